@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -20,6 +21,8 @@ var (
 	errDeleteDefaultAdmin = errors.New("default admin cannot be deleted")
 	errProtectedRole      = errors.New("protected admin role cannot change")
 	errAdminRename        = errors.New("admin username cannot change")
+	errInvalidUserPin     = errors.New("pin must be 4-8 digits")
+	errCredentialInUse    = errors.New("pin or card number already in use")
 )
 
 type adminUserPayload struct {
@@ -35,6 +38,12 @@ type adminUserPayload struct {
 	YearlyTopupCents  int64  `json:"yearlyTopupCents"`
 	MonthlyLimitCents int64  `json:"monthlyLimitCents"`
 	YearlyLimitCents  int64  `json:"yearlyLimitCents"`
+	// Pin and CardNumber are left unchanged when omitted and cleared when
+	// empty.
+	Pin        *string `json:"pin"`
+	CardNumber *string `json:"cardNumber"`
+	// Group is left unchanged when omitted.
+	Group *string `json:"group"`
 }
 
 type adminUserResponse struct {
@@ -51,6 +60,9 @@ type adminUserResponse struct {
 	YearlyTopupCents  int64  `json:"yearlyTopupCents"`
 	MonthlyLimitCents int64  `json:"monthlyLimitCents"`
 	YearlyLimitCents  int64  `json:"yearlyLimitCents"`
+	HasPin            bool   `json:"hasPin"`
+	CardNumber        string `json:"cardNumber"`
+	Group             string `json:"group"`
 	CreatedAt         string `json:"createdAt"`
 	UpdatedAt         string `json:"updatedAt"`
 }
@@ -60,9 +72,13 @@ type topupPayload struct {
 }
 
 type settingsPayload struct {
-	PerPageCents   *int64 `json:"perPageCents"`
-	ColorPageCents *int64 `json:"colorPageCents"`
-	RetentionDays  *int64 `json:"retentionDays"`
+	PerPageCents      *int64 `json:"perPageCents"`
+	ColorPageCents    *int64 `json:"colorPageCents"`
+	RetentionDays     *int64 `json:"retentionDays"`
+	LowBalanceCents   *int64 `json:"lowBalanceCents"`
+	PrintRetryMinutes *int64 `json:"printRetryMinutes"`
+	HoldExpiryHours   *int64 `json:"holdExpiryHours"`
+	LibraryQuotaBytes *int64 `json:"libraryQuotaBytes"`
 }
 
 type topupResponse struct {
@@ -116,6 +132,18 @@ func adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "invalid amounts")
 		return
 	}
+	if payload.CardNumber != nil {
+		card := strings.TrimSpace(*payload.CardNumber)
+		payload.CardNumber = &card
+	}
+	if payload.Pin != nil && *payload.Pin != "" && !validReleasePin(*payload.Pin) {
+		writeJSONError(w, http.StatusBadRequest, errInvalidUserPin.Error())
+		return
+	}
+	group := ""
+	if payload.Group != nil {
+		group = strings.TrimSpace(*payload.Group)
+	}
 	hash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "failed to hash password")
@@ -138,14 +166,23 @@ func adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
 			YearlyTopupCents:  payload.YearlyTopupCents,
 			MonthlyLimitCents: payload.MonthlyLimitCents,
 			YearlyLimitCents:  payload.YearlyLimitCents,
+			Group:             group,
 		})
 		if err != nil {
 			return err
 		}
+		user, err = setKioskCredentials(r.Context(), tx, user.ID, payload.Pin, payload.CardNumber)
+		if err != nil {
+			return err
+		}
 		created = user
-		return nil
+		return enqueueEvent(r.Context(), tx, eventUserCreated, mapAdminUser(user))
 	})
 	if err != nil {
+		if errors.Is(err, errCredentialInUse) {
+			writeJSONError(w, http.StatusConflict, errCredentialInUse.Error())
+			return
+		}
 		writeJSONError(w, http.StatusInternalServerError, "failed to create user")
 		return
 	}
@@ -178,6 +215,18 @@ func adminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "invalid amounts")
 		return
 	}
+	if payload.CardNumber != nil {
+		card := strings.TrimSpace(*payload.CardNumber)
+		payload.CardNumber = &card
+	}
+	if payload.Group != nil {
+		group := strings.TrimSpace(*payload.Group)
+		payload.Group = &group
+	}
+	if payload.Pin != nil && *payload.Pin != "" && !validReleasePin(*payload.Pin) {
+		writeJSONError(w, http.StatusBadRequest, errInvalidUserPin.Error())
+		return
+	}
 
 	var pwdHash *string
 	if strings.TrimSpace(payload.Password) != "" {
@@ -219,14 +268,23 @@ func adminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 			YearlyTopupCents:  payload.YearlyTopupCents,
 			MonthlyLimitCents: payload.MonthlyLimitCents,
 			YearlyLimitCents:  payload.YearlyLimitCents,
+			Group:             payload.Group,
 		})
 		if err != nil {
 			return err
 		}
+		user, err = setKioskCredentials(r.Context(), tx, user.ID, payload.Pin, payload.CardNumber)
+		if err != nil {
+			return err
+		}
 		updated = user
 		return nil
 	})
 	if err != nil {
+		if errors.Is(err, errCredentialInUse) {
+			writeJSONError(w, http.StatusConflict, errCredentialInUse.Error())
+			return
+		}
 		if errors.Is(err, errAdminRename) {
 			writeJSONError(w, http.StatusBadRequest, errAdminRename.Error())
 			return
@@ -310,11 +368,12 @@ func adminTopupHandler(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 		opID := sess.UserID
-		if _, err := store.InsertTopup(r.Context(), tx, user.ID, payload.AmountCents, before, after, "manual", &opID, sess.Username); err != nil {
+		topupID, err := store.InsertTopup(r.Context(), tx, user.ID, payload.AmountCents, before, after, "manual", &opID, sess.Username)
+		if err != nil {
 			return err
 		}
 		newBalance = after
-		return nil
+		return enqueueTopupEvent(r.Context(), tx, topupID)
 	})
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -324,6 +383,8 @@ func adminTopupHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	go notifyUserThresholds(context.Background(), id)
+	publishBalance(r.Context(), id)
 	writeJSON(w, map[string]int64{"balanceCents": newBalance})
 }
 
@@ -359,6 +420,10 @@ func adminGetSettingsHandler(w http.ResponseWriter, r *http.Request) {
 	var perPage int64
 	var colorPage int64
 	var retention int64
+	var lowBalance int64
+	var retryMinutes int64
+	var holdHours int64
+	var libraryQuota int64
 	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
 		val, err := store.GetSettingInt(r.Context(), tx, store.SettingPerPageCents, store.DefaultPerPageCents)
 		if err != nil {
@@ -375,13 +440,41 @@ func adminGetSettingsHandler(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 		retention = val
+		val, err = store.GetSettingInt(r.Context(), tx, store.SettingLowBalanceCents, 0)
+		if err != nil {
+			return err
+		}
+		lowBalance = val
+		val, err = store.GetSettingInt(r.Context(), tx, store.SettingPrintRetryMinutes, store.DefaultPrintRetryMinutes)
+		if err != nil {
+			return err
+		}
+		retryMinutes = val
+		val, err = store.GetSettingInt(r.Context(), tx, store.SettingHoldExpiryHours, store.DefaultHoldExpiryHours)
+		if err != nil {
+			return err
+		}
+		holdHours = val
+		val, err = store.GetSettingInt(r.Context(), tx, store.SettingLibraryQuotaBytes, store.DefaultLibraryQuotaBytes)
+		if err != nil {
+			return err
+		}
+		libraryQuota = val
 		return nil
 	})
 	if err != nil {
 		writeJSONError(w, http.StatusInternalServerError, "failed to load settings")
 		return
 	}
-	writeJSON(w, map[string]int64{"perPageCents": perPage, "colorPageCents": colorPage, "retentionDays": retention})
+	writeJSON(w, map[string]int64{
+		"perPageCents":      perPage,
+		"colorPageCents":    colorPage,
+		"retentionDays":     retention,
+		"lowBalanceCents":   lowBalance,
+		"printRetryMinutes": retryMinutes,
+		"holdExpiryHours":   holdHours,
+		"libraryQuotaBytes": libraryQuota,
+	})
 }
 
 func adminUpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
@@ -415,6 +508,38 @@ func adminUpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
 				return err
 			}
 		}
+		if payload.LowBalanceCents != nil {
+			if *payload.LowBalanceCents < 0 {
+				return errors.New("invalid lowBalanceCents")
+			}
+			if err := store.SetSettingInt(r.Context(), tx, store.SettingLowBalanceCents, *payload.LowBalanceCents); err != nil {
+				return err
+			}
+		}
+		if payload.PrintRetryMinutes != nil {
+			if *payload.PrintRetryMinutes < 0 {
+				return errors.New("invalid printRetryMinutes")
+			}
+			if err := store.SetSettingInt(r.Context(), tx, store.SettingPrintRetryMinutes, *payload.PrintRetryMinutes); err != nil {
+				return err
+			}
+		}
+		if payload.HoldExpiryHours != nil {
+			if *payload.HoldExpiryHours < 0 {
+				return errors.New("invalid holdExpiryHours")
+			}
+			if err := store.SetSettingInt(r.Context(), tx, store.SettingHoldExpiryHours, *payload.HoldExpiryHours); err != nil {
+				return err
+			}
+		}
+		if payload.LibraryQuotaBytes != nil {
+			if *payload.LibraryQuotaBytes < 0 {
+				return errors.New("invalid libraryQuotaBytes")
+			}
+			if err := store.SetSettingInt(r.Context(), tx, store.SettingLibraryQuotaBytes, *payload.LibraryQuotaBytes); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -465,6 +590,9 @@ func mapAdminUser(user store.User) adminUserResponse {
 		YearlyTopupCents:  user.YearlyTopupCents,
 		MonthlyLimitCents: user.MonthlyLimitCents,
 		YearlyLimitCents:  user.YearlyLimitCents,
+		HasPin:            user.PinHash != "",
+		CardNumber:        user.CardNumber,
+		Group:             user.Group,
 		CreatedAt:         user.CreatedAt,
 		UpdatedAt:         user.UpdatedAt,
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cups-web/internal/store"
+)
+
+// 相册打印：一次上传多张照片，按网格每页排多张，可在照片下方标注文件名或
+// 拍摄日期，最终合成一个 PDF 任务。
+
+const (
+	albumCaptionFilename = "filename"
+	albumCaptionDate     = "date"
+
+	// maxAlbumFiles bounds how many photos one album submission may hold.
+	maxAlbumFiles = 100
+)
+
+// albumOptions are stored on album jobs. The grid and fit come from the
+// image layout.
+type albumOptions struct {
+	Caption string `json:"caption,omitempty"`
+}
+
+// parseAlbumOptions reads the album and caption form fields. It returns nil
+// when the submission is not an album.
+func parseAlbumOptions(r *http.Request) (*albumOptions, error) {
+	if r.FormValue("album") != "true" {
+		return nil, nil
+	}
+	switch caption := strings.TrimSpace(r.FormValue("caption")); caption {
+	case "", "none":
+		return &albumOptions{}, nil
+	case albumCaptionFilename, albumCaptionDate:
+		return &albumOptions{Caption: caption}, nil
+	default:
+		return nil, errors.New("caption must be none, filename or date")
+	}
+}
+
+func (a albumOptions) caption(path string, filename string) string {
+	switch a.Caption {
+	case albumCaptionFilename:
+		return filename
+	case albumCaptionDate:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		return exifDate(data)
+	}
+	return ""
+}
+
+// prepareAlbumDocument lays out the photos of an album job into storedAbs.
+// Like merged jobs, the parts are removed once the album is written.
+func prepareAlbumDocument(ctx context.Context, storedAbs string, parts []store.PrintJobFile, layout imageLayout, album albumOptions) (printDocument, error) {
+	doc := printDocument{path: storedAbs, mime: "application/pdf", cleanup: func() {}}
+	if pages, err := countPDFPages(storedAbs); err == nil {
+		doc.pages = pages
+		return doc, nil
+	}
+
+	items := make([]imageItem, 0, len(parts))
+	for _, part := range parts {
+		if err := ctx.Err(); err != nil {
+			return doc, err
+		}
+		partAbs := filepath.Join(uploadDir, filepath.FromSlash(part.StoredPath))
+		items = append(items, imageItem{Path: partAbs, Caption: album.caption(partAbs, part.Filename)})
+	}
+	outPath, cleanup, err := writeImagePDF(items, layout)
+	if err != nil {
+		return doc, err
+	}
+	defer cleanup()
+	if err := copyFile(outPath, storedAbs); err != nil {
+		_ = os.Remove(storedAbs)
+		return doc, err
+	}
+	doc.pages, err = countPDFPages(storedAbs)
+	if err != nil {
+		return doc, err
+	}
+	for _, part := range parts {
+		_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(part.StoredPath)))
+	}
+	return doc, nil
+}
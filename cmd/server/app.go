@@ -1,6 +1,12 @@
 package main
 
-import "cups-web/internal/store"
+import (
+	"cups-web/internal/events"
+	"cups-web/internal/notify"
+	"cups-web/internal/store"
+)
 
 var appStore *store.Store
 var uploadDir string
+var appMailer notify.Mailer
+var appEvents = events.NewHub()
@@ -34,6 +34,11 @@ func writeJSONError(w http.ResponseWriter, status int, msg string) {
 	writeJSONStatus(w, status, map[string]string{"error": msg})
 }
 
+// writeJSONErrorCode adds a machine-readable code to the error response.
+func writeJSONErrorCode(w http.ResponseWriter, status int, code string, msg string) {
+	writeJSONStatus(w, status, map[string]string{"error": msg, "code": code})
+}
+
 func randomToken() string {
 	b := make([]byte, 16)
 	_, _ = rand.Read(b)
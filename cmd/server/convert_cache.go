@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 转换缓存：外部转换后端（LibreOffice 等）的结果按文件内容的 SHA-256 和
+// 后端名称缓存，先估价再打印时只转换一次。缓存总大小超过上限时删除最久
+// 未使用的条目。
+
+const (
+	convertCacheDir       = "convert-cache"
+	defaultConvertCacheMB = 512
+	convertCacheTmpPrefix = "tmp-"
+)
+
+// convertCacheMu serializes writes and eviction; reads copy the entry out
+// and need no lock.
+var convertCacheMu sync.Mutex
+
+// convertCacheLimit returns the cache size in bytes from CONVERT_CACHE_MB.
+// Zero disables the cache.
+func convertCacheLimit() int64 {
+	mb := defaultConvertCacheMB
+	if v, err := strconv.Atoi(os.Getenv("CONVERT_CACHE_MB")); err == nil && v >= 0 {
+		mb = v
+	}
+	return int64(mb) << 20
+}
+
+// convertKey hashes the file contents together with the file extension and
+// any conversion options that change the output.
+func convertKey(path string, name string, conv convertOptions) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "\x00ext:%s", strings.ToLower(filepath.Ext(name)))
+	if !conv.Text.isZero() {
+		fmt.Fprintf(h, "\x00text:%v:%s", conv.Text.FontSize, conv.Text.Orientation)
+	}
+	if !conv.Image.isZero() {
+		l := conv.Image
+		fmt.Fprintf(h, "\x00image:%s:%dx%d:%t:%s", l.Fit, l.Cols, l.Rows, l.Repeat, l.Orientation)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// convertWithCache returns a copy of the PDF cached for the file and
+// backend, or runs convert and caches its result. Only external backends are
+// cached; they ignore the conversion options. The caller owns the returned
+// file either way and must call cleanup.
+func convertWithCache(path string, name string, backend string, convert func() (string, func(), error)) (string, func(), error) {
+	limit := convertCacheLimit()
+	if limit <= 0 {
+		return convert()
+	}
+	key, err := convertKey(path, name, convertOptions{})
+	if err != nil {
+		return convert()
+	}
+	dir := filepath.Join(uploadDir, convertCacheDir)
+	entry := filepath.Join(dir, backend+"-"+key+".pdf")
+	if out, cleanup, err := checkoutCachedPDF(entry); err == nil {
+		return out, cleanup, nil
+	}
+
+	out, cleanup, err := convert()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := storeCachedPDF(dir, entry, out, limit); err != nil {
+		log.Println("store conversion cache failed:", err)
+	}
+	return out, cleanup, nil
+}
+
+func checkoutCachedPDF(entry string) (string, func(), error) {
+	if _, err := os.Stat(entry); err != nil {
+		return "", nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "convert-cached-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	out := filepath.Join(tmpDir, filepath.Base(entry))
+	// the entry may be evicted meanwhile, which is just a miss
+	if err := copyFile(entry, out); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(entry, now, now)
+	return out, cleanup, nil
+}
+
+func storeCachedPDF(dir string, entry string, src string, limit int64) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() > limit {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, convertCacheTmpPrefix+"*.pdf")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	if err := copyFile(src, tmpPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	convertCacheMu.Lock()
+	defer convertCacheMu.Unlock()
+	if err := os.Rename(tmpPath, entry); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	evictConvertCache(dir, limit)
+	return nil
+}
+
+// evictConvertCache removes the least recently used entries until the cache
+// fits limit, along with copies left by interrupted writes. The caller holds
+// convertCacheMu.
+func evictConvertCache(dir string, limit int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var list []cached
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), convertCacheTmpPrefix) {
+			if time.Since(info.ModTime()) > time.Hour {
+				_ = os.Remove(path)
+			}
+			continue
+		}
+		list = append(list, cached{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].modTime.Before(list[j].modTime) })
+	for _, c := range list {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(c.path); err != nil {
+			log.Println("evict conversion cache failed:", err)
+			continue
+		}
+		total -= c.size
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+
+	"cups-web/internal/auth"
 )
 
 func convertHandler(w http.ResponseWriter, r *http.Request) {
@@ -27,9 +30,14 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer cleanup()
 
-	ctx, cancel := convertTimeoutContext(r.Context())
+	sess, _ := auth.GetSession(r)
+	ctx, cancel := convertTimeoutContext(withConvertOwner(r.Context(), sess.UserID))
 	defer cancel()
-	outPath, outCleanup, err := convertOfficeToPDF(ctx, inPath)
+	outPath, outCleanup, err := convertDocument(ctx, inPath, fh.Filename, fileKindOffice, convertOptions{})
+	if errors.Is(err, errOfficeQueueFull) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		http.Error(w, "conversion failed: "+err.Error(), http.StatusInternalServerError)
 		return
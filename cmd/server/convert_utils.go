@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -10,22 +11,72 @@ import (
 	"time"
 )
 
+// convertOptions tune how an upload is converted to PDF.
+type convertOptions struct {
+	Text  textLayout
+	Image imageLayout
+}
+
+func (c convertOptions) isZero() bool {
+	return c.Text.isZero() && c.Image.isZero()
+}
+
+// parseConvertOptions reads the conversion form fields.
+func parseConvertOptions(r *http.Request) (convertOptions, error) {
+	text, err := parseTextLayout(r)
+	if err != nil {
+		return convertOptions{}, err
+	}
+	img, err := parseImageLayout(r)
+	if err != nil {
+		return convertOptions{}, err
+	}
+	return convertOptions{Text: text, Image: img}, nil
+}
+
+// convertOfficeToPDF runs LibreOffice in a slot of the converter pool, so at
+// most LIBREOFFICE_WORKERS conversions run at once, each with its own profile.
 func convertOfficeToPDF(ctx context.Context, inputPath string) (string, func(), error) {
+	slot, err := officeConverters.acquire(ctx, convertOwner(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	defer officeConverters.release(slot)
+
 	tmpDir, err := os.MkdirTemp("", "convert-")
 	if err != nil {
 		return "", nil, err
 	}
 	cleanup := func() { _ = os.RemoveAll(tmpDir) }
 
-	cmd := exec.CommandContext(ctx, "libreoffice", "--headless", "--convert-to", "pdf", "--outdir", tmpDir, inputPath)
-	if out, err := cmd.CombinedOutput(); err != nil {
+	runCtx, cancel := context.WithTimeout(ctx, officeConvertTimeout)
+	defer cancel()
+	start := time.Now()
+	base := filepath.Base(inputPath)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	outPath := filepath.Join(tmpDir, name+".pdf")
+	var out []byte
+	if officeConverters.persistent {
+		var started bool
+		started, out, err = officeConverters.slots[slot].convert(runCtx, inputPath, outPath)
+		if started {
+			officeConverters.noteWorkerStart()
+		}
+	} else {
+		cmd := exec.CommandContext(runCtx, "libreoffice", "-env:UserInstallation="+officeConverters.profileURL(slot),
+			"--headless", "--convert-to", "pdf", "--outdir", tmpDir, inputPath)
+		killProcessGroup(cmd)
+		out, err = cmd.CombinedOutput()
+	}
+	if err != nil && runCtx.Err() != nil {
+		err = runCtx.Err()
+	}
+	officeConverters.observe(time.Since(start), err)
+	if err != nil {
 		cleanup()
 		return "", nil, fmt.Errorf("conversion failed: %w - %s", err, string(out))
 	}
 
-	base := filepath.Base(inputPath)
-	name := strings.TrimSuffix(base, filepath.Ext(base))
-	outPath := filepath.Join(tmpDir, name+".pdf")
 	if _, err := os.Stat(outPath); os.IsNotExist(err) {
 		matches, _ := filepath.Glob(filepath.Join(tmpDir, "*.pdf"))
 		if len(matches) == 0 {
@@ -38,6 +89,17 @@ func convertOfficeToPDF(ctx context.Context, inputPath string) (string, func(),
 	return outPath, cleanup, nil
 }
 
+// convertTimeout bounds a whole conversion, including the wait for a
+// LibreOffice slot.
+const convertTimeout = 2 * time.Minute
+
 func convertTimeoutContext(ctx context.Context) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(ctx, 60*time.Second)
+	return context.WithTimeout(ctx, convertTimeout)
+}
+
+// extendWriteDeadline lets a handler that converts while the client waits
+// respond after the server-wide WriteTimeout, which is shorter than a
+// conversion may take.
+func extendWriteDeadline(w http.ResponseWriter) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(convertTimeout + time.Minute))
 }
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+// 可插拔转换后端：按文件类型选择转换器，可按扩展名改用 unoserver、
+// Gotenberg 兼容的 HTTP 服务、自定义命令或用于测试的 fake 后端。
+//
+//	CONVERTER_DEFAULT=gotenberg                 办公文档和 HTML 的默认后端
+//	CONVERTER_BACKENDS=.html=command,.pptx=unoserver
+
+// Converter turns an upload into a PDF. The caller removes the result with
+// cleanup.
+type Converter interface {
+	Convert(ctx context.Context, inputPath string, conv convertOptions) (string, func(), error)
+}
+
+// ConverterFunc adapts a function to the Converter interface.
+type ConverterFunc func(ctx context.Context, inputPath string, conv convertOptions) (string, func(), error)
+
+func (f ConverterFunc) Convert(ctx context.Context, inputPath string, conv convertOptions) (string, func(), error) {
+	return f(ctx, inputPath, conv)
+}
+
+const (
+	backendLibreOffice = "libreoffice"
+	backendUnoserver   = "unoserver"
+	backendGotenberg   = "gotenberg"
+	backendCommand     = "command"
+	backendFake        = "fake"
+	backendText        = "text"
+	backendMarkdown    = "markdown"
+	backendImage       = "image"
+)
+
+var errNoConverter = errors.New("no converter for this file type")
+
+// converterBackend is a named converter. External backends run outside the
+// process and have their results cached.
+type converterBackend struct {
+	name      string
+	converter Converter
+	external  bool
+}
+
+type converterRegistry struct {
+	byKind map[fileKind]converterBackend
+	byExt  map[string]converterBackend
+}
+
+// converters is the process-wide registry, configured by startConverters.
+var converters = mustConverterRegistry(func(string) string { return "" })
+
+// startConverters configures the registry from the environment.
+func startConverters() error {
+	reg, err := newConverterRegistry(os.Getenv)
+	if err != nil {
+		return err
+	}
+	converters = reg
+	return nil
+}
+
+func mustConverterRegistry(getenv func(string) string) *converterRegistry {
+	reg, err := newConverterRegistry(getenv)
+	if err != nil {
+		panic(err)
+	}
+	return reg
+}
+
+// newConverterRegistry builds the registry: built-in renderers for text,
+// Markdown and images, CONVERTER_DEFAULT (libreoffice when unset) for office
+// documents and HTML, and CONVERTER_BACKENDS overrides per extension.
+func newConverterRegistry(getenv func(string) string) (*converterRegistry, error) {
+	reg := &converterRegistry{byKind: map[fileKind]converterBackend{}, byExt: map[string]converterBackend{}}
+	def := strings.TrimSpace(getenv("CONVERTER_DEFAULT"))
+	if def == "" {
+		def = backendLibreOffice
+	}
+	office, err := newConverterBackend(def, "", getenv)
+	if err != nil {
+		return nil, err
+	}
+	reg.byKind[fileKindOffice] = office
+	reg.byKind[fileKindHTML] = office
+	for kind, name := range map[fileKind]string{fileKindText: backendText, fileKindMarkdown: backendMarkdown, fileKindImage: backendImage} {
+		reg.byKind[kind], _ = newConverterBackend(name, "", getenv)
+	}
+
+	spec := strings.TrimSpace(getenv("CONVERTER_BACKENDS"))
+	if spec == "" {
+		return reg, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		ext, name, ok := strings.Cut(strings.TrimSpace(item), "=")
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !ok || ext == "" {
+			return nil, fmt.Errorf("CONVERTER_BACKENDS: invalid entry %q", item)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		b, err := newConverterBackend(strings.TrimSpace(name), ext, getenv)
+		if err != nil {
+			return nil, fmt.Errorf("CONVERTER_BACKENDS %s: %w", ext, err)
+		}
+		reg.byExt[ext] = b
+	}
+	return reg, nil
+}
+
+func newConverterBackend(name string, ext string, getenv func(string) string) (converterBackend, error) {
+	b := converterBackend{name: name, external: true}
+	switch name {
+	case backendLibreOffice:
+		b.converter = ConverterFunc(func(ctx context.Context, inputPath string, _ convertOptions) (string, func(), error) {
+			return convertOfficeToPDF(ctx, inputPath)
+		})
+	case backendUnoserver:
+		host, port := getenv("UNOSERVER_HOST"), getenv("UNOSERVER_PORT")
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if port == "" {
+			port = "2003"
+		}
+		b.converter = commandConverter{args: []string{"unoconvert", "--host", host, "--port", port, "--convert-to", "pdf", "{in}", "{out}"}}
+	case backendGotenberg:
+		url := strings.TrimRight(getenv("GOTENBERG_URL"), "/")
+		if url == "" {
+			return b, errors.New("gotenberg backend needs GOTENBERG_URL")
+		}
+		b.converter = gotenbergConverter{baseURL: url, client: http.DefaultClient}
+	case backendCommand:
+		// CONVERT_COMMAND_HTML overrides CONVERT_COMMAND for .html files
+		command := getenv("CONVERT_COMMAND_" + strings.ToUpper(strings.TrimPrefix(ext, ".")))
+		if ext == "" || command == "" {
+			command = getenv("CONVERT_COMMAND")
+		}
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return b, errors.New("command backend needs CONVERT_COMMAND")
+		}
+		b.converter = commandConverter{args: args}
+	case backendFake:
+		b.converter = ConverterFunc(fakeConvert)
+		b.external = false
+	case backendText:
+		b.converter = ConverterFunc(func(_ context.Context, inputPath string, conv convertOptions) (string, func(), error) {
+			return convertTextToPDF(inputPath, conv.Text)
+		})
+		b.external = false
+	case backendMarkdown:
+		b.converter = ConverterFunc(func(_ context.Context, inputPath string, _ convertOptions) (string, func(), error) {
+			return convertMarkdownToPDF(inputPath)
+		})
+		b.external = false
+	case backendImage:
+		b.converter = ConverterFunc(func(_ context.Context, inputPath string, conv convertOptions) (string, func(), error) {
+			return convertImageToPDF(inputPath, conv.Image)
+		})
+		b.external = false
+	default:
+		return b, fmt.Errorf("unknown converter backend %q", name)
+	}
+	return b, nil
+}
+
+// lookup returns the backend for a file: the extension override when there
+// is one, otherwise the backend of its kind.
+func (reg *converterRegistry) lookup(kind fileKind, filename string) (converterBackend, bool) {
+	if b, ok := reg.byExt[strings.ToLower(filepath.Ext(filename))]; ok {
+		return b, true
+	}
+	b, ok := reg.byKind[kind]
+	return b, ok
+}
+
+// overridden reports whether the file's extension has its own backend.
+func (reg *converterRegistry) overridden(filename string) bool {
+	_, ok := reg.byExt[strings.ToLower(filepath.Ext(filename))]
+	return ok
+}
+
+// needsConversion reports whether a file is converted to PDF before
+// printing. Files of unknown kind are sent as they are unless their
+// extension has a backend.
+func needsConversion(kind fileKind, filename string) bool {
+	if kind == fileKindPDF {
+		return false
+	}
+	_, ok := converters.lookup(kind, filename)
+	return ok
+}
+
+// usesConvertOptions reports whether the backend for a file renders it
+// itself and so honours the conversion options.
+func usesConvertOptions(kind fileKind, filename string) bool {
+	b, ok := converters.lookup(kind, filename)
+	return ok && !b.external
+}
+
+// convertDocument converts an upload of the given kind to PDF with the
+// configured backend.
+func convertDocument(ctx context.Context, path string, filename string, kind fileKind, conv convertOptions) (string, func(), error) {
+	b, ok := converters.lookup(kind, filename)
+	if !ok {
+		return "", nil, errNoConverter
+	}
+	if !b.external {
+		return b.converter.Convert(ctx, path, conv)
+	}
+	return convertWithCache(path, filename, b.name, func() (string, func(), error) {
+		return b.converter.Convert(ctx, path, conv)
+	})
+}
+
+// commandConverter runs a command line. {in} is replaced by the input path,
+// {out} by the PDF to write and {outdir} by its directory; without {out}
+// the command may write any single PDF into {outdir}.
+type commandConverter struct {
+	args []string
+}
+
+func (c commandConverter) Convert(ctx context.Context, inputPath string, _ convertOptions) (string, func(), error) {
+	tmpDir, err := os.MkdirTemp("", "convert-cmd-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	base := filepath.Base(inputPath)
+	outPath := filepath.Join(tmpDir, strings.TrimSuffix(base, filepath.Ext(base))+".pdf")
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		a = strings.ReplaceAll(a, "{in}", inputPath)
+		a = strings.ReplaceAll(a, "{outdir}", tmpDir)
+		args[i] = strings.ReplaceAll(a, "{out}", outPath)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	killProcessGroup(cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("conversion failed: %w - %s", err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(outPath); err != nil {
+		matches, _ := filepath.Glob(filepath.Join(tmpDir, "*.pdf"))
+		if len(matches) == 0 {
+			cleanup()
+			return "", nil, errors.New("conversion produced no PDF")
+		}
+		outPath = matches[0]
+	}
+	return outPath, cleanup, nil
+}
+
+// gotenbergConverter posts the file to a Gotenberg compatible service. HTML
+// goes to the Chromium route, everything else to LibreOffice.
+type gotenbergConverter struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (g gotenbergConverter) Convert(ctx context.Context, inputPath string, _ convertOptions) (string, func(), error) {
+	route, name := "/forms/libreoffice/convert", filepath.Base(inputPath)
+	switch strings.ToLower(filepath.Ext(inputPath)) {
+	case ".html", ".htm":
+		// the Chromium route renders the file named index.html
+		route, name = "/forms/chromium/convert/html", "index.html"
+	}
+
+	in, err := os.Open(inputPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("files", name)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := io.Copy(part, in); err != nil {
+		return "", nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+route, &body)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("conversion failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", nil, fmt.Errorf("conversion failed: %s - %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	tmpDir, err := os.MkdirTemp("", "convert-http-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	outPath := filepath.Join(tmpDir, "converted.pdf")
+	out, err := os.Create(outPath)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := out.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
+
+// fakeConvert writes a one-page PDF naming the input, standing in for a real
+// backend in tests and development setups without LibreOffice.
+func fakeConvert(_ context.Context, inputPath string, _ convertOptions) (string, func(), error) {
+	tmpDir, err := os.MkdirTemp("", "convert-fake-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetFont("Helvetica", "", 12)
+	pdf.AddPage()
+	pdf.Text(pdfPageMarginMM, 2*pdfPageMarginMM, "fake conversion of "+filepath.Base(inputPath))
+	outPath := filepath.Join(tmpDir, "fake.pdf")
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
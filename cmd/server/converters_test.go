@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func envFunc(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestNewConverterRegistry(t *testing.T) {
+	reg, err := newConverterRegistry(envFunc(map[string]string{
+		"CONVERTER_DEFAULT":  "fake",
+		"CONVERTER_BACKENDS": " .HTML=command , pptx=unoserver,.odt=gotenberg",
+		"CONVERT_COMMAND":    "convert {in} {out}",
+		"GOTENBERG_URL":      "http://gotenberg:3000/",
+		"UNOSERVER_PORT":     "2004",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, want := range map[fileKind]string{
+		fileKindOffice:   backendFake,
+		fileKindHTML:     backendFake,
+		fileKindText:     backendText,
+		fileKindMarkdown: backendMarkdown,
+		fileKindImage:    backendImage,
+	} {
+		if b, ok := reg.byKind[kind]; !ok || b.name != want {
+			t.Errorf("byKind[%s] = %q, want %q", kind, b.name, want)
+		}
+	}
+	if _, ok := reg.byKind[fileKindPDF]; ok {
+		t.Errorf("PDF has a converter")
+	}
+	for ext, want := range map[string]string{".html": backendCommand, ".pptx": backendUnoserver, ".odt": backendGotenberg} {
+		if b, ok := reg.byExt[ext]; !ok || b.name != want {
+			t.Errorf("byExt[%s] = %q, want %q", ext, b.name, want)
+		}
+	}
+
+	uno := reg.byExt[".pptx"].converter.(commandConverter)
+	if got := strings.Join(uno.args, " "); got != "unoconvert --host 127.0.0.1 --port 2004 --convert-to pdf {in} {out}" {
+		t.Errorf("unoserver command = %q", got)
+	}
+	if g := reg.byExt[".odt"].converter.(gotenbergConverter); g.baseURL != "http://gotenberg:3000" {
+		t.Errorf("gotenberg URL = %q", g.baseURL)
+	}
+}
+
+func TestNewConverterRegistryDefaults(t *testing.T) {
+	reg, err := newConverterRegistry(envFunc(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := reg.byKind[fileKindOffice]; b.name != backendLibreOffice || !b.external {
+		t.Errorf("office backend = %+v, want external libreoffice", b)
+	}
+	if len(reg.byExt) != 0 {
+		t.Errorf("byExt = %v, want empty", reg.byExt)
+	}
+}
+
+func TestNewConverterRegistryCommandPerExtension(t *testing.T) {
+	reg, err := newConverterRegistry(envFunc(map[string]string{
+		"CONVERTER_BACKENDS":   ".html=command,.rtf=command",
+		"CONVERT_COMMAND":      "generic {in}",
+		"CONVERT_COMMAND_HTML": "wkhtmltopdf {in} {out}",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.byExt[".html"].converter.(commandConverter).args[0]; got != "wkhtmltopdf" {
+		t.Errorf(".html command = %q, want wkhtmltopdf", got)
+	}
+	if got := reg.byExt[".rtf"].converter.(commandConverter).args[0]; got != "generic" {
+		t.Errorf(".rtf command = %q, want generic", got)
+	}
+}
+
+func TestNewConverterRegistryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"unknown default", map[string]string{"CONVERTER_DEFAULT": "magic"}, `unknown converter backend "magic"`},
+		{"gotenberg without URL", map[string]string{"CONVERTER_DEFAULT": "gotenberg"}, "GOTENBERG_URL"},
+		{"command without command", map[string]string{"CONVERTER_DEFAULT": "command"}, "CONVERT_COMMAND"},
+		{"entry without backend", map[string]string{"CONVERTER_BACKENDS": ".html"}, "invalid entry"},
+		{"entry without extension", map[string]string{"CONVERTER_BACKENDS": "=fake"}, "invalid entry"},
+		{"unknown override", map[string]string{"CONVERTER_BACKENDS": ".html=fake,.doc=magic"}, "CONVERTER_BACKENDS .doc"},
+		{"override needs its settings", map[string]string{"CONVERTER_BACKENDS": ".odt=gotenberg"}, "GOTENBERG_URL"},
+	}
+	for _, tt := range tests {
+		_, err := newConverterRegistry(envFunc(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConverterLookup(t *testing.T) {
+	reg, err := newConverterRegistry(envFunc(map[string]string{
+		"CONVERTER_BACKENDS": ".HTML=fake,.dat=fake",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind     fileKind
+		filename string
+		want     string
+		ok       bool
+	}{
+		{fileKindHTML, "page.html", backendFake, true},
+		{fileKindHTML, "PAGE.Html", backendFake, true},
+		{fileKindHTML, "page.htm", backendLibreOffice, true},
+		{fileKindOffice, "report.docx", backendLibreOffice, true},
+		{fileKindText, "notes.txt", backendText, true},
+		{fileKindOther, "data.dat", backendFake, true},
+		{fileKindOther, "data.bin", "", false},
+		{fileKindPDF, "doc.pdf", "", false},
+	}
+	for _, tt := range tests {
+		b, ok := reg.lookup(tt.kind, tt.filename)
+		if ok != tt.ok || b.name != tt.want {
+			t.Errorf("lookup(%s, %q) = %q, %v, want %q, %v", tt.kind, tt.filename, b.name, ok, tt.want, tt.ok)
+		}
+	}
+	if !reg.overridden("a.dat") || reg.overridden("a.docx") {
+		t.Errorf("overridden does not follow CONVERTER_BACKENDS")
+	}
+}
+
+func writeTempFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGotenbergConverter(t *testing.T) {
+	type request struct{ path, name, content string }
+	var got request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("files")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		got = request{r.URL.Path, h.Filename, string(b)}
+		w.Write([]byte("%PDF-1.4 converted"))
+	}))
+	defer srv.Close()
+	g := gotenbergConverter{baseURL: srv.URL, client: srv.Client()}
+
+	tests := []struct {
+		file string
+		want request
+	}{
+		{"report.docx", request{"/forms/libreoffice/convert", "report.docx", "docx data"}},
+		{"page.HTML", request{"/forms/chromium/convert/html", "index.html", "docx data"}},
+	}
+	for _, tt := range tests {
+		in := writeTempFile(t, tt.file, "docx data")
+		out, cleanup, err := g.Convert(context.Background(), in, convertOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: request = %+v, want %+v", tt.file, got, tt.want)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil || string(b) != "%PDF-1.4 converted" {
+			t.Errorf("%s: output = %q, %v", tt.file, b, err)
+		}
+		cleanup()
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: cleanup left %s", tt.file, out)
+		}
+	}
+}
+
+func TestGotenbergConverterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "LibreOffice failed", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	g := gotenbergConverter{baseURL: srv.URL, client: srv.Client()}
+
+	in := writeTempFile(t, "report.docx", "docx data")
+	_, _, err := g.Convert(context.Background(), in, convertOptions{})
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "LibreOffice failed") {
+		t.Errorf("err = %v, want the status and message", err)
+	}
+
+	srv.Close()
+	if _, _, err := g.Convert(context.Background(), in, convertOptions{}); err == nil {
+		t.Errorf("conversion against a closed server succeeded")
+	}
+}
+
+func TestConvertDocumentFakeBackend(t *testing.T) {
+	reg, err := newConverterRegistry(envFunc(map[string]string{
+		"CONVERTER_DEFAULT":  "fake",
+		"CONVERTER_BACKENDS": ".dat=fake",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := converters
+	converters = reg
+	defer func() { converters = saved }()
+
+	for _, name := range []string{"report.docx", "page.html", "data.dat"} {
+		in := writeTempFile(t, name, "content")
+		kind := detectFileKind(in, name)
+		if !needsConversion(kind, name) || !usesConvertOptions(kind, name) {
+			t.Errorf("%s: fake backend not selected", name)
+		}
+		out, cleanup, err := convertDocument(context.Background(), in, name, kind, convertOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n, err := countPDFPages(out); err != nil || n != 1 {
+			t.Errorf("%s: %d pages, %v; want 1", name, n, err)
+		}
+		cleanup()
+	}
+
+	in := writeTempFile(t, "data.bin", "content")
+	if _, _, err := convertDocument(context.Background(), in, "data.bin", fileKindOther, convertOptions{}); err != errNoConverter {
+		t.Errorf("unknown type: err = %v, want errNoConverter", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/store"
+)
+
+// libraryDir holds personal library files. cleanupOldPrints only removes
+// files referenced by print records, so the library is never expired.
+const libraryDir = "library"
+
+var errLibraryQuota = errors.New("document library quota exceeded")
+
+type documentResponse struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Filename  string `json:"filename"`
+	Mime      string `json:"mime"`
+	SizeBytes int64  `json:"sizeBytes"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type documentListResponse struct {
+	Documents  []documentResponse `json:"documents"`
+	UsedBytes  int64              `json:"usedBytes"`
+	QuotaBytes int64              `json:"quotaBytes"`
+}
+
+type renameDocumentPayload struct {
+	Name string `json:"name"`
+}
+
+func documentsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp documentListResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		docs, err := store.ListDocuments(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		quota, err := store.GetSettingInt(r.Context(), tx, store.SettingLibraryQuotaBytes, store.DefaultLibraryQuotaBytes)
+		if err != nil {
+			return err
+		}
+		resp.Documents = make([]documentResponse, 0, len(docs))
+		for _, doc := range docs {
+			resp.Documents = append(resp.Documents, mapDocument(doc))
+			resp.UsedBytes += doc.SizeBytes
+		}
+		resp.QuotaBytes = quota
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load documents")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func uploadDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	defer file.Close()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = fh.Filename
+	}
+
+	storedRel, storedAbs, err := saveUploadedFile(file, fh.Filename, filepath.Join(uploadDir, libraryDir))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	if err := decryptUploadedPDF(r.Context(), storedAbs, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+		_ = os.Remove(storedAbs)
+		if !writePDFPasswordError(w, err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+	stat, err := os.Stat(storedAbs)
+	if err != nil {
+		_ = os.Remove(storedAbs)
+		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+
+	var created store.Document
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		quota, err := store.GetSettingInt(r.Context(), tx, store.SettingLibraryQuotaBytes, store.DefaultLibraryQuotaBytes)
+		if err != nil {
+			return err
+		}
+		used, err := store.SumDocumentBytes(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		if used+stat.Size() > quota {
+			return errLibraryQuota
+		}
+		doc, err := store.CreateDocument(r.Context(), tx, store.Document{
+			UserID:     sess.UserID,
+			Name:       name,
+			Filename:   fh.Filename,
+			StoredPath: libraryDir + "/" + storedRel,
+			Mime:       fh.Header.Get("Content-Type"),
+			SizeBytes:  stat.Size(),
+		})
+		if err != nil {
+			return err
+		}
+		created = doc
+		return nil
+	})
+	if err != nil {
+		_ = os.Remove(storedAbs)
+		if errors.Is(err, errLibraryQuota) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errLibraryQuota.Error())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to save document")
+		return
+	}
+	writeJSON(w, mapDocument(created))
+}
+
+func renameDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid document id")
+		return
+	}
+	var payload renameDocumentPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name required")
+		return
+	}
+	var updated store.Document
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		if _, err := ownDocument(r, tx, sess.UserID, id); err != nil {
+			return err
+		}
+		if err := store.RenameDocument(r.Context(), tx, id, payload.Name); err != nil {
+			return err
+		}
+		doc, err := store.GetDocument(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		updated = doc
+		return nil
+	})
+	if err != nil {
+		writeDocumentError(w, err, "failed to rename document")
+		return
+	}
+	writeJSON(w, mapDocument(updated))
+}
+
+func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid document id")
+		return
+	}
+	var doc store.Document
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		d, err := ownDocument(r, tx, sess.UserID, id)
+		if err != nil {
+			return err
+		}
+		doc = d
+		return store.DeleteDocument(r.Context(), tx, id)
+	})
+	if err != nil {
+		writeDocumentError(w, err, "failed to delete document")
+		return
+	}
+	abs := filepath.Join(uploadDir, filepath.FromSlash(doc.StoredPath))
+	_ = os.Remove(abs)
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(convertedRelPath(doc.StoredPath))))
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func documentFileHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid document id")
+		return
+	}
+	var doc store.Document
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		d, err := ownDocument(r, tx, sess.UserID, id)
+		doc = d
+		return err
+	})
+	if err != nil {
+		writeDocumentError(w, err, "failed to load document")
+		return
+	}
+	f, err := os.Open(filepath.Join(uploadDir, filepath.FromSlash(doc.StoredPath)))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": doc.Filename})
+	w.Header().Set("Content-Disposition", disposition)
+	http.ServeContent(w, r, doc.Filename, stat.ModTime(), f)
+}
+
+// printDocumentHandler prints a library document with the same form fields
+// as /api/print. The file is copied into a regular upload so the print
+// record can be cleaned up independently of the library.
+func printDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid document id")
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeJSONError(w, http.StatusBadRequest, "invalid form")
+		return
+	}
+	opts, err := parsePrintOptions(r, sess.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var doc store.Document
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		d, err := ownDocument(r, tx, sess.UserID, id)
+		doc = d
+		return err
+	})
+	if err != nil {
+		writeDocumentError(w, err, "failed to load document")
+		return
+	}
+
+	storedRel, _, err := copyToUploads(doc.StoredPath, doc.Filename, uploadDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to copy document")
+		return
+	}
+	rec, err := submitPrintJob(r.Context(), printSubmission{
+		UserID:    sess.UserID,
+		Printer:   opts.Printer,
+		Filename:  doc.Filename,
+		StoredRel: storedRel,
+		Sides:     opts.Sides,
+		IsColor:   opts.IsColor,
+		Copies:    opts.Copies,
+		PageRange: opts.PageRange,
+		Options:   opts.jobOptions(doc.Mime),
+	})
+	if err != nil {
+		removeUploadCopy(storedRel)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create print record")
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, mapPrintResp(rec))
+}
+
+func ownDocument(r *http.Request, tx *sql.Tx, userID int64, id int64) (store.Document, error) {
+	doc, err := store.GetDocument(r.Context(), tx, id)
+	if err != nil {
+		return doc, err
+	}
+	if doc.UserID != userID {
+		return doc, sql.ErrNoRows
+	}
+	return doc, nil
+}
+
+func writeDocumentError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "document not found")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, msg)
+}
+
+func mapDocument(doc store.Document) documentResponse {
+	return documentResponse{
+		ID:        doc.ID,
+		Name:      doc.Name,
+		Filename:  doc.Filename,
+		Mime:      doc.Mime,
+		SizeBytes: doc.SizeBytes,
+		CreatedAt: doc.CreatedAt,
+		UpdatedAt: doc.UpdatedAt,
+	}
+}
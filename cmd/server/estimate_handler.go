@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+
+	"cups-web/internal/auth"
 )
 
 type estimateResp struct {
@@ -41,9 +44,25 @@ func estimateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer cleanup()
 
-	countCtx, cancel := convertTimeoutContext(r.Context())
+	conv, err := parseConvertOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sess, _ := auth.GetSession(r)
+	countCtx, cancel := convertTimeoutContext(withConvertOwner(r.Context(), sess.UserID))
 	defer cancel()
-	pages, estimated, err := countPages(countCtx, tmpPath, fh.Filename)
+	if err := decryptUploadedPDF(countCtx, tmpPath, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+		if !writePDFPasswordError(w, err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+	pages, estimated, err := countPages(countCtx, tmpPath, fh.Filename, conv)
+	if errors.Is(err, errOfficeQueueFull) {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "failed to read pages")
 		return
@@ -51,6 +70,12 @@ func estimateHandler(w http.ResponseWriter, r *http.Request) {
 	if pages < 1 {
 		pages = 1
 	}
+	layout, err := parseLayoutOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pages = layout.sheetPages(pages)
 
 	resp := estimateResp{
 		Pages:               pages,
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -17,14 +16,15 @@ import (
 type fileKind string
 
 const (
-	fileKindPDF    fileKind = "pdf"
-	fileKindImage  fileKind = "image"
-	fileKindText   fileKind = "text"
-	fileKindOffice fileKind = "office"
-	fileKindOther  fileKind = "other"
+	fileKindPDF      fileKind = "pdf"
+	fileKindImage    fileKind = "image"
+	fileKindText     fileKind = "text"
+	fileKindMarkdown fileKind = "markdown"
+	fileKindHTML     fileKind = "html"
+	fileKindOffice   fileKind = "office"
+	fileKindOther    fileKind = "other"
 )
 
-const textLinesPerPage = 60
 const convertedSuffix = ".print.pdf"
 
 func sanitizeFilename(name string) string {
@@ -77,6 +77,24 @@ func sanitizeExtPart(ext string) string {
 }
 
 func saveUploadedFile(file io.Reader, filename string, baseDir string) (string, string, error) {
+	relPath, absPath, err := newUploadPath(filename, baseDir)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := os.Create(absPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, file); err != nil {
+		return "", "", err
+	}
+	return relPath, absPath, nil
+}
+
+// newUploadPath picks a unique dated path under baseDir for filename and
+// creates its directory. The file itself is not created.
+func newUploadPath(filename string, baseDir string) (string, string, error) {
 	subDir := time.Now().UTC().Format("20060102")
 	absDir := filepath.Join(baseDir, subDir)
 	if err := os.MkdirAll(absDir, 0755); err != nil {
@@ -84,17 +102,42 @@ func saveUploadedFile(file io.Reader, filename string, baseDir string) (string,
 	}
 	safe := sanitizeFilename(filename)
 	storedName := fmt.Sprintf("%s_%s_%s", time.Now().UTC().Format("20060102T150405Z"), randomToken(), safe)
-	absPath := filepath.Join(absDir, storedName)
-	out, err := os.Create(absPath)
+	relPath := filepath.ToSlash(filepath.Join(subDir, storedName))
+	return relPath, filepath.Join(absDir, storedName), nil
+}
+
+// copyToUploads stores a copy of an existing upload (relative to baseDir) as
+// a new dated upload, so the copy can follow print retention on its own. A
+// converted PDF next to the source is copied too, which spares the print
+// worker from converting it again.
+func copyToUploads(srcRel string, filename string, baseDir string) (string, string, error) {
+	src, err := os.Open(filepath.Join(baseDir, filepath.FromSlash(srcRel)))
 	if err != nil {
 		return "", "", err
 	}
-	defer out.Close()
-	if _, err := io.Copy(out, file); err != nil {
+	defer src.Close()
+	storedRel, storedAbs, err := saveUploadedFile(src, filename, baseDir)
+	if err != nil {
 		return "", "", err
 	}
-	relPath := filepath.ToSlash(filepath.Join(subDir, storedName))
-	return relPath, absPath, nil
+	if converted, err := os.Open(filepath.Join(baseDir, filepath.FromSlash(convertedRelPath(srcRel)))); err == nil {
+		defer converted.Close()
+		if out, err := os.Create(filepath.Join(baseDir, filepath.FromSlash(convertedRelPath(storedRel)))); err == nil {
+			_, err = io.Copy(out, converted)
+			out.Close()
+			if err != nil {
+				_ = os.Remove(out.Name())
+			}
+		}
+	}
+	return storedRel, storedAbs, nil
+}
+
+// removeUploadCopy removes an upload made by copyToUploads along with the
+// converted PDF copied next to it.
+func removeUploadCopy(storedRel string) {
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(storedRel)))
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(convertedRelPath(storedRel))))
 }
 
 func convertedRelPath(storedRel string) string {
@@ -155,6 +198,12 @@ func detectFileKind(path string, name string) fileKind {
 	if isOfficeFile(name) {
 		return fileKindOffice
 	}
+	switch ext {
+	case ".md", ".markdown":
+		return fileKindMarkdown
+	case ".html", ".htm":
+		return fileKindHTML
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return fileKindOther
@@ -166,10 +215,13 @@ func detectFileKind(path string, name string) fileKind {
 	if mime == "application/pdf" {
 		return fileKindPDF
 	}
-	if strings.HasPrefix(mime, "image/") {
+	if strings.HasPrefix(mime, "image/") || ext == ".tif" || ext == ".tiff" || tiffByteOrder(buf[:n]) != nil {
 		return fileKindImage
 	}
-	if strings.HasPrefix(mime, "text/") || ext == ".txt" || ext == ".md" || ext == ".html" {
+	if strings.HasPrefix(mime, "text/html") {
+		return fileKindHTML
+	}
+	if strings.HasPrefix(mime, "text/") || ext == ".txt" {
 		return fileKindText
 	}
 	return fileKindOther
@@ -185,19 +237,22 @@ func isOfficeFile(name string) bool {
 	}
 }
 
-func countPages(ctx context.Context, path string, name string) (int, bool, error) {
+func countPages(ctx context.Context, path string, name string, conv convertOptions) (int, bool, error) {
 	kind := detectFileKind(path, name)
-	switch kind {
-	case fileKindPDF:
+	// the built-in layouts count pages without rendering
+	builtin := !converters.overridden(name)
+	switch {
+	case kind == fileKindPDF:
 		pages, err := countPDFPages(path)
 		return pages, false, err
-	case fileKindImage:
-		return 1, false, nil
-	case fileKindText:
-		pages, err := estimateTextPages(path)
-		return pages, true, err
-	case fileKindOffice:
-		outPath, cleanup, err := convertOfficeToPDF(ctx, path)
+	case kind == fileKindImage && builtin:
+		pages, err := countImagePages(path, conv.Image)
+		return pages, false, err
+	case kind == fileKindText && builtin:
+		pages, err := countTextPages(path, conv.Text)
+		return pages, false, err
+	case needsConversion(kind, name):
+		outPath, cleanup, err := convertDocument(ctx, path, name, kind, conv)
 		if err != nil {
 			return 0, false, err
 		}
@@ -219,28 +274,3 @@ func countPDFPages(path string) (int, error) {
 	}
 	return doc.NumPage(), nil
 }
-
-func estimateTextPages(path string) (int, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-	lines := 0
-	for scanner.Scan() {
-		lines++
-	}
-	if err := scanner.Err(); err != nil {
-		return 0, err
-	}
-	if lines < 1 {
-		lines = 1
-	}
-	pages := (lines + textLinesPerPage - 1) / textLinesPerPage
-	if pages < 1 {
-		pages = 1
-	}
-	return pages, nil
-}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errNotHeld    = errors.New("print job is not held")
+	errInvalidPin = errors.New("invalid release pin")
+)
+
+type releasePayload struct {
+	Pin string `json:"pin"`
+}
+
+func validReleasePin(pin string) bool {
+	if len(pin) < 4 || len(pin) > 8 {
+		return false
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func heldJobsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp []printRecordResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		records, err := store.ListPrintRecords(r.Context(), tx, store.PrintFilter{
+			Username: user.Username,
+			Status:   store.PrintStatusHeld,
+		})
+		if err != nil {
+			return err
+		}
+		resp = mapPrintRecords(records)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load held jobs")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func releasePrintHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var payload releasePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		rec, err := store.GetPrintRecordByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if rec.UserID != sess.UserID {
+			return sql.ErrNoRows
+		}
+		if rec.Status != store.PrintStatusHeld {
+			return errNotHeld
+		}
+		hash, err := store.GetReleasePinHash(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(payload.Pin)) != nil {
+			return errInvalidPin
+		}
+		return store.ReleaseHeldPrintJob(r.Context(), tx, id)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidPin):
+			writeJSONError(w, http.StatusForbidden, errInvalidPin.Error())
+		case errors.Is(err, errNotHeld):
+			writeJSONError(w, http.StatusConflict, errNotHeld.Error())
+		case errors.Is(err, sql.ErrNoRows):
+			writeJSONError(w, http.StatusNotFound, "record not found")
+		default:
+			writeJSONError(w, http.StatusInternalServerError, "failed to release job")
+		}
+		return
+	}
+	wakePrintWorkers()
+	publishPrintRecord(r.Context(), id)
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+// expireHeldPrints refunds and closes held jobs nobody released in time.
+func expireHeldPrints(ctx context.Context, s *store.Store, now time.Time) error {
+	var expired []store.PrintRecord
+	err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+		list, err := store.ListExpiredHeldPrints(ctx, tx, now.UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		expired = list
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range expired {
+		if err := closeHeldPrint(ctx, s, rec, store.PrintStatusExpired, "hold expired"); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("expire held job %d failed: %v", rec.ID, err)
+		}
+	}
+	return nil
+}
+
+// closeHeldPrint takes a held job out of the queue and refunds it, leaving
+// the record in the given status. Both happen in one transaction so a job is
+// never closed without its refund.
+func closeHeldPrint(ctx context.Context, s *store.Store, rec store.PrintRecord, status string, reason string) error {
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		if err := store.ClosePrintJob(ctx, tx, rec.ID, store.QueueHeld, reason); err != nil {
+			return err
+		}
+		return refundPrintTx(ctx, tx, rec.ID, rec.UserID, rec.CostCents, status)
+	})
+	if err != nil {
+		return err
+	}
+	publishRefund(ctx, rec.ID, rec.UserID)
+	return nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phpdave11/gofpdf"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// 图片排版：支持 JPEG/PNG/GIF/BMP/WebP 和多页 TIFF，按 EXIF 方向旋转，
+// 可选适应、填充裁剪、原始尺寸，以及每页多张（如 2x2 证件照）。
+
+const (
+	imageFitContain = "fit"
+	imageFitFill    = "fill"
+	imageFitActual  = "actual"
+
+	maxImageGrid     = 6
+	maxImageFrames   = 200
+	maxImagePixels   = 100 << 20
+	imageCellGapMM   = 3.0
+	imageJPEGQuality = 92
+	imageCaptionSize = 8.0
+)
+
+// imageLayout controls how images are placed on A4 pages. The zero value
+// fits one image per portrait page.
+type imageLayout struct {
+	Fit  string `json:"fit,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+	// Repeat fills every cell of a page with the same image instead of
+	// flowing the images through the cells.
+	Repeat      bool   `json:"repeat,omitempty"`
+	Orientation string `json:"orientation,omitempty"`
+}
+
+func (l imageLayout) isZero() bool {
+	return l == imageLayout{}
+}
+
+func (l imageLayout) grid() (int, int) {
+	cols, rows := l.Cols, l.Rows
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	return cols, rows
+}
+
+func (l imageLayout) pdfOrientation() string {
+	if l.Orientation == orientationLandscape {
+		return "L"
+	}
+	return "P"
+}
+
+// pageCount returns the number of pages frames images take.
+func (l imageLayout) pageCount(frames int) int {
+	if l.Repeat {
+		return frames
+	}
+	cols, rows := l.grid()
+	per := cols * rows
+	return (frames + per - 1) / per
+}
+
+// parseImageLayout reads the imageFit, imageGrid ("2x2"), imageRepeat and
+// orientation form fields.
+func parseImageLayout(r *http.Request) (imageLayout, error) {
+	var l imageLayout
+	switch fit := strings.TrimSpace(r.FormValue("imageFit")); fit {
+	case "", imageFitContain:
+	case imageFitFill, imageFitActual:
+		l.Fit = fit
+	default:
+		return l, errors.New("imageFit must be fit, fill or actual")
+	}
+	if v := strings.ToLower(strings.TrimSpace(r.FormValue("imageGrid"))); v != "" {
+		c, rw, ok := strings.Cut(v, "x")
+		cols, err1 := strconv.Atoi(c)
+		rows, err2 := strconv.Atoi(rw)
+		if !ok || err1 != nil || err2 != nil || cols < 1 || rows < 1 || cols > maxImageGrid || rows > maxImageGrid {
+			return l, errors.New("imageGrid must be COLSxROWS, 1-6 each")
+		}
+		if cols*rows > 1 {
+			l.Cols, l.Rows = cols, rows
+		}
+	}
+	if v := strings.TrimSpace(r.FormValue("imageRepeat")); v != "" {
+		repeat, err := strconv.ParseBool(v)
+		if err != nil {
+			return l, errors.New("imageRepeat must be true or false")
+		}
+		l.Repeat = repeat
+	}
+	o, err := parseOrientation(r)
+	if err != nil {
+		return l, err
+	}
+	l.Orientation = o
+	return l, nil
+}
+
+// imageSource is a decoded-on-demand image file. TIFF files may hold several
+// pages; every other format has one frame.
+type imageSource struct {
+	data   []byte
+	format string
+	order  binary.ByteOrder
+	ifds   []uint32
+}
+
+func openImageSource(path string) (*imageSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, errors.New("invalid image dimensions")
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errors.New("image is too large")
+	}
+	src := &imageSource{data: data, format: format}
+	if format == "tiff" {
+		src.order = tiffByteOrder(data)
+		src.ifds = tiffIFDs(data, src.order)
+		if len(src.ifds) == 0 {
+			return nil, errors.New("invalid tiff file")
+		}
+	}
+	return src, nil
+}
+
+func (s *imageSource) frames() int {
+	if s.format == "tiff" {
+		return len(s.ifds)
+	}
+	return 1
+}
+
+func (s *imageSource) orientation(i int) int {
+	switch s.format {
+	case "jpeg":
+		return jpegOrientation(s.data)
+	case "tiff":
+		return tiffIFDOrientation(s.data, s.order, s.ifds[i])
+	}
+	return 1
+}
+
+// frame decodes frame i with its orientation applied.
+func (s *imageSource) frame(i int) (*image.NRGBA, error) {
+	if s.format == "tiff" {
+		// the decoder reads the first IFD named by the header, so point the
+		// header at the wanted page
+		s.order.PutUint32(s.data[4:8], s.ifds[i])
+	}
+	img, _, err := image.Decode(bytes.NewReader(s.data))
+	if err != nil {
+		return nil, err
+	}
+	return orientImage(img, s.orientation(i)), nil
+}
+
+// register adds frame i to pdf under name. Upright JPEGs are embedded as
+// they are; the rest are decoded and re-encoded in a format gofpdf reads.
+func (s *imageSource) register(pdf *gofpdf.Fpdf, name string, i int) (string, *gofpdf.ImageInfoType, error) {
+	if s.format == "jpeg" && s.orientation(i) == 1 {
+		info := pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "JPG", ReadDpi: true}, bytes.NewReader(s.data))
+		return name, info, pdf.Error()
+	}
+	img, err := s.frame(i)
+	if err != nil {
+		return "", nil, err
+	}
+	var buf bytes.Buffer
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	if s.format == "jpeg" {
+		opts.ImageType = "JPG"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageJPEGQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	info := pdf.RegisterImageOptionsReader(name, opts, &buf)
+	return name, info, pdf.Error()
+}
+
+// countImagePages returns the number of pages convertImageToPDF produces
+// without decoding the pixels.
+func countImagePages(path string, layout imageLayout) (int, error) {
+	src, err := openImageSource(path)
+	if err != nil {
+		return 0, err
+	}
+	return layout.pageCount(src.frames()), nil
+}
+
+func convertImageToPDF(inputPath string, layout imageLayout) (string, func(), error) {
+	return writeImagePDF([]imageItem{{Path: inputPath}}, layout)
+}
+
+// imageItem is one image file placed by writeImagePDF, with an optional
+// caption printed under each of its frames.
+type imageItem struct {
+	Path    string
+	Caption string
+}
+
+// writeImagePDF lays out the frames of every item, in order, through the
+// cells of the layout grid. When any item has a caption, every cell keeps
+// room for one under the image.
+func writeImagePDF(items []imageItem, layout imageLayout) (string, func(), error) {
+	pdf := gofpdf.New(layout.pdfOrientation(), "mm", "A4", "")
+	pdf.SetMargins(pdfPageMarginMM, pdfPageMarginMM, pdfPageMarginMM)
+	pdf.SetAutoPageBreak(false, pdfPageMarginMM)
+	captionH := 0.0
+	var runeWidth func(rune) float64
+	for _, item := range items {
+		if item.Caption != "" {
+			if err := setPdfTextFont(pdf, imageCaptionSize); err != nil {
+				return "", nil, err
+			}
+			captionH = imageCaptionSize * ptToMM * 1.6
+			runeWidth = runeWidths(pdf)
+			break
+		}
+	}
+	pageW, pageH := pdf.GetPageSize()
+	cols, rows := layout.grid()
+	per := cols * rows
+	cellW := (pageW - 2*pdfPageMarginMM - imageCellGapMM*float64(cols-1)) / float64(cols)
+	cellH := (pageH - 2*pdfPageMarginMM - imageCellGapMM*float64(rows-1)) / float64(rows)
+
+	cell := 0
+	place := func(name string, info *gofpdf.ImageInfoType, caption string) {
+		if cell%per == 0 {
+			pdf.AddPage()
+		}
+		col, row := cell%per%cols, cell%per/cols
+		x := pdfPageMarginMM + float64(col)*(cellW+imageCellGapMM)
+		y := pdfPageMarginMM + float64(row)*(cellH+imageCellGapMM)
+		drawImageInCell(pdf, name, info, x, y, cellW, cellH-captionH, layout.Fit)
+		if caption != "" {
+			caption = wrapLine(caption, cellW, runeWidth)[0]
+			pdf.SetXY(x, y+cellH-captionH)
+			pdf.CellFormat(cellW, captionH, caption, "", 0, "C", false, 0, "")
+		}
+		cell++
+	}
+	for n, item := range items {
+		src, err := openImageSource(item.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		for i := 0; i < src.frames(); i++ {
+			// names must be unique across items
+			name, info, err := src.register(pdf, "img"+strconv.Itoa(n)+"-"+strconv.Itoa(i), i)
+			if err != nil {
+				return "", nil, err
+			}
+			if layout.Repeat {
+				for k := 0; k < per; k++ {
+					place(name, info, item.Caption)
+				}
+				continue
+			}
+			place(name, info, item.Caption)
+		}
+	}
+	if pdf.Err() {
+		return "", nil, pdf.Error()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "convert-img-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	outPath := filepath.Join(tmpDir, "image.pdf")
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
+
+// drawImageInCell centers the image in the cell. fit scales it to fit, fill
+// covers the cell and clips the overflow, actual keeps the size recorded in
+// the file (72 dpi when there is none) unless it does not fit.
+func drawImageInCell(pdf *gofpdf.Fpdf, name string, info *gofpdf.ImageInfoType, x, y, cellW, cellH float64, fit string) {
+	iw, ih := info.Width(), info.Height()
+	scale := math.Min(cellW/iw, cellH/ih)
+	switch fit {
+	case imageFitFill:
+		scale = math.Max(cellW/iw, cellH/ih)
+	case imageFitActual:
+		scale = math.Min(scale, 1)
+	}
+	w, h := iw*scale, ih*scale
+	ix, iy := x+(cellW-w)/2, y+(cellH-h)/2
+	if fit == imageFitFill {
+		pdf.ClipRect(x, y, cellW, cellH, false)
+		pdf.ImageOptions(name, ix, iy, w, h, false, gofpdf.ImageOptions{}, 0, "")
+		pdf.ClipEnd()
+		return
+	}
+	pdf.ImageOptions(name, ix, iy, w, h, false, gofpdf.ImageOptions{}, 0, "")
+}
+
+// orientImage converts img to 8-bit NRGBA, applying an EXIF orientation
+// (1-8) so the result is upright.
+func orientImage(img image.Image, orientation int) *image.NRGBA {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 when absent.
+func jpegOrientation(data []byte) int {
+	tiff := jpegExif(data)
+	order := tiffByteOrder(tiff)
+	if order == nil || len(tiff) < 8 {
+		return 1
+	}
+	return tiffIFDOrientation(tiff, order, order.Uint32(tiff[4:8]))
+}
+
+// jpegExif returns the TIFF structure inside the EXIF segment of a JPEG, or
+// nil when there is none.
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// image data starts; EXIF always comes before it
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + size
+	}
+	return nil
+}
+
+// exifDate returns the date a JPEG photo was taken as YYYY-MM-DD, falling
+// back to the file modification date recorded by the camera, or "".
+func exifDate(data []byte) string {
+	tiff := jpegExif(data)
+	order := tiffByteOrder(tiff)
+	if order == nil || len(tiff) < 8 {
+		return ""
+	}
+	ifd0 := order.Uint32(tiff[4:8])
+	value := ""
+	if e, ok := tiffIFDEntry(tiff, order, ifd0, 0x8769); ok {
+		// DateTimeOriginal lives in the Exif sub-IFD
+		value = tiffASCII(tiff, order, order.Uint32(tiff[e+8:]), 0x9003)
+	}
+	if value == "" {
+		value = tiffASCII(tiff, order, ifd0, 0x0132)
+	}
+	// "2006:01:02 15:04:05"
+	if len(value) < 10 || value[4] != ':' || value[7] != ':' || strings.HasPrefix(value, "0000") {
+		return ""
+	}
+	return value[0:4] + "-" + value[5:7] + "-" + value[8:10]
+}
+
+// tiffASCII returns the ASCII value of tag in the IFD at off.
+func tiffASCII(data []byte, order binary.ByteOrder, off uint32, tag uint16) string {
+	e, ok := tiffIFDEntry(data, order, off, tag)
+	if !ok || order.Uint16(data[e+2:]) != 2 {
+		return ""
+	}
+	n := int(order.Uint32(data[e+4:]))
+	start := e + 8
+	if n > 4 {
+		start = int(order.Uint32(data[e+8:]))
+	}
+	if n < 1 || start+n > len(data) {
+		return ""
+	}
+	return strings.TrimRight(string(data[start:start+n]), "\x00 ")
+}
+
+func tiffByteOrder(data []byte) binary.ByteOrder {
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		return binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// tiffIFDs follows the IFD chain and returns the offset of every page.
+func tiffIFDs(data []byte, order binary.ByteOrder) []uint32 {
+	if order == nil || len(data) < 8 {
+		return nil
+	}
+	offsets := []uint32{}
+	seen := map[uint32]bool{}
+	off := order.Uint32(data[4:8])
+	for off != 0 && !seen[off] && len(offsets) < maxImageFrames {
+		if int(off)+2 > len(data) {
+			break
+		}
+		n := int(order.Uint16(data[off:]))
+		next := int(off) + 2 + 12*n
+		if next+4 > len(data) {
+			break
+		}
+		seen[off] = true
+		offsets = append(offsets, off)
+		off = order.Uint32(data[next:])
+	}
+	return offsets
+}
+
+// tiffIFDEntry returns the position of the tag entry in the IFD at off.
+func tiffIFDEntry(data []byte, order binary.ByteOrder, off uint32, tag uint16) (int, bool) {
+	if int(off)+2 > len(data) {
+		return 0, false
+	}
+	n := int(order.Uint16(data[off:]))
+	for k := 0; k < n; k++ {
+		e := int(off) + 2 + 12*k
+		if e+12 > len(data) {
+			return 0, false
+		}
+		if order.Uint16(data[e:]) == tag {
+			return e, true
+		}
+	}
+	return 0, false
+}
+
+// tiffIFDOrientation returns the Orientation tag (274) of the IFD at off.
+func tiffIFDOrientation(data []byte, order binary.ByteOrder, off uint32) int {
+	e, ok := tiffIFDEntry(data, order, off, 0x0112)
+	// SHORT values are stored left-aligned in the value field
+	if !ok || order.Uint16(data[e+2:]) != 3 {
+		return 1
+	}
+	if v := int(order.Uint16(data[e+8:])); v >= 1 && v <= 8 {
+		return v
+	}
+	return 1
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+)
+
+// 拼版：在服务器端把转换后的 PDF 排成多合一、小册子或缩放到纸张大小，
+// 这样任何打印机都能得到相同的结果，页数按拼版后的结果计算。
+
+const (
+	layoutNUp     = "nup"
+	layoutBooklet = "booklet"
+
+	scalingFit    = "fit"
+	scalingShrink = "shrink"
+)
+
+const (
+	sheetMarginPt = 28.35 // 10mm
+	mmPt          = 72 / 25.4
+	inchPt        = 72.0
+)
+
+// sheetSize is a portrait sheet in points.
+type sheetSize struct {
+	w, h float64
+}
+
+// defaultSheet is used when the job names no media or one we do not know.
+var defaultSheet = sheetSize{210 * mmPt, 297 * mmPt}
+
+// mediaSheets maps common IPP media keywords, with and without their PWG
+// prefix, to sheet sizes.
+var mediaSheets = map[string]sheetSize{
+	"iso_a3":       {297 * mmPt, 420 * mmPt},
+	"iso_a4":       {210 * mmPt, 297 * mmPt},
+	"iso_a5":       {148 * mmPt, 210 * mmPt},
+	"iso_b5":       {176 * mmPt, 250 * mmPt},
+	"jis_b5":       {182 * mmPt, 257 * mmPt},
+	"na_letter":    {8.5 * inchPt, 11 * inchPt},
+	"na_legal":     {8.5 * inchPt, 14 * inchPt},
+	"na_ledger":    {11 * inchPt, 17 * inchPt},
+	"na_executive": {7.25 * inchPt, 10.5 * inchPt},
+	"a3":           {297 * mmPt, 420 * mmPt},
+	"a4":           {210 * mmPt, 297 * mmPt},
+	"a5":           {148 * mmPt, 210 * mmPt},
+	"b5":           {176 * mmPt, 250 * mmPt},
+	"letter":       {8.5 * inchPt, 11 * inchPt},
+	"legal":        {8.5 * inchPt, 14 * inchPt},
+	"ledger":       {11 * inchPt, 17 * inchPt},
+	"tabloid":      {11 * inchPt, 17 * inchPt},
+	"executive":    {7.25 * inchPt, 10.5 * inchPt},
+}
+
+// pwgMediaSize matches the dimensions at the end of a PWG self-describing
+// media name such as iso_a4_210x297mm or na_letter_8.5x11in.
+var pwgMediaSize = regexp.MustCompile(`_(\d+(?:\.\d+)?)x(\d+(?:\.\d+)?)(mm|in)$`)
+
+// mediaSheet returns the sheet for an IPP media keyword.
+func mediaSheet(media string) sheetSize {
+	media = strings.ToLower(strings.TrimSpace(media))
+	if m := pwgMediaSize.FindStringSubmatch(media); m != nil {
+		w, _ := strconv.ParseFloat(m[1], 64)
+		h, _ := strconv.ParseFloat(m[2], 64)
+		unit := mmPt
+		if m[3] == "in" {
+			unit = inchPt
+		}
+		if w > 0 && h > 0 {
+			return sheetSize{math.Min(w, h) * unit, math.Max(w, h) * unit}
+		}
+	}
+	if sheet, ok := mediaSheets[media]; ok {
+		return sheet
+	}
+	return defaultSheet
+}
+
+var nupOrders = map[string]bool{"lrtb": true, "rltb": true, "tblr": true, "tbrl": true}
+
+// layoutOptions describe the imposition applied to the converted PDF before
+// it is sent to the printer. A zero value prints pages as they are.
+type layoutOptions struct {
+	Layout string `json:"layout,omitempty"`
+	// PagesPerSheet is the number of pages on each side of a sheet for n-up.
+	PagesPerSheet int `json:"pagesPerSheet,omitempty"`
+	// Order is the n-up page order: lrtb, rltb, tblr or tbrl.
+	Order   string `json:"order,omitempty"`
+	Borders bool   `json:"borders,omitempty"`
+	// Signature is the number of sheets folded together in a booklet; 0
+	// folds all sheets as one signature.
+	Signature int    `json:"signature,omitempty"`
+	Scaling   string `json:"scaling,omitempty"`
+}
+
+func (l layoutOptions) isZero() bool {
+	return l.Layout == "" && l.Scaling == ""
+}
+
+// parseLayoutOptions reads the layout, pagesPerSheet, nupOrder, borders,
+// signature and scaling form fields.
+func parseLayoutOptions(r *http.Request) (layoutOptions, error) {
+	l := layoutOptions{
+		Layout:  strings.TrimSpace(r.FormValue("layout")),
+		Order:   strings.TrimSpace(r.FormValue("nupOrder")),
+		Borders: r.FormValue("borders") == "true",
+		Scaling: strings.TrimSpace(r.FormValue("scaling")),
+	}
+	switch l.Layout {
+	case "", "none":
+		l.Layout = ""
+	case layoutNUp:
+		n, err := strconv.Atoi(r.FormValue("pagesPerSheet"))
+		if err != nil || n < 2 || !validNumberUp[n] {
+			return l, errors.New("pagesPerSheet must be 2, 4, 6, 9 or 16")
+		}
+		l.PagesPerSheet = n
+		if l.Order == "" {
+			l.Order = "lrtb"
+		}
+		if !nupOrders[l.Order] {
+			return l, errors.New("nupOrder must be lrtb, rltb, tblr or tbrl")
+		}
+	case layoutBooklet:
+		if v := r.FormValue("signature"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 64 {
+				return l, errors.New("signature must be 0-64 sheets")
+			}
+			l.Signature = n
+		}
+	default:
+		return l, errors.New("layout must be nup or booklet")
+	}
+	if l.Layout != layoutNUp {
+		l.Order = ""
+		l.Borders = false
+	}
+	switch l.Scaling {
+	case "", "none":
+		l.Scaling = ""
+	case scalingFit, scalingShrink:
+	default:
+		return l, errors.New("scaling must be fit, shrink or none")
+	}
+	return l, nil
+}
+
+// sheetPages returns how many pages the imposed document has for a source
+// document of the given page count.
+func (l layoutOptions) sheetPages(pages int) int {
+	switch l.Layout {
+	case layoutNUp:
+		return (pages + l.PagesPerSheet - 1) / l.PagesPerSheet
+	case layoutBooklet:
+		return (pages + 3) / 4 * 2
+	default:
+		return pages
+	}
+}
+
+type importedPage struct {
+	tpl  int
+	w, h float64
+}
+
+// imposePDF lays out the pages of inPath according to l on sheets of the given
+// IPP media and writes the result to a temporary file. It returns the file,
+// its page count and a cleanup function.
+func imposePDF(inPath string, l layoutOptions, media string) (outPath string, pages int, cleanup func(), err error) {
+	// gofpdi panics on PDFs it cannot parse
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("imposition failed: %v", r)
+		}
+	}()
+
+	count, err := countPDFPages(inPath)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	sheet := mediaSheet(media)
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.SetAutoPageBreak(false, 0)
+	imp := gofpdi.NewImporter()
+	src := make([]importedPage, 0, count)
+	for n := 1; n <= count; n++ {
+		tpl := imp.ImportPage(pdf, inPath, n, "/MediaBox")
+		box := imp.GetPageSizes()[n]["/MediaBox"]
+		p := importedPage{tpl: tpl, w: box["w"], h: box["h"]}
+		if p.w <= 0 || p.h <= 0 {
+			p.w, p.h = sheet.w, sheet.h
+		}
+		src = append(src, p)
+	}
+
+	place := func(p importedPage, x, y, w, h float64, scaling string) {
+		scale := math.Min(w/p.w, h/p.h)
+		if scaling == scalingShrink && scale > 1 {
+			scale = 1
+		}
+		pw, ph := p.w*scale, p.h*scale
+		imp.UseImportedTemplate(pdf, p.tpl, x+(w-pw)/2, y+(h-ph)/2, pw, ph)
+	}
+
+	switch l.Layout {
+	case layoutNUp:
+		imposeNUp(pdf, sheet, src, l, place)
+	case layoutBooklet:
+		imposeBooklet(pdf, sheet, src, l, place)
+	default:
+		for _, p := range src {
+			sw, sh := sheet.w, sheet.h
+			orientation := "P"
+			if p.w > p.h {
+				sw, sh = sh, sw
+				orientation = "L"
+			}
+			pdf.AddPageFormat(orientation, gofpdf.SizeType{Wd: sheet.w, Ht: sheet.h})
+			if l.Scaling == scalingShrink && p.w <= sw && p.h <= sh {
+				place(p, 0, 0, sw, sh, scalingShrink)
+				continue
+			}
+			place(p, sheetMarginPt, sheetMarginPt, sw-2*sheetMarginPt, sh-2*sheetMarginPt, l.Scaling)
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "impose-")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	cleanup = func() { _ = os.RemoveAll(tmpDir) }
+	outPath = filepath.Join(tmpDir, "imposed.pdf")
+	pages = pdf.PageNo()
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", 0, nil, err
+	}
+	return outPath, pages, cleanup, nil
+}
+
+// nupGrid picks the columns, rows and sheet orientation that give the pages
+// the largest scale.
+func nupGrid(sheet sheetSize, n int, pageW, pageH float64) (cols, rows int, landscape bool) {
+	best := -1.0
+	for c := 1; c <= n; c++ {
+		if n%c != 0 {
+			continue
+		}
+		r := n / c
+		for _, land := range []bool{false, true} {
+			sw, sh := sheet.w, sheet.h
+			if land {
+				sw, sh = sh, sw
+			}
+			cellW := (sw - 2*sheetMarginPt) / float64(c)
+			cellH := (sh - 2*sheetMarginPt) / float64(r)
+			if scale := math.Min(cellW/pageW, cellH/pageH); scale > best {
+				best, cols, rows, landscape = scale, c, r, land
+			}
+		}
+	}
+	return cols, rows, landscape
+}
+
+func imposeNUp(pdf *gofpdf.Fpdf, sheet sheetSize, src []importedPage, l layoutOptions, place func(importedPage, float64, float64, float64, float64, string)) {
+	n := l.PagesPerSheet
+	cols, rows, landscape := nupGrid(sheet, n, src[0].w, src[0].h)
+	sw, sh := sheet.w, sheet.h
+	orientation := "P"
+	if landscape {
+		sw, sh = sh, sw
+		orientation = "L"
+	}
+	cellW := (sw - 2*sheetMarginPt) / float64(cols)
+	cellH := (sh - 2*sheetMarginPt) / float64(rows)
+	pdf.SetLineWidth(0.5)
+	for i, p := range src {
+		k := i % n
+		if k == 0 {
+			pdf.AddPageFormat(orientation, gofpdf.SizeType{Wd: sheet.w, Ht: sheet.h})
+		}
+		var col, row int
+		switch l.Order {
+		case "rltb":
+			col, row = cols-1-k%cols, k/cols
+		case "tblr":
+			col, row = k/rows, k%rows
+		case "tbrl":
+			col, row = cols-1-k/rows, k%rows
+		default:
+			col, row = k%cols, k/cols
+		}
+		x := sheetMarginPt + float64(col)*cellW
+		y := sheetMarginPt + float64(row)*cellH
+		place(p, x, y, cellW, cellH, scalingFit)
+		if l.Borders {
+			pdf.Rect(x, y, cellW, cellH, "D")
+		}
+	}
+}
+
+// imposeBooklet puts two pages side by side on landscape sheets in saddle
+// stitch order, so the printed stack can be folded in the middle. Sheets are
+// meant to be printed duplex, flipped on the short edge.
+func imposeBooklet(pdf *gofpdf.Fpdf, sheet sheetSize, src []importedPage, l layoutOptions, place func(importedPage, float64, float64, float64, float64, string)) {
+	total := (len(src) + 3) / 4 * 4
+	sigPages := total
+	if l.Signature > 0 && l.Signature*4 < total {
+		sigPages = l.Signature * 4
+	}
+	sw, sh := sheet.h, sheet.w
+	cellW := (sw - 2*sheetMarginPt) / 2
+	cellH := sh - 2*sheetMarginPt
+	side := func(left, right int) {
+		pdf.AddPageFormat("L", gofpdf.SizeType{Wd: sheet.w, Ht: sheet.h})
+		for i, idx := range []int{left, right} {
+			if idx < len(src) {
+				place(src[idx], sheetMarginPt+float64(i)*cellW, sheetMarginPt, cellW, cellH, scalingFit)
+			}
+		}
+	}
+	for start := 0; start < total; start += sigPages {
+		n := sigPages
+		if start+n > total {
+			n = total - start
+		}
+		for s := 0; s < n/4; s++ {
+			side(start+n-1-2*s, start+2*s)
+			side(start+2*s+1, start+n-2-2*s)
+		}
+	}
+}
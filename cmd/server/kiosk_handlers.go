@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/store"
+)
+
+const (
+	kioskSessionTTL      = 5 * time.Minute
+	kioskMaxFailures     = 5
+	kioskLockoutDuration = time.Minute
+)
+
+var (
+	errKioskDevice  = errors.New("invalid device token")
+	errKioskSession = errors.New("kiosk session required")
+	errKioskLocked  = errors.New("too many failed attempts, try again later")
+)
+
+type kioskDevicePayload struct {
+	Name       string `json:"name"`
+	PrinterURI string `json:"printerUri"`
+}
+
+type kioskDeviceResponse struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	PrinterURI string `json:"printerUri"`
+	Token      string `json:"token,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+}
+
+type kioskLoginPayload struct {
+	Pin        string `json:"pin"`
+	CardNumber string `json:"cardNumber"`
+}
+
+// kioskThrottle locks a device out for a while after repeated failed logins
+// so short PINs cannot be brute forced from a station.
+type kioskThrottle struct {
+	mu       sync.Mutex
+	failures map[int64]int
+	locked   map[int64]time.Time
+}
+
+var kioskLogins = &kioskThrottle{
+	failures: map[int64]int{},
+	locked:   map[int64]time.Time{},
+}
+
+func (t *kioskThrottle) allowed(deviceID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().After(t.locked[deviceID])
+}
+
+func (t *kioskThrottle) fail(deviceID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[deviceID]++
+	if t.failures[deviceID] >= kioskMaxFailures {
+		t.locked[deviceID] = time.Now().Add(kioskLockoutDuration)
+		t.failures[deviceID] = 0
+	}
+}
+
+func (t *kioskThrottle) reset(deviceID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, deviceID)
+	delete(t.locked, deviceID)
+}
+
+func newDeviceToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashDeviceToken(token), nil
+}
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// kioskPinHash derives a deterministic lookup key for a PIN. A keyed HMAC is
+// used instead of bcrypt because kiosk login has to find the user by PIN.
+func kioskPinHash(ctx context.Context, tx *sql.Tx, pin string, create bool) (string, error) {
+	secret, err := store.GetSetting(ctx, tx, store.SettingPinSecret, "")
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		if !create {
+			return "", nil
+		}
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		secret = hex.EncodeToString(buf)
+		if err := store.SetSetting(ctx, tx, store.SettingPinSecret, secret); err != nil {
+			return "", err
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(pin))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// setKioskCredentials stores the user's kiosk PIN and card number, rejecting
+// values that already belong to someone else.
+func setKioskCredentials(ctx context.Context, tx *sql.Tx, userID int64, pin *string, cardNumber *string) (store.User, error) {
+	var pinHash *string
+	if pin != nil {
+		h := ""
+		if *pin != "" {
+			var err error
+			h, err = kioskPinHash(ctx, tx, *pin, true)
+			if err != nil {
+				return store.User{}, err
+			}
+			if other, err := store.GetUserByPinHash(ctx, tx, h); err == nil && other.ID != userID {
+				return store.User{}, errCredentialInUse
+			} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return store.User{}, err
+			}
+		}
+		pinHash = &h
+	}
+	if cardNumber != nil && *cardNumber != "" {
+		if other, err := store.GetUserByCardNumber(ctx, tx, *cardNumber); err == nil && other.ID != userID {
+			return store.User{}, errCredentialInUse
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return store.User{}, err
+		}
+	}
+	if err := store.SetUserCredentials(ctx, tx, userID, pinHash, cardNumber); err != nil {
+		return store.User{}, err
+	}
+	return store.GetUserByID(ctx, tx, userID)
+}
+
+func kioskDeviceFromRequest(r *http.Request) (store.KioskDevice, error) {
+	token := strings.TrimSpace(r.Header.Get("X-Device-Token"))
+	if token == "" {
+		return store.KioskDevice{}, errKioskDevice
+	}
+	var device store.KioskDevice
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		d, err := store.GetKioskDeviceByTokenHash(r.Context(), tx, hashDeviceToken(token))
+		if err != nil {
+			return err
+		}
+		device = d
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return device, errKioskDevice
+	}
+	return device, err
+}
+
+// kioskAuth resolves the calling device and, when a kiosk session header is
+// present and was issued to that device, the signed-in user.
+func kioskAuth(w http.ResponseWriter, r *http.Request, needUser bool) (store.KioskDevice, int64, bool) {
+	device, err := kioskDeviceFromRequest(r)
+	if err != nil {
+		if errors.Is(err, errKioskDevice) {
+			writeJSONError(w, http.StatusUnauthorized, errKioskDevice.Error())
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to load device")
+		}
+		return device, 0, false
+	}
+	if !needUser {
+		return device, 0, true
+	}
+	sess, err := auth.DecodeKioskSession(r.Header.Get("X-Kiosk-Session"))
+	if err != nil || sess.DeviceID != device.ID {
+		writeJSONError(w, http.StatusUnauthorized, errKioskSession.Error())
+		return device, 0, false
+	}
+	return device, sess.UserID, true
+}
+
+func kioskDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	device, _, ok := kioskAuth(w, r, false)
+	if !ok {
+		return
+	}
+	writeJSON(w, mapKioskDevice(device, ""))
+}
+
+func kioskLoginHandler(w http.ResponseWriter, r *http.Request) {
+	device, _, ok := kioskAuth(w, r, false)
+	if !ok {
+		return
+	}
+	if !kioskLogins.allowed(device.ID) {
+		writeJSONError(w, http.StatusTooManyRequests, errKioskLocked.Error())
+		return
+	}
+	var payload kioskLoginPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Pin = strings.TrimSpace(payload.Pin)
+	payload.CardNumber = strings.TrimSpace(payload.CardNumber)
+	if payload.Pin == "" && payload.CardNumber == "" {
+		writeJSONError(w, http.StatusBadRequest, "pin or card number required")
+		return
+	}
+
+	var user store.User
+	err := appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		var err error
+		if payload.CardNumber != "" {
+			user, err = store.GetUserByCardNumber(r.Context(), tx, payload.CardNumber)
+		} else {
+			var hash string
+			hash, err = kioskPinHash(r.Context(), tx, payload.Pin, false)
+			if err != nil {
+				return err
+			}
+			if hash == "" {
+				return sql.ErrNoRows
+			}
+			user, err = store.GetUserByPinHash(r.Context(), tx, hash)
+		}
+		if err != nil {
+			return err
+		}
+		return store.TouchKioskDevice(r.Context(), tx, device.ID)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			kioskLogins.fail(device.ID)
+			writeJSONError(w, http.StatusUnauthorized, "invalid pin or card")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to sign in")
+		}
+		return
+	}
+	kioskLogins.reset(device.ID)
+
+	expires := time.Now().Add(kioskSessionTTL)
+	token, err := auth.EncodeKioskSession(auth.KioskSession{
+		DeviceID: device.ID,
+		UserID:   user.ID,
+		Expires:  expires,
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"token":     token,
+		"expiresAt": expires.UTC().Format(time.RFC3339),
+		"user":      displayName(user),
+	})
+}
+
+func kioskJobsHandler(w http.ResponseWriter, r *http.Request) {
+	device, userID, ok := kioskAuth(w, r, true)
+	if !ok {
+		return
+	}
+	var resp []printRecordResponse
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(r.Context(), tx, userID)
+		if err != nil {
+			return err
+		}
+		records, err := store.ListPrintRecords(r.Context(), tx, store.PrintFilter{
+			Username: user.Username,
+			Status:   store.PrintStatusHeld,
+			Printer:  device.PrinterURI,
+		})
+		if err != nil {
+			return err
+		}
+		resp = mapPrintRecords(records)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load held jobs")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// kioskHeldRecord loads a held job that belongs to the signed-in user and was
+// sent to the device's printer.
+func kioskHeldRecord(ctx context.Context, tx *sql.Tx, device store.KioskDevice, userID int64, id int64) (store.PrintRecord, error) {
+	rec, err := store.GetPrintRecordByID(ctx, tx, id)
+	if err != nil {
+		return rec, err
+	}
+	if rec.UserID != userID || rec.PrinterURI != device.PrinterURI {
+		return rec, sql.ErrNoRows
+	}
+	if rec.Status != store.PrintStatusHeld {
+		return rec, errNotHeld
+	}
+	return rec, nil
+}
+
+func kioskReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	device, userID, ok := kioskAuth(w, r, true)
+	if !ok {
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		if _, err := kioskHeldRecord(r.Context(), tx, device, userID, id); err != nil {
+			return err
+		}
+		return store.ReleaseHeldPrintJob(r.Context(), tx, id)
+	})
+	if err != nil {
+		writeKioskJobError(w, err, "failed to release job")
+		return
+	}
+	wakePrintWorkers()
+	publishPrintRecord(r.Context(), id)
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func kioskDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	device, userID, ok := kioskAuth(w, r, true)
+	if !ok {
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var rec store.PrintRecord
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		var err error
+		rec, err = kioskHeldRecord(r.Context(), tx, device, userID, id)
+		return err
+	})
+	if err == nil {
+		err = closeHeldPrint(r.Context(), appStore, rec, store.PrintStatusCanceled, "canceled at kiosk")
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errNotHeld
+		}
+	}
+	if err != nil {
+		writeKioskJobError(w, err, "failed to delete job")
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func writeKioskJobError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, errNotHeld):
+		writeJSONError(w, http.StatusConflict, errNotHeld.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, "record not found")
+	default:
+		writeJSONError(w, http.StatusInternalServerError, msg)
+	}
+}
+
+func adminListDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	var resp []kioskDeviceResponse
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		devices, err := store.ListKioskDevices(r.Context(), tx)
+		if err != nil {
+			return err
+		}
+		resp = make([]kioskDeviceResponse, 0, len(devices))
+		for _, d := range devices {
+			resp = append(resp, mapKioskDevice(d, ""))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list devices")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func adminCreateDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var payload kioskDevicePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	payload.PrinterURI = strings.TrimSpace(payload.PrinterURI)
+	if payload.Name == "" || payload.PrinterURI == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and printerUri required")
+		return
+	}
+	token, tokenHash, err := newDeviceToken()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	var created store.KioskDevice
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		d, err := store.CreateKioskDevice(r.Context(), tx, payload.Name, payload.PrinterURI, tokenHash)
+		if err != nil {
+			return err
+		}
+		created = d
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create device")
+		return
+	}
+	writeJSON(w, mapKioskDevice(created, token))
+}
+
+func adminRotateDeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+	token, tokenHash, err := newDeviceToken()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	var device store.KioskDevice
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		if err := store.UpdateKioskDeviceToken(r.Context(), tx, id, tokenHash); err != nil {
+			return err
+		}
+		d, err := store.GetKioskDeviceByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		device = d
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "device not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to rotate token")
+		}
+		return
+	}
+	writeJSON(w, mapKioskDevice(device, token))
+}
+
+func adminDeleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		return store.DeleteKioskDevice(r.Context(), tx, id)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "device not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to delete device")
+		}
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+// mapKioskDevice includes the plain token only right after it was generated.
+func mapKioskDevice(d store.KioskDevice, token string) kioskDeviceResponse {
+	return kioskDeviceResponse{
+		ID:         d.ID,
+		Name:       d.Name,
+		PrinterURI: d.PrinterURI,
+		Token:      token,
+		CreatedAt:  d.CreatedAt,
+		LastSeenAt: d.LastSeenAt,
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"cups-web/internal/auth"
 	"cups-web/internal/ipp"
 	"cups-web/internal/middleware"
+	"cups-web/internal/notify"
 	"cups-web/internal/server"
 	"cups-web/internal/store"
 	"github.com/gorilla/mux"
@@ -49,6 +50,12 @@ func main() {
 		log.Fatal("failed to create uploads dir: ", err)
 	}
 
+	if cfg, ok := notify.ConfigFromEnv(); ok {
+		appMailer = notify.NewSMTPSender(cfg)
+	} else {
+		log.Println("SMTP_HOST not set; email notifications disabled")
+	}
+
 	hashKey := os.Getenv("SESSION_HASH_KEY")
 	blockKey := os.Getenv("SESSION_BLOCK_KEY")
 	if hashKey == "" || blockKey == "" {
@@ -65,6 +72,14 @@ func main() {
 	// session endpoint used by frontend to detect existing session on page load
 	api.HandleFunc("/session", SessionHandler).Methods("GET")
 
+	// kiosk endpoints authenticate with X-Device-Token / X-Kiosk-Session headers
+	kiosk := api.PathPrefix("/kiosk").Subrouter()
+	kiosk.HandleFunc("/device", kioskDeviceHandler).Methods("GET")
+	kiosk.HandleFunc("/login", kioskLoginHandler).Methods("POST")
+	kiosk.HandleFunc("/jobs", kioskJobsHandler).Methods("GET")
+	kiosk.HandleFunc("/jobs/{id:[0-9]+}/release", kioskReleaseHandler).Methods("POST")
+	kiosk.HandleFunc("/jobs/{id:[0-9]+}", kioskDeleteHandler).Methods("DELETE")
+
 	protected := api.PathPrefix("").Subrouter()
 	protected.Use(middleware.RequireSession)
 	protected.Use(middleware.ValidateCSRF)
@@ -72,12 +87,7 @@ func main() {
 	protected.HandleFunc("/printers", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		cupsHost := os.Getenv("CUPS_HOST")
-		if cupsHost == "" {
-			cupsHost = "localhost"
-		}
-
-		printers, err := ipp.ListPrinters(cupsHost)
+		printers, err := ipp.ListPrinters(cupsHost())
 		if err != nil {
 			http.Error(w, "failed to list printers: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -88,8 +98,35 @@ func main() {
 	protected.HandleFunc("/print", printHandler).Methods("POST")
 	protected.HandleFunc("/convert", convertHandler).Methods("POST")
 	protected.HandleFunc("/estimate", estimateHandler).Methods("POST")
+	protected.HandleFunc("/preview", previewHandler).Methods("POST")
+	protected.HandleFunc("/previews/{hash:[0-9a-f]{64}}/{page:[0-9]+}.png", previewImageHandler).Methods("GET")
 	protected.HandleFunc("/print-records", printRecordsHandler).Methods("GET")
 	protected.HandleFunc("/print-records/{id:[0-9]+}/file", printRecordFileHandler).Methods("GET")
+	protected.HandleFunc("/print-records/{id:[0-9]+}/files", printRecordFilesHandler).Methods("GET")
+	protected.HandleFunc("/print-records/{id:[0-9]+}/release", releasePrintHandler).Methods("POST")
+	protected.HandleFunc("/print-records/{id:[0-9]+}/reprint", reprintHandler).Methods("POST")
+	protected.HandleFunc("/held-jobs", heldJobsHandler).Methods("GET")
+	protected.HandleFunc("/scheduled-jobs", scheduledJobsHandler).Methods("GET")
+	protected.HandleFunc("/recurring-prints", recurringPrintsHandler).Methods("GET")
+	protected.HandleFunc("/recurring-prints", createRecurringPrintHandler).Methods("POST")
+	protected.HandleFunc("/recurring-prints/{id:[0-9]+}", updateRecurringPrintHandler).Methods("PUT")
+	protected.HandleFunc("/recurring-prints/{id:[0-9]+}", deleteRecurringPrintHandler).Methods("DELETE")
+	protected.HandleFunc("/recurring-prints/{id:[0-9]+}/runs", recurringRunsHandler).Methods("GET")
+	protected.HandleFunc("/documents", documentsHandler).Methods("GET")
+	protected.HandleFunc("/documents", uploadDocumentHandler).Methods("POST")
+	protected.HandleFunc("/documents/{id:[0-9]+}", renameDocumentHandler).Methods("PUT")
+	protected.HandleFunc("/documents/{id:[0-9]+}", deleteDocumentHandler).Methods("DELETE")
+	protected.HandleFunc("/documents/{id:[0-9]+}/file", documentFileHandler).Methods("GET")
+	protected.HandleFunc("/documents/{id:[0-9]+}/print", printDocumentHandler).Methods("POST")
+	protected.HandleFunc("/presets", presetsHandler).Methods("GET")
+	protected.HandleFunc("/presets", createPresetHandler).Methods("POST")
+	protected.HandleFunc("/presets/{id:[0-9]+}", updatePresetHandler).Methods("PUT")
+	protected.HandleFunc("/presets/{id:[0-9]+}", deletePresetHandler).Methods("DELETE")
+	protected.HandleFunc("/templates", templatesHandler).Methods("GET")
+	protected.HandleFunc("/templates/{id:[0-9]+}/print", printTemplateHandler).Methods("POST")
+	protected.HandleFunc("/print-records/{id:[0-9]+}/schedule", rescheduleHandler).Methods("PUT")
+	protected.HandleFunc("/print-records/{id:[0-9]+}/schedule", cancelScheduledHandler).Methods("DELETE")
+	protected.HandleFunc("/events", eventsHandler).Methods("GET")
 
 	admin := api.PathPrefix("/admin").Subrouter()
 	admin.Use(middleware.RequireSession)
@@ -104,6 +141,26 @@ func main() {
 	admin.HandleFunc("/topups", adminTopupsHandler).Methods("GET")
 	admin.HandleFunc("/settings", adminGetSettingsHandler).Methods("GET")
 	admin.HandleFunc("/settings", adminUpdateSettingsHandler).Methods("PUT")
+	admin.HandleFunc("/events", adminEventsHandler).Methods("GET")
+	admin.HandleFunc("/webhooks", adminListWebhooksHandler).Methods("GET")
+	admin.HandleFunc("/webhooks", adminCreateWebhookHandler).Methods("POST")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}", adminUpdateWebhookHandler).Methods("PUT")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}", adminDeleteWebhookHandler).Methods("DELETE")
+	admin.HandleFunc("/webhook-deliveries", adminWebhookDeliveriesHandler).Methods("GET")
+	admin.HandleFunc("/webhook-deliveries/{id:[0-9]+}/retry", adminRetryWebhookDeliveryHandler).Methods("POST")
+	admin.HandleFunc("/devices", adminListDevicesHandler).Methods("GET")
+	admin.HandleFunc("/devices", adminCreateDeviceHandler).Methods("POST")
+	admin.HandleFunc("/devices/{id:[0-9]+}/token", adminRotateDeviceTokenHandler).Methods("POST")
+	admin.HandleFunc("/devices/{id:[0-9]+}", adminDeleteDeviceHandler).Methods("DELETE")
+	admin.HandleFunc("/stamps", adminListStampTemplatesHandler).Methods("GET")
+	admin.HandleFunc("/stamps", adminCreateStampTemplateHandler).Methods("POST")
+	admin.HandleFunc("/stamps/{id:[0-9]+}", adminUpdateStampTemplateHandler).Methods("PUT")
+	admin.HandleFunc("/stamps/{id:[0-9]+}", adminDeleteStampTemplateHandler).Methods("DELETE")
+	admin.HandleFunc("/convert-stats", adminConvertStatsHandler).Methods("GET")
+	admin.HandleFunc("/templates", templatesHandler).Methods("GET")
+	admin.HandleFunc("/templates", adminCreateTemplateHandler).Methods("POST")
+	admin.HandleFunc("/templates/{id:[0-9]+}", adminUpdateTemplateHandler).Methods("PUT")
+	admin.HandleFunc("/templates/{id:[0-9]+}", adminDeleteTemplateHandler).Methods("DELETE")
 
 	// Static files (embedded) - register after API routes so /api/* is matched first
 	serverFS := server.NewEmbeddedServer(frontend.FS)
@@ -117,6 +174,13 @@ func main() {
 	}
 
 	startMaintenance(appStore, uploadDir)
+	startWebhookDispatcher(appStore)
+	startPrinterStateWatcher()
+	startOfficePool()
+	if err := startConverters(); err != nil {
+		log.Fatal("invalid converter configuration: ", err)
+	}
+	startPrintWorkers(appStore)
 
 	fmt.Println("listening on", addr)
 	log.Fatal(srv.ListenAndServe())
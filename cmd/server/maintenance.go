@@ -20,9 +20,22 @@ func startMaintenance(s *store.Store, uploads string) {
 			if err := cleanupOldPrints(context.Background(), s, uploads, time.Now()); err != nil {
 				log.Println("cleanup failed:", err)
 			}
+			cleanupPreviews(uploads, time.Now())
 			time.Sleep(1 * time.Hour)
 		}
 	}()
+	// time-sensitive jobs run every minute
+	go func() {
+		for {
+			if err := expireHeldPrints(context.Background(), s, time.Now()); err != nil {
+				log.Println("expire held prints failed:", err)
+			}
+			if err := runRecurringPrints(context.Background(), s, time.Now()); err != nil {
+				log.Println("recurring prints failed:", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
 }
 
 func applyAutoTopups(ctx context.Context, s *store.Store, now time.Time) error {
@@ -41,7 +54,8 @@ func applyAutoTopups(ctx context.Context, s *store.Store, now time.Time) error {
 		lastYearlyTopup  string
 	}
 
-	return s.WithTx(ctx, false, func(tx *sql.Tx) error {
+	var notices []autoTopupNotice
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
 		rows, err := tx.QueryContext(ctx, `SELECT
 			id, balance_cents, daily_topup_cents, monthly_topup_cents, yearly_topup_cents,
 			last_daily_topup, last_monthly_topup, last_yearly_topup
@@ -77,27 +91,42 @@ func applyAutoTopups(ctx context.Context, s *store.Store, now time.Time) error {
 			if u.dailyTopup > 0 && lastDaily != today {
 				before := balance
 				balance += u.dailyTopup
-				if _, err := store.InsertTopup(ctx, tx, u.id, u.dailyTopup, before, balance, "auto_daily", nil, "system"); err != nil {
+				topupID, err := store.InsertTopup(ctx, tx, u.id, u.dailyTopup, before, balance, "auto_daily", nil, "system")
+				if err != nil {
+					return err
+				}
+				if err := enqueueTopupEvent(ctx, tx, topupID); err != nil {
 					return err
 				}
+				notices = append(notices, autoTopupNotice{userID: u.id, amountCents: u.dailyTopup, balanceCents: balance, topupType: "auto_daily"})
 				lastDaily = today
 				changed = true
 			}
 			if u.monthlyTopup > 0 && lastMonthly != month {
 				before := balance
 				balance += u.monthlyTopup
-				if _, err := store.InsertTopup(ctx, tx, u.id, u.monthlyTopup, before, balance, "auto_monthly", nil, "system"); err != nil {
+				topupID, err := store.InsertTopup(ctx, tx, u.id, u.monthlyTopup, before, balance, "auto_monthly", nil, "system")
+				if err != nil {
+					return err
+				}
+				if err := enqueueTopupEvent(ctx, tx, topupID); err != nil {
 					return err
 				}
+				notices = append(notices, autoTopupNotice{userID: u.id, amountCents: u.monthlyTopup, balanceCents: balance, topupType: "auto_monthly"})
 				lastMonthly = month
 				changed = true
 			}
 			if u.yearlyTopup > 0 && lastYearly != year {
 				before := balance
 				balance += u.yearlyTopup
-				if _, err := store.InsertTopup(ctx, tx, u.id, u.yearlyTopup, before, balance, "auto_yearly", nil, "system"); err != nil {
+				topupID, err := store.InsertTopup(ctx, tx, u.id, u.yearlyTopup, before, balance, "auto_yearly", nil, "system")
+				if err != nil {
 					return err
 				}
+				if err := enqueueTopupEvent(ctx, tx, topupID); err != nil {
+					return err
+				}
+				notices = append(notices, autoTopupNotice{userID: u.id, amountCents: u.yearlyTopup, balanceCents: balance, topupType: "auto_yearly"})
 				lastYearly = year
 				changed = true
 			}
@@ -114,6 +143,14 @@ func applyAutoTopups(ctx context.Context, s *store.Store, now time.Time) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, n := range notices {
+		publishBalance(ctx, n.userID)
+	}
+	notifyAutoTopups(ctx, notices)
+	return nil
 }
 
 func cleanupOldPrints(ctx context.Context, s *store.Store, uploads string, now time.Time) error {
@@ -136,30 +173,34 @@ func cleanupOldPrints(ctx context.Context, s *store.Store, uploads string, now t
 	cutoff := now.AddDate(0, 0, -int(retentionDays)).UTC().Format(time.RFC3339)
 	var paths []string
 	err = s.WithTx(ctx, false, func(tx *sql.Tx) error {
-		rows, err := tx.QueryContext(ctx, "SELECT stored_path FROM print_jobs WHERE created_at < ?", cutoff)
+		finished, err := store.ListFinishedPrintPathsBefore(ctx, tx, cutoff)
 		if err != nil {
 			return err
 		}
-		for rows.Next() {
-			var p string
-			if err := rows.Scan(&p); err != nil {
-				return err
-			}
-			paths = append(paths, p)
-		}
-		if err := rows.Err(); err != nil {
-			rows.Close()
+		paths = append(paths, finished...)
+		// parts of multi-file jobs that were never merged
+		parts, err := store.ListPrintJobFilePathsBefore(ctx, tx, cutoff)
+		if err != nil {
 			return err
 		}
-		rows.Close()
-		_, err = tx.ExecContext(ctx, "DELETE FROM print_jobs WHERE created_at < ?", cutoff)
-		return err
+		paths = append(paths, parts...)
+		return store.DeleteFinishedPrintRecordsBefore(ctx, tx, cutoff)
 	})
 	if err != nil {
 		return err
 	}
 
 	for _, rel := range paths {
+		// reprints may still point at the same upload
+		var refs int
+		err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+			n, err := store.CountPrintRecordsByStoredPath(ctx, tx, rel)
+			refs = n
+			return err
+		})
+		if err != nil || refs > 0 {
+			continue
+		}
 		abs := filepath.Join(uploads, filepath.FromSlash(rel))
 		_ = os.Remove(abs)
 		convertedRel := convertedRelPath(rel)
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Markdown 排版：用 goldmark 解析后直接绘制到 PDF，支持标题、列表、表格、
+// 代码块和引用，中文使用内嵌字体。只有一种字重，粗体用描边模拟。
+
+const (
+	markdownMarginMM   = 15.0
+	markdownBodySize   = 11.0
+	markdownCodeSize   = 9.0
+	markdownLineFactor = 1.5
+	markdownIndentMM   = 6.0
+	markdownCellPadMM  = 1.5
+)
+
+var markdownHeadingSizes = map[int]float64{1: 20, 2: 16, 3: 14, 4: 12, 5: 11, 6: 11}
+
+type markdownRenderer struct {
+	pdf       *gofpdf.Fpdf
+	src       []byte
+	size      float64
+	bold      int
+	runeWidth func(rune) float64
+}
+
+func convertMarkdownToPDF(inputPath string) (string, func(), error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return "", nil, err
+	}
+	src := []byte(decodeText(data))
+	md := goldmark.New(goldmark.WithExtensions(extension.Table, extension.Strikethrough, extension.Linkify))
+	doc := md.Parser().Parse(text.NewReader(src))
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(markdownMarginMM, markdownMarginMM, markdownMarginMM)
+	pdf.SetAutoPageBreak(true, markdownMarginMM)
+	if err := setPdfTextFont(pdf, markdownBodySize); err != nil {
+		return "", nil, err
+	}
+	pdf.AddPage()
+	r := &markdownRenderer{pdf: pdf, src: src}
+	r.setSize(markdownBodySize)
+	r.blocks(doc)
+	if pdf.Err() {
+		return "", nil, pdf.Error()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "convert-md-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+	outPath := filepath.Join(tmpDir, "markdown.pdf")
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
+
+func (r *markdownRenderer) setSize(size float64) {
+	r.size = size
+	r.pdf.SetFontSize(size)
+	r.runeWidth = runeWidths(r.pdf)
+}
+
+func (r *markdownRenderer) lineHeight() float64 {
+	return r.size * ptToMM * markdownLineFactor
+}
+
+func (r *markdownRenderer) left() float64 {
+	left, _, _, _ := r.pdf.GetMargins()
+	return left
+}
+
+func (r *markdownRenderer) setLeft(x float64) {
+	r.pdf.SetLeftMargin(x)
+	r.pdf.SetX(x)
+}
+
+func (r *markdownRenderer) width() float64 {
+	pageW, _ := r.pdf.GetPageSize()
+	return pageW - markdownMarginMM - r.left()
+}
+
+func (r *markdownRenderer) gap() {
+	r.pdf.Ln(r.lineHeight() * 0.4)
+}
+
+func (r *markdownRenderer) blocks(parent ast.Node) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		r.block(n)
+	}
+}
+
+func (r *markdownRenderer) block(n ast.Node) {
+	pdf := r.pdf
+	switch node := n.(type) {
+	case *ast.Heading:
+		size := markdownHeadingSizes[node.Level]
+		r.setSize(size)
+		r.gap()
+		r.bold++
+		r.inline(node)
+		r.bold--
+		pdf.Ln(r.lineHeight())
+		r.setSize(markdownBodySize)
+		r.gap()
+	case *ast.Paragraph:
+		r.inline(node)
+		pdf.Ln(r.lineHeight())
+		r.gap()
+	case *ast.TextBlock:
+		r.inline(node)
+		pdf.Ln(r.lineHeight())
+	case *ast.List:
+		r.list(node)
+		r.gap()
+	case *ast.FencedCodeBlock:
+		r.code(node)
+	case *ast.CodeBlock:
+		r.code(node)
+	case *ast.Blockquote:
+		left := r.left()
+		r.setLeft(left + markdownIndentMM)
+		pdf.SetTextColor(100, 100, 100)
+		r.blocks(node)
+		pdf.SetTextColor(0, 0, 0)
+		r.setLeft(left)
+	case *ast.ThematicBreak:
+		y := pdf.GetY() + r.lineHeight()/2
+		pdf.SetDrawColor(180, 180, 180)
+		pdf.Line(r.left(), y, r.left()+r.width(), y)
+		pdf.SetDrawColor(0, 0, 0)
+		pdf.Ln(r.lineHeight())
+	case *east.Table:
+		r.table(node)
+		r.gap()
+	case *ast.HTMLBlock:
+		// raw HTML is not rendered
+	default:
+		r.blocks(n)
+	}
+}
+
+func (r *markdownRenderer) list(list *ast.List) {
+	left := r.left()
+	start := list.Start
+	if start == 0 {
+		start = 1
+	}
+	i := 0
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		marker := "•"
+		if list.IsOrdered() {
+			marker = strconv.Itoa(start+i) + "."
+		}
+		i++
+		r.pdf.SetX(left)
+		r.pdf.CellFormat(markdownIndentMM, r.lineHeight(), marker, "", 0, "L", false, 0, "")
+		r.setLeft(left + markdownIndentMM)
+		r.blocks(item)
+		r.setLeft(left)
+	}
+}
+
+func (r *markdownRenderer) code(n ast.Node) {
+	pdf := r.pdf
+	r.setSize(markdownCodeSize)
+	pdf.SetFillColor(242, 242, 242)
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		line := strings.TrimRight(string(seg.Value(r.src)), "\r\n")
+		for _, part := range wrapLine(expandTabs(line), r.width()-2, r.runeWidth) {
+			pdf.SetX(r.left())
+			pdf.CellFormat(r.width(), r.lineHeight(), " "+part, "", 1, "L", true, 0, "")
+		}
+	}
+	pdf.SetFillColor(255, 255, 255)
+	r.setSize(markdownBodySize)
+	r.gap()
+}
+
+func (r *markdownRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	if r.bold > 0 {
+		// fill and stroke the glyphs to fake a bold weight
+		r.pdf.SetLineWidth(r.size * 0.012)
+		r.pdf.SetTextRenderingMode(2)
+		r.pdf.Write(r.lineHeight(), s)
+		r.pdf.SetTextRenderingMode(0)
+		r.pdf.SetLineWidth(0.2)
+		return
+	}
+	r.pdf.Write(r.lineHeight(), s)
+}
+
+func (r *markdownRenderer) inline(parent ast.Node) {
+	pdf := r.pdf
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		switch node := n.(type) {
+		case *ast.Text:
+			r.write(string(node.Segment.Value(r.src)))
+			if node.HardLineBreak() {
+				pdf.Ln(r.lineHeight())
+			} else if node.SoftLineBreak() {
+				r.write(" ")
+			}
+		case *ast.String:
+			r.write(string(node.Value))
+		case *ast.Emphasis:
+			if node.Level >= 2 {
+				r.bold++
+				r.inline(node)
+				r.bold--
+			} else {
+				r.inline(node)
+			}
+		case *ast.CodeSpan:
+			pdf.SetTextColor(170, 40, 40)
+			r.inline(node)
+			pdf.SetTextColor(0, 0, 0)
+		case *ast.Link:
+			pdf.SetTextColor(20, 80, 200)
+			pdf.WriteLinkString(r.lineHeight(), r.plainText(node), string(node.Destination))
+			pdf.SetTextColor(0, 0, 0)
+		case *ast.AutoLink:
+			url := string(node.URL(r.src))
+			pdf.SetTextColor(20, 80, 200)
+			pdf.WriteLinkString(r.lineHeight(), string(node.Label(r.src)), url)
+			pdf.SetTextColor(0, 0, 0)
+		case *ast.Image:
+			r.write("[" + r.plainText(node) + "]")
+		case *ast.RawHTML:
+			// raw HTML is not rendered
+		default:
+			r.inline(n)
+		}
+	}
+}
+
+// plainText returns the text content of an inline subtree.
+func (r *markdownRenderer) plainText(n ast.Node) string {
+	var b strings.Builder
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch t := c.(type) {
+		case *ast.Text:
+			b.Write(t.Segment.Value(r.src))
+			if t.SoftLineBreak() {
+				b.WriteByte(' ')
+			}
+		case *ast.String:
+			b.Write(t.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return b.String()
+}
+
+func (r *markdownRenderer) table(t *east.Table) {
+	pdf := r.pdf
+	type row struct {
+		cells  []string
+		header bool
+	}
+	rows := []row{}
+	cols := 0
+	for rn := t.FirstChild(); rn != nil; rn = rn.NextSibling() {
+		rw := row{header: rn.Kind() == east.KindTableHeader}
+		for c := rn.FirstChild(); c != nil; c = c.NextSibling() {
+			rw.cells = append(rw.cells, r.plainText(c))
+		}
+		if len(rw.cells) > cols {
+			cols = len(rw.cells)
+		}
+		rows = append(rows, rw)
+	}
+	if cols == 0 {
+		return
+	}
+
+	r.setSize(markdownBodySize - 1)
+	lineH := r.lineHeight()
+	colW := r.width() / float64(cols)
+	_, pageH := pdf.GetPageSize()
+	pdf.SetFillColor(235, 235, 235)
+	pdf.SetDrawColor(160, 160, 160)
+	for _, rw := range rows {
+		wrapped := make([][]string, cols)
+		lines := 1
+		for i := 0; i < cols; i++ {
+			cell := ""
+			if i < len(rw.cells) {
+				cell = rw.cells[i]
+			}
+			wrapped[i] = wrapLine(cell, colW-2*markdownCellPadMM, r.runeWidth)
+			if len(wrapped[i]) > lines {
+				lines = len(wrapped[i])
+			}
+		}
+		height := float64(lines)*lineH + 2*markdownCellPadMM
+		if pdf.GetY()+height > pageH-markdownMarginMM {
+			pdf.AddPage()
+		}
+		x, y := r.left(), pdf.GetY()
+		style := "D"
+		if rw.header {
+			style = "FD"
+			r.bold++
+		}
+		for i := 0; i < cols; i++ {
+			cx := x + float64(i)*colW
+			pdf.Rect(cx, y, colW, height, style)
+			align := "L"
+			if i < len(t.Alignments) {
+				switch t.Alignments[i] {
+				case east.AlignCenter:
+					align = "C"
+				case east.AlignRight:
+					align = "R"
+				}
+			}
+			for k, line := range wrapped[i] {
+				pdf.SetXY(cx+markdownCellPadMM, y+markdownCellPadMM+float64(k)*lineH)
+				if r.bold > 0 {
+					pdf.SetTextRenderingMode(2)
+				}
+				pdf.CellFormat(colW-2*markdownCellPadMM, lineH, line, "", 0, align, false, 0, "")
+				pdf.SetTextRenderingMode(0)
+			}
+		}
+		if rw.header {
+			r.bold--
+		}
+		pdf.SetXY(x, y+height)
+	}
+	pdf.SetFillColor(255, 255, 255)
+	pdf.SetDrawColor(0, 0, 0)
+	r.setSize(markdownBodySize)
+}
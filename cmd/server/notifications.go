@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"cups-web/internal/store"
+)
+
+type pendingEmail struct {
+	to      string
+	subject string
+	body    string
+	// notice is the notification marked as sent for this email, cleared
+	// again when the email cannot be delivered so a later check retries it.
+	notice *store.Notification
+}
+
+// notifyUserThresholds checks the user's balance and monthly spending against
+// the configured thresholds and emails the user the first time each one is
+// crossed. The low-balance notice is re-armed once the balance recovers.
+func notifyUserThresholds(ctx context.Context, userID int64) {
+	if appMailer == nil {
+		return
+	}
+	var emails []pendingEmail
+	err := appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.Email == "" {
+			return nil
+		}
+		if err := normalizeUserPeriods(ctx, tx, &user, time.Now()); err != nil {
+			return err
+		}
+		threshold, err := store.GetSettingInt(ctx, tx, store.SettingLowBalanceCents, 0)
+		if err != nil {
+			return err
+		}
+		if threshold > 0 {
+			if user.BalanceCents < threshold {
+				sent, err := store.MarkNotificationSent(ctx, tx, user.ID, store.NotificationLowBalance, "")
+				if err != nil {
+					return err
+				}
+				if sent {
+					emails = append(emails, pendingEmail{
+						notice:  &store.Notification{UserID: user.ID, Kind: store.NotificationLowBalance},
+						to:      user.Email,
+						subject: "打印余额不足提醒",
+						body: fmt.Sprintf("%s，您好：\n\n您的打印余额为 %s，已低于提醒阈值 %s，请及时联系管理员充值。",
+							displayName(user), formatCents(user.BalanceCents), formatCents(threshold)),
+					})
+				}
+			} else if err := store.ClearNotification(ctx, tx, user.ID, store.NotificationLowBalance); err != nil {
+				return err
+			}
+		}
+		if user.MonthlyLimitCents > 0 {
+			spent := user.MonthSpentCents
+			limit := user.MonthlyLimitCents
+			kind := ""
+			percent := 0
+			switch {
+			case spent >= limit:
+				kind, percent = store.NotificationMonthlyLimit, 100
+			case spent*5 >= limit*4:
+				kind, percent = store.NotificationMonthlyLimit80, 80
+			}
+			if kind != "" {
+				sent, err := store.MarkNotificationSent(ctx, tx, user.ID, kind, user.MonthPeriod)
+				if err != nil {
+					return err
+				}
+				if sent {
+					emails = append(emails, pendingEmail{
+						notice:  &store.Notification{UserID: user.ID, Kind: kind, PeriodKey: user.MonthPeriod},
+						to:      user.Email,
+						subject: "本月打印额度提醒",
+						body: fmt.Sprintf("%s，您好：\n\n您本月已打印消费 %s，达到月度额度 %s 的 %d%%。",
+							displayName(user), formatCents(spent), formatCents(limit), percent),
+					})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("notification check failed:", err)
+		return
+	}
+	sendEmails(ctx, emails)
+}
+
+type autoTopupNotice struct {
+	userID       int64
+	amountCents  int64
+	balanceCents int64
+	topupType    string
+}
+
+func notifyAutoTopups(ctx context.Context, notices []autoTopupNotice) {
+	if appMailer == nil || len(notices) == 0 {
+		return
+	}
+	var emails []pendingEmail
+	err := appStore.WithTx(ctx, true, func(tx *sql.Tx) error {
+		for _, n := range notices {
+			user, err := store.GetUserByID(ctx, tx, n.userID)
+			if err != nil {
+				return err
+			}
+			if user.Email == "" {
+				continue
+			}
+			emails = append(emails, pendingEmail{
+				to:      user.Email,
+				subject: "打印余额自动充值通知",
+				body: fmt.Sprintf("%s，您好：\n\n系统已为您%s %s，当前余额为 %s。",
+					displayName(user), autoTopupLabel(n.topupType), formatCents(n.amountCents), formatCents(n.balanceCents)),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("auto topup notification failed:", err)
+		return
+	}
+	sendEmails(ctx, emails)
+	for _, n := range notices {
+		notifyUserThresholds(ctx, n.userID)
+	}
+}
+
+func sendEmails(ctx context.Context, emails []pendingEmail) {
+	for _, e := range emails {
+		sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := appMailer.Send(sendCtx, e.to, e.subject, e.body); err != nil {
+			log.Printf("send email to %s failed: %v", e.to, err)
+			if e.notice != nil {
+				unmarkNotification(ctx, *e.notice)
+			}
+		}
+		cancel()
+	}
+}
+
+func unmarkNotification(ctx context.Context, n store.Notification) {
+	err := appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+		return store.UnmarkNotificationSent(ctx, tx, n.UserID, n.Kind, n.PeriodKey)
+	})
+	if err != nil {
+		log.Printf("clear notification %s for user %d failed: %v", n.Kind, n.UserID, err)
+	}
+}
+
+func autoTopupLabel(typ string) string {
+	switch typ {
+	case "auto_daily":
+		return "每日自动充值"
+	case "auto_monthly":
+		return "每月自动充值"
+	case "auto_yearly":
+		return "每年自动充值"
+	default:
+		return "自动充值"
+	}
+}
+
+func displayName(user store.User) string {
+	if user.ContactName != "" {
+		return user.ContactName
+	}
+	return user.Username
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return sign + "¥" + strconv.FormatInt(cents/100, 10) + "." + fmt.Sprintf("%02d", cents%100)
+}
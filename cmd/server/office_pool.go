@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LibreOffice 转换池：限制同时运行的转换数，每个槽位使用独立且长期保留的
+// 用户配置目录（共用配置会导致并发转换失败，保留配置可省去每次初始化），
+// 排队的请求按用户轮流分配槽位，并统计排队长度和转换耗时。装有 unoserver
+// 时每个槽位使用一个常驻转换进程（见 office_worker.go），否则每次转换启动
+// 一个 libreoffice。
+
+const (
+	defaultOfficeWorkers = 2
+	maxOfficeQueue       = 64
+	officeConvertTimeout = 60 * time.Second
+)
+
+var errOfficeQueueFull = errors.New("conversion queue is full, try again later")
+
+// officeConverters is the process-wide pool, set up by startOfficePool.
+var officeConverters = newOfficePool(defaultOfficeWorkers, filepath.Join(os.TempDir(), "cups-web-office"))
+
+type officeWaiter struct {
+	ready    chan int
+	assigned bool
+}
+
+// officePool hands out converter slots. Waiters are kept per user and served
+// round-robin, so one user converting many files does not starve the rest.
+type officePool struct {
+	mu          sync.Mutex
+	workers     int
+	profileBase string
+	free        []int
+	waiting     map[int64][]*officeWaiter
+	owners      []int64
+	queued      int
+	// persistent is set when slots convert through long-lived unoserver
+	// workers instead of one libreoffice run per file.
+	persistent bool
+	slots      []*officeWorker
+
+	workerStarts int64
+
+	completed  int64
+	failed     int64
+	timedOut   int64
+	rejected   int64
+	totalTime  time.Duration
+	maxTime    time.Duration
+	lastTime   time.Duration
+	maxWaiting time.Duration
+}
+
+func newOfficePool(workers int, profileBase string) *officePool {
+	p := &officePool{
+		workers:     workers,
+		profileBase: profileBase,
+		waiting:     map[int64][]*officeWaiter{},
+	}
+	for i := 0; i < workers; i++ {
+		p.free = append(p.free, i)
+	}
+	return p
+}
+
+// startOfficePool sizes the pool from LIBREOFFICE_WORKERS and uses
+// persistent workers when unoserver and unoconvert are installed.
+func startOfficePool() {
+	n := defaultOfficeWorkers
+	if v, err := strconv.Atoi(os.Getenv("LIBREOFFICE_WORKERS")); err == nil && v > 0 {
+		n = v
+	}
+	p := newOfficePool(n, officeConverters.profileBase)
+	_, errServer := exec.LookPath("unoserver")
+	_, errConvert := exec.LookPath("unoconvert")
+	if errServer == nil && errConvert == nil {
+		p.persistent = true
+		for i := 0; i < n; i++ {
+			p.slots = append(p.slots, &officeWorker{
+				slot:    i,
+				port:    officePortBase + 2*i,
+				profile: p.profileDir(i),
+			})
+		}
+	} else {
+		log.Printf("unoserver not found, starting libreoffice for each conversion")
+	}
+	officeConverters = p
+}
+
+// profileDir is the LibreOffice user installation directory of a slot.
+func (p *officePool) profileDir(slot int) string {
+	return filepath.Join(p.profileBase, "slot-"+strconv.Itoa(slot))
+}
+
+// profileURL is the LibreOffice user installation of a slot.
+func (p *officePool) profileURL(slot int) string {
+	return "file://" + filepath.ToSlash(p.profileDir(slot))
+}
+
+func (p *officePool) noteWorkerStart() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workerStarts++
+}
+
+// acquire waits for a free slot. The wait ends early when ctx is done.
+func (p *officePool) acquire(ctx context.Context, owner int64) (int, error) {
+	start := time.Now()
+	p.mu.Lock()
+	if len(p.free) > 0 && p.queued == 0 {
+		slot := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		p.mu.Unlock()
+		return slot, nil
+	}
+	if p.queued >= maxOfficeQueue {
+		p.rejected++
+		p.mu.Unlock()
+		return 0, errOfficeQueueFull
+	}
+	w := &officeWaiter{ready: make(chan int, 1)}
+	if len(p.waiting[owner]) == 0 {
+		p.owners = append(p.owners, owner)
+	}
+	p.waiting[owner] = append(p.waiting[owner], w)
+	p.queued++
+	p.mu.Unlock()
+
+	select {
+	case slot := <-w.ready:
+		p.noteWait(time.Since(start))
+		return slot, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		if !w.assigned {
+			p.removeWaiter(owner, w)
+			p.mu.Unlock()
+			return 0, ctx.Err()
+		}
+		p.mu.Unlock()
+		// a slot was handed over just as the context ended
+		p.release(<-w.ready)
+		return 0, ctx.Err()
+	}
+}
+
+// release gives the slot to the next user in turn, or frees it.
+func (p *officePool) release(slot int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued == 0 {
+		p.free = append(p.free, slot)
+		return
+	}
+	owner := p.owners[0]
+	queue := p.waiting[owner]
+	w := queue[0]
+	p.owners = p.owners[1:]
+	if len(queue) > 1 {
+		p.waiting[owner] = queue[1:]
+		p.owners = append(p.owners, owner)
+	} else {
+		delete(p.waiting, owner)
+	}
+	p.queued--
+	w.assigned = true
+	w.ready <- slot
+}
+
+// removeWaiter drops a waiter that gave up. The caller holds p.mu.
+func (p *officePool) removeWaiter(owner int64, w *officeWaiter) {
+	queue := p.waiting[owner]
+	for i, q := range queue {
+		if q == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			p.queued--
+			break
+		}
+	}
+	if len(queue) > 0 {
+		p.waiting[owner] = queue
+		return
+	}
+	delete(p.waiting, owner)
+	for i, o := range p.owners {
+		if o == owner {
+			p.owners = append(p.owners[:i], p.owners[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *officePool) noteWait(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d > p.maxWaiting {
+		p.maxWaiting = d
+	}
+}
+
+// observe records the outcome of one conversion.
+func (p *officePool) observe(d time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err == nil:
+		p.completed++
+	case errors.Is(err, context.DeadlineExceeded):
+		p.timedOut++
+	default:
+		p.failed++
+	}
+	p.totalTime += d
+	p.lastTime = d
+	if d > p.maxTime {
+		p.maxTime = d
+	}
+}
+
+type officePoolStats struct {
+	Workers       int   `json:"workers"`
+	Persistent    bool  `json:"persistent"`
+	WorkerStarts  int64 `json:"workerStarts"`
+	Busy          int   `json:"busy"`
+	Queued        int   `json:"queued"`
+	QueuedUsers   int   `json:"queuedUsers"`
+	Completed     int64 `json:"completed"`
+	Failed        int64 `json:"failed"`
+	TimedOut      int64 `json:"timedOut"`
+	Rejected      int64 `json:"rejected"`
+	AvgMillis     int64 `json:"avgMillis"`
+	MaxMillis     int64 `json:"maxMillis"`
+	LastMillis    int64 `json:"lastMillis"`
+	MaxWaitMillis int64 `json:"maxWaitMillis"`
+}
+
+func (p *officePool) stats() officePoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := officePoolStats{
+		Workers:       p.workers,
+		Persistent:    p.persistent,
+		WorkerStarts:  p.workerStarts,
+		Busy:          p.workers - len(p.free),
+		Queued:        p.queued,
+		QueuedUsers:   len(p.owners),
+		Completed:     p.completed,
+		Failed:        p.failed,
+		TimedOut:      p.timedOut,
+		Rejected:      p.rejected,
+		MaxMillis:     p.maxTime.Milliseconds(),
+		LastMillis:    p.lastTime.Milliseconds(),
+		MaxWaitMillis: p.maxWaiting.Milliseconds(),
+	}
+	if runs := p.completed + p.failed + p.timedOut; runs > 0 {
+		s.AvgMillis = (p.totalTime / time.Duration(runs)).Milliseconds()
+	}
+	return s
+}
+
+type convertOwnerKey struct{}
+
+// withConvertOwner tags conversions made with ctx as the user's, for fair
+// scheduling in the pool.
+func withConvertOwner(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, convertOwnerKey{}, userID)
+}
+
+func convertOwner(ctx context.Context) int64 {
+	id, _ := ctx.Value(convertOwnerKey{}).(int64)
+	return id
+}
+
+func adminConvertStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, officeConverters.stats())
+}
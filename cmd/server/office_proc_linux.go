@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// setParentDeathSignal asks the kernel to stop the child when the server
+// exits, so long-lived converters do not linger holding their ports.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGTERM
+}
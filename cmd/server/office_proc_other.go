@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+func killProcessGroup(cmd *exec.Cmd) {}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func stopProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
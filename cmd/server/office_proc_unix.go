@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup makes cancelling cmd kill the whole process group. The
+// libreoffice launcher forks soffice.bin, which would otherwise outlive it.
+func killProcessGroup(cmd *exec.Cmd) {
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return stopProcessGroup(cmd)
+	}
+}
+
+// setProcessGroup starts cmd in its own process group, so stopProcessGroup
+// reaches the processes it forks.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	setParentDeathSignal(cmd.SysProcAttr)
+}
+
+func stopProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// 常驻转换进程：每个槽位运行一个 unoserver，由它启动并保持一个使用该槽位
+// 配置目录的 LibreOffice，转换通过 unoconvert 提交，省去每次启动
+// LibreOffice 的开销。进程退出或转换超时后，下次使用时重新启动。
+
+const (
+	officeStartTimeout = 60 * time.Second
+	// officePortBase is the first port of the slot workers: slot n serves
+	// conversions on officePortBase+2n and runs LibreOffice on the next port.
+	officePortBase = 21000
+)
+
+// officeWorker is the long-lived unoserver of one pool slot. Only the holder
+// of the slot uses it, so it needs no locking of its own.
+type officeWorker struct {
+	slot    int
+	port    int
+	profile string
+	cmd     *exec.Cmd
+	done    chan struct{}
+}
+
+func (w *officeWorker) addr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(w.port))
+}
+
+// running reports whether the worker was started and has not exited.
+func (w *officeWorker) running() bool {
+	if w.cmd == nil {
+		return false
+	}
+	select {
+	case <-w.done:
+		w.cmd = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// start launches unoserver and waits until it accepts connections.
+func (w *officeWorker) start(ctx context.Context) error {
+	if err := os.MkdirAll(w.profile, 0700); err != nil {
+		return err
+	}
+	cmd := exec.Command("unoserver",
+		"--interface", "127.0.0.1", "--port", strconv.Itoa(w.port),
+		"--uno-interface", "127.0.0.1", "--uno-port", strconv.Itoa(w.port+1),
+		"--user-installation", w.profile)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start unoserver: %w", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Printf("office worker %d exited: %v", w.slot, err)
+		close(done)
+	}()
+	w.cmd, w.done = cmd, done
+
+	timeout := time.NewTimer(officeStartTimeout)
+	defer timeout.Stop()
+	for {
+		if conn, err := net.DialTimeout("tcp", w.addr(), time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-done:
+			w.cmd = nil
+			return errors.New("unoserver exited during startup")
+		case <-ctx.Done():
+			w.stop()
+			return ctx.Err()
+		case <-timeout.C:
+			w.stop()
+			return errors.New("unoserver did not start in time")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// stop kills unoserver and the LibreOffice it runs and waits for them to
+// exit.
+func (w *officeWorker) stop() {
+	if w.cmd == nil {
+		return
+	}
+	stopProcessGroup(w.cmd)
+	<-w.done
+	w.cmd = nil
+}
+
+// convert converts inputPath to the PDF outPath, starting the worker first
+// when it is not running. It reports whether the worker had to be started.
+func (w *officeWorker) convert(ctx context.Context, inputPath string, outPath string) (started bool, out []byte, err error) {
+	if !w.running() {
+		if err := w.start(ctx); err != nil {
+			return true, nil, err
+		}
+		started = true
+	}
+	cmd := exec.CommandContext(ctx, "unoconvert", "--host", "127.0.0.1", "--port", strconv.Itoa(w.port),
+		"--convert-to", "pdf", inputPath, outPath)
+	out, err = cmd.CombinedOutput()
+	if err != nil && ctx.Err() != nil {
+		// LibreOffice is likely stuck on the document; start afresh next time
+		w.stop()
+	}
+	return started, out, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// 加密 PDF：上传时检测加密，用 pdfPassword 字段提供的密码经 qpdf 解密后
+// 替换原文件，之后的页数统计和打印都使用解密后的文件，密码不会保存。
+
+var (
+	errPDFPasswordRequired = errors.New("pdf is password protected")
+	errPDFPasswordInvalid  = errors.New("incorrect pdf password")
+	errPDFDecryptFailed    = errors.New("failed to decrypt pdf")
+)
+
+// error codes returned alongside the message so clients can ask for the
+// password
+const (
+	errCodePDFPasswordRequired = "pdf_password_required"
+	errCodePDFPasswordInvalid  = "pdf_password_invalid"
+)
+
+// pdfEncryptPattern matches the /Encrypt entry of a trailer or cross
+// reference stream dictionary.
+var pdfEncryptPattern = regexp.MustCompile(`/Encrypt\s*(\d+\s+\d+\s+R|<<)`)
+
+func isEncryptedPDF(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return pdfEncryptPattern.Match(data), nil
+}
+
+// decryptUploadedPDF replaces an encrypted PDF upload with a decrypted copy.
+// Other files are left alone. PDFs that only restrict permissions open with
+// an empty password. Errors other than the password ones are logged and
+// reported as errPDFDecryptFailed.
+func decryptUploadedPDF(ctx context.Context, path string, name string, password string) error {
+	if detectFileKind(path, name) != fileKindPDF {
+		return nil
+	}
+	encrypted, err := isEncryptedPDF(path)
+	if err != nil {
+		log.Printf("decrypt %s: %v", name, err)
+		return errPDFDecryptFailed
+	}
+	if !encrypted {
+		return nil
+	}
+	tmp := path + ".decrypted"
+	// the password is passed on stdin so it does not show up in ps
+	cmd := exec.CommandContext(ctx, "qpdf", "--password-file=-", "--decrypt", path, tmp)
+	cmd.Stdin = strings.NewReader(password)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	// exit status 3 means the output was written with warnings
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 3) {
+		_ = os.Remove(tmp)
+		if strings.Contains(strings.ToLower(string(out)), "invalid password") {
+			if password == "" {
+				return errPDFPasswordRequired
+			}
+			return errPDFPasswordInvalid
+		}
+		log.Printf("decrypt %s: %v - %s", name, err, strings.TrimSpace(string(out)))
+		return errPDFDecryptFailed
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("decrypt %s: %v", name, err)
+		return errPDFDecryptFailed
+	}
+	return nil
+}
+
+// writePDFPasswordError writes the response for the password errors of
+// decryptUploadedPDF and reports whether err was one of them.
+func writePDFPasswordError(w http.ResponseWriter, err error) bool {
+	code := ""
+	switch {
+	case errors.Is(err, errPDFPasswordRequired):
+		code = errCodePDFPasswordRequired
+	case errors.Is(err, errPDFPasswordInvalid):
+		code = errCodePDFPasswordInvalid
+	default:
+		return false
+	}
+	writeJSONErrorCode(w, http.StatusUnprocessableEntity, code, err.Error())
+	return true
+}
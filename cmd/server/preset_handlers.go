@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/ipp"
+	"cups-web/internal/store"
+)
+
+var mediaKeywordPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+var validNumberUp = map[int]bool{0: true, 1: true, 2: true, 4: true, 6: true, 9: true, 16: true}
+
+type presetPayload struct {
+	Name         string `json:"name"`
+	Printer      string `json:"printer"`
+	Sides        string `json:"sides"`
+	IsColor      bool   `json:"isColor"`
+	Copies       int    `json:"copies"`
+	Media        string `json:"media"`
+	NumberUp     int    `json:"numberUp"`
+	PrintQuality string `json:"printQuality"`
+	IsDefault    bool   `json:"isDefault"`
+}
+
+type presetResponse struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Printer      string `json:"printer"`
+	Sides        string `json:"sides"`
+	IsColor      bool   `json:"isColor"`
+	Copies       int    `json:"copies"`
+	Media        string `json:"media"`
+	NumberUp     int    `json:"numberUp"`
+	PrintQuality string `json:"printQuality"`
+	IsDefault    bool   `json:"isDefault"`
+	CreatedAt    string `json:"createdAt"`
+	UpdatedAt    string `json:"updatedAt"`
+}
+
+// validateJobOptions checks the optional IPP job attributes shared by print
+// requests and presets.
+func validateJobOptions(media string, numberUp int, quality string) error {
+	if media != "" && !mediaKeywordPattern.MatchString(media) {
+		return errors.New("invalid media")
+	}
+	if !validNumberUp[numberUp] {
+		return errors.New("numberUp must be 1, 2, 4, 6, 9 or 16")
+	}
+	if quality != "" && !ipp.ValidPrintQuality(quality) {
+		return errors.New("printQuality must be draft, normal or high")
+	}
+	return nil
+}
+
+func (p presetPayload) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("name required")
+	}
+	if p.Copies < 0 || p.Copies > 100 {
+		return errors.New("copies must be 0-100")
+	}
+	return validateJobOptions(p.Media, p.NumberUp, p.PrintQuality)
+}
+
+func (p presetPayload) toPreset(userID int64) store.PrintPreset {
+	return store.PrintPreset{
+		UserID:       userID,
+		Name:         strings.TrimSpace(p.Name),
+		PrinterURI:   strings.TrimSpace(p.Printer),
+		Sides:        p.Sides,
+		IsColor:      p.IsColor,
+		Copies:       p.Copies,
+		Media:        p.Media,
+		NumberUp:     p.NumberUp,
+		PrintQuality: p.PrintQuality,
+		IsDefault:    p.IsDefault,
+	}
+}
+
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp []presetResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		list, err := store.ListPrintPresets(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		resp = make([]presetResponse, 0, len(list))
+		for _, p := range list {
+			resp = append(resp, mapPreset(p))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load presets")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func createPresetHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload presetPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if err := payload.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var created store.PrintPreset
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		p, err := store.CreatePrintPreset(r.Context(), tx, payload.toPreset(sess.UserID))
+		if err != nil {
+			return err
+		}
+		created = p
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create preset")
+		return
+	}
+	writeJSON(w, mapPreset(created))
+}
+
+func updatePresetHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid preset id")
+		return
+	}
+	var payload presetPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if err := payload.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var updated store.PrintPreset
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		p := payload.toPreset(sess.UserID)
+		p.ID = id
+		saved, err := store.UpdatePrintPreset(r.Context(), tx, p)
+		if err != nil {
+			return err
+		}
+		updated = saved
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, errPresetNotFound.Error())
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to update preset")
+		}
+		return
+	}
+	writeJSON(w, mapPreset(updated))
+}
+
+func deletePresetHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid preset id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		return store.DeletePrintPreset(r.Context(), tx, id, sess.UserID)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, errPresetNotFound.Error())
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to delete preset")
+		}
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func mapPreset(p store.PrintPreset) presetResponse {
+	return presetResponse{
+		ID:           p.ID,
+		Name:         p.Name,
+		Printer:      p.PrinterURI,
+		Sides:        p.Sides,
+		IsColor:      p.IsColor,
+		Copies:       p.Copies,
+		Media:        p.Media,
+		NumberUp:     p.NumberUp,
+		PrintQuality: p.PrintQuality,
+		IsDefault:    p.IsDefault,
+		CreatedAt:    p.CreatedAt,
+		UpdatedAt:    p.UpdatedAt,
+	}
+}
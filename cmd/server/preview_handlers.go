@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cups-web/internal/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// 打印预览：上传文件经现有转换流程转为 PDF 后，用 pdftoppm 渲染每页缩略图，
+// 按文件内容哈希缓存，相同文件再次预览时直接返回。
+
+const (
+	previewsDir     = "previews"
+	previewWidth    = 300
+	previewMaxPages = 50
+	previewTTL      = 24 * time.Hour
+	previewMetaFile = "meta.json"
+)
+
+type previewMeta struct {
+	Pages    int `json:"pages"`
+	Rendered int `json:"rendered"`
+}
+
+type previewResp struct {
+	Hash       string   `json:"hash"`
+	Pages      int      `json:"pages"`
+	Thumbnails []string `json:"thumbnails"`
+}
+
+// previewHandler converts the uploaded file and returns URLs of its page
+// thumbnails. Only the first previewMaxPages pages are rendered.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	defer file.Close()
+
+	conv, err := parseConvertOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tmpPath, cleanup, err := saveTempUpload(file, fh.Filename)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	defer cleanup()
+	if err := decryptUploadedPDF(r.Context(), tmpPath, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+		if !writePDFPasswordError(w, err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+	hash, err := convertKey(tmpPath, fh.Filename, conv)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read file")
+		return
+	}
+
+	sess, _ := auth.GetSession(r)
+	extendWriteDeadline(w)
+	convertCtx, cancel := convertTimeoutContext(withConvertOwner(r.Context(), sess.UserID))
+	defer cancel()
+	meta, err := renderPreview(convertCtx, hash, tmpPath, fh.Filename, conv)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	resp := previewResp{Hash: hash, Pages: meta.Pages, Thumbnails: make([]string, 0, meta.Rendered)}
+	for i := 1; i <= meta.Rendered; i++ {
+		resp.Thumbnails = append(resp.Thumbnails, fmt.Sprintf("/api/previews/%s/%d.png", hash, i))
+	}
+	writeJSON(w, resp)
+}
+
+func previewImageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	page, err := strconv.Atoi(vars["page"])
+	if err != nil || page < 1 {
+		writeJSONError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	path := filepath.Join(uploadDir, previewsDir, vars["hash"], strconv.Itoa(page)+".png")
+	f, err := os.Open(path)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "preview not found")
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to stat file")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+// renderPreview returns the cached thumbnails for hash or renders them. The
+// thumbnails are rendered in a scratch directory that is renamed into place,
+// so concurrent requests for the same file never see a partial cache entry.
+func renderPreview(ctx context.Context, hash string, srcPath string, filename string, conv convertOptions) (previewMeta, error) {
+	base := filepath.Join(uploadDir, previewsDir)
+	dir := filepath.Join(base, hash)
+	if meta, err := readPreviewMeta(dir); err == nil {
+		now := time.Now()
+		_ = os.Chtimes(dir, now, now)
+		return meta, nil
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return previewMeta{}, err
+	}
+	scratch, err := os.MkdirTemp(base, "tmp-"+hash[:8]+"-")
+	if err != nil {
+		return previewMeta{}, err
+	}
+	defer os.RemoveAll(scratch)
+
+	sourceName := "source" + sanitizeExtPart(filepath.Ext(filename))
+	if err := copyFile(srcPath, filepath.Join(scratch, sourceName)); err != nil {
+		return previewMeta{}, err
+	}
+	sourceRel := previewsDir + "/" + filepath.Base(scratch) + "/" + sourceName
+	doc, err := preparePrintDocument(ctx, sourceRel, filepath.Join(scratch, sourceName), filename, conv)
+	if err != nil {
+		return previewMeta{}, err
+	}
+	defer doc.cleanup()
+	if doc.mime != "application/pdf" {
+		return previewMeta{}, errors.New("preview is not available for this file type")
+	}
+
+	meta := previewMeta{Pages: doc.pages, Rendered: doc.pages}
+	if meta.Rendered > previewMaxPages {
+		meta.Rendered = previewMaxPages
+	}
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-png", "-scale-to", strconv.Itoa(previewWidth),
+		"-f", "1", "-l", strconv.Itoa(meta.Rendered), doc.path, filepath.Join(scratch, "page"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return previewMeta{}, fmt.Errorf("render failed: %w - %s", err, strings.TrimSpace(string(out)))
+	}
+	// pdftoppm zero-pads page numbers to the width of the last page
+	matches, _ := filepath.Glob(filepath.Join(scratch, "page-*.png"))
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "page-"), ".png"))
+		if err != nil {
+			continue
+		}
+		if err := os.Rename(m, filepath.Join(scratch, strconv.Itoa(n)+".png")); err != nil {
+			return previewMeta{}, err
+		}
+	}
+	_ = os.Remove(filepath.Join(scratch, sourceName))
+	_ = os.Remove(filepath.Join(scratch, sourceName+convertedSuffix))
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return previewMeta{}, err
+	}
+	if err := os.WriteFile(filepath.Join(scratch, previewMetaFile), data, 0644); err != nil {
+		return previewMeta{}, err
+	}
+	if err := os.Rename(scratch, dir); err != nil {
+		// another request rendered the same file first
+		if cached, err := readPreviewMeta(dir); err == nil {
+			return cached, nil
+		}
+		return previewMeta{}, err
+	}
+	return meta, nil
+}
+
+func readPreviewMeta(dir string) (previewMeta, error) {
+	var meta previewMeta
+	data, err := os.ReadFile(filepath.Join(dir, previewMetaFile))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cleanupPreviews removes cached previews that have not been requested for
+// previewTTL, along with scratch directories left by interrupted renders.
+func cleanupPreviews(uploads string, now time.Time) {
+	base := filepath.Join(uploads, previewsDir)
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < previewTTL {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(base, e.Name())); err != nil {
+			log.Println("remove preview failed:", err)
+		}
+	}
+}
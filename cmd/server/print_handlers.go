@@ -2,21 +2,24 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"cups-web/internal/auth"
-	"cups-web/internal/ipp"
 	"cups-web/internal/store"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type printResp struct {
+	RecordID        int64  `json:"recordId"`
+	Status          string `json:"status"`
 	JobID           string `json:"jobId,omitempty"`
 	OK              bool   `json:"ok"`
 	Pages           int    `json:"pages"`
@@ -34,252 +37,387 @@ var (
 	errYearlyLimit         = errors.New("yearly limit exceeded")
 )
 
+// printHandler stores the upload and queues it. Conversion and the IPP
+// submission happen in the print workers; clients follow progress through
+// /api/events or /api/print-records.
 func printHandler(w http.ResponseWriter, r *http.Request) {
 	// Expect multipart form
 	if err := r.ParseMultipartForm(64 << 20); err != nil {
 		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
 		return
 	}
-	file, fh, err := r.FormFile("file")
+	album, err := parseAlbumOptions(r)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer file.Close()
-
-	printer := r.FormValue("printer")
-	if printer == "" {
-		writeJSONError(w, http.StatusBadRequest, "missing printer field")
-		return
-	}
-
-	sides := r.FormValue("sides")
-	duplexParam := r.FormValue("duplex")
-	if sides == "" {
-		if duplexParam == "true" {
-			sides = "two-sided-long-edge"
-		} else {
-			sides = "one-sided"
-		}
+	maxFiles := maxPrintFiles
+	if album != nil {
+		maxFiles = maxAlbumFiles
 	}
-	isDuplex := strings.HasPrefix(sides, "two-sided")
-	isColor := r.FormValue("color") == "true"
-	
-	// 获取打印份数，默认为1
-	copies := 1
-	if copiesStr := r.FormValue("copies"); copiesStr != "" {
-		if c, err := strconv.Atoi(copiesStr); err == nil && c > 0 && c <= 100 {
-			copies = c
-		}
+	fhs, err := orderedUploads(r, maxFiles)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	
-	// 获取页面范围，默认为全部页面
-	pageRange := r.FormValue("pageRange")
 
-	storedRel, storedAbs, err := saveUploadedFile(file, fh.Filename, uploadDir)
+	sess, _ := auth.GetSession(r)
+	opts, err := parsePrintOptions(r, sess.UserID)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	countCtx, cancel := convertTimeoutContext(r.Context())
-	defer cancel()
-	printPath := storedAbs
-	var printCleanup func()
-	printMime := ""
-	var pages int
-	kind := detectFileKind(storedAbs, fh.Filename)
-	switch kind {
-	case fileKindPDF:
-		var err error
-		pages, err = countPDFPages(storedAbs)
-		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "failed to read pages")
+	// 保密打印：任务保留在服务器上，凭 PIN 释放；未设置 PIN 时只能在释放终端上释放
+	hold := r.FormValue("hold") == "true"
+	var pinHash string
+	if pin := r.FormValue("releasePin"); hold && pin != "" {
+		if !validReleasePin(pin) {
+			writeJSONError(w, http.StatusBadRequest, "release pin must be 4-8 digits")
 			return
 		}
-		printMime = "application/pdf"
-	case fileKindOffice:
-		outPath, cleanup, err := convertOfficeToPDF(countCtx, storedAbs)
+		hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
 		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "conversion failed")
+			writeJSONError(w, http.StatusInternalServerError, "failed to hash pin")
 			return
 		}
-		pages, err = countPDFPages(outPath)
-		if err != nil {
-			cleanup()
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "failed to read pages")
+		pinHash = string(hash)
+	}
+
+	// 定时打印：到指定时间后再进入打印队列
+	var printAt time.Time
+	if v := strings.TrimSpace(r.FormValue("printAt")); v != "" {
+		if hold {
+			writeJSONError(w, http.StatusBadRequest, "printAt cannot be combined with hold")
 			return
 		}
-		_, convertedAbs, err := saveConvertedPDFToUploads(outPath, storedRel, uploadDir)
+		t, err := parsePrintAt(v, time.Now())
 		if err != nil {
-			cleanup()
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusInternalServerError, "failed to save converted file")
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		printPath = convertedAbs
-		printCleanup = cleanup
-		printMime = "application/pdf"
-	case fileKindImage:
-		outPath, cleanup, err := convertImageToPDF(storedAbs)
-		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "conversion failed")
-			return
+		printAt = t
+	}
+
+	// 多文件打印：各文件分别保存，由打印队列转换后按顺序合并为一个 PDF
+	var files []printFile
+	var saved []string
+	removeSaved := func() {
+		for _, abs := range saved {
+			_ = os.Remove(abs)
 		}
-		_, convertedAbs, err := saveConvertedPDFToUploads(outPath, storedRel, uploadDir)
+	}
+	for _, fh := range fhs {
+		rel, abs, err := saveMultipartFile(fh, uploadDir)
 		if err != nil {
-			cleanup()
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusInternalServerError, "failed to save converted file")
+			removeSaved()
+			writeJSONError(w, http.StatusInternalServerError, "failed to save file")
 			return
 		}
-		printPath = convertedAbs
-		printCleanup = cleanup
-		printMime = "application/pdf"
-		pages = 1
-	case fileKindText:
-		var err error
-		pages, err = estimateTextPages(storedAbs)
-		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "failed to read pages")
+		saved = append(saved, abs)
+		if err := decryptUploadedPDF(r.Context(), abs, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+			removeSaved()
+			if !writePDFPasswordError(w, err) {
+				writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			}
 			return
 		}
-		outPath, cleanup, err := convertTextToPDF(storedAbs)
-		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "conversion failed")
+		files = append(files, printFile{Filename: fh.Filename, StoredRel: rel, Mime: fh.Header.Get("Content-Type")})
+		if album != nil && detectFileKind(abs, fh.Filename) != fileKindImage {
+			removeSaved()
+			writeJSONError(w, http.StatusBadRequest, "album accepts images only: "+fh.Filename)
 			return
 		}
-		_, convertedAbs, err := saveConvertedPDFToUploads(outPath, storedRel, uploadDir)
+	}
+	// 相册默认每页 2x2
+	if album != nil && r.FormValue("imageGrid") == "" {
+		opts.Convert.Image.Cols, opts.Convert.Image.Rows = 2, 2
+	}
+	sub := printSubmission{
+		UserID:    sess.UserID,
+		Printer:   opts.Printer,
+		Filename:  files[0].Filename,
+		StoredRel: files[0].StoredRel,
+		Sides:     opts.Sides,
+		IsColor:   opts.IsColor,
+		Copies:    opts.Copies,
+		PageRange: opts.PageRange,
+		Options:   opts.jobOptions(files[0].Mime),
+
+		Hold:           hold,
+		ReleasePinHash: pinHash,
+		PrintAt:        printAt,
+	}
+	if len(files) > 1 || album != nil {
+		sub.Filename = mergedFilename(files)
+		sub.StoredRel, _, err = newUploadPath(sub.Filename, uploadDir)
 		if err != nil {
-			cleanup()
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusInternalServerError, "failed to save converted file")
+			removeSaved()
+			writeJSONError(w, http.StatusInternalServerError, "failed to save file")
 			return
 		}
-		printPath = convertedAbs
-		printCleanup = cleanup
-		printMime = "application/pdf"
-	default:
-		var err error
-		pages, _, err = countPages(countCtx, storedAbs, fh.Filename)
-		if err != nil {
-			_ = os.Remove(storedAbs)
-			writeJSONError(w, http.StatusBadRequest, "failed to read pages")
-			return
+		sub.Options = opts.jobOptions("application/pdf")
+		sub.Options.Album = album
+		sub.Files = files
+	}
+
+	rec, err := submitPrintJob(r.Context(), sub)
+	if err != nil {
+		removeSaved()
+		writeJSONError(w, http.StatusInternalServerError, "failed to create print record")
+		return
+	}
+
+	writeJSONStatus(w, http.StatusAccepted, mapPrintResp(rec))
+}
+
+// maxPrintFiles bounds how many files one multi-file submission may merge.
+const maxPrintFiles = 20
+
+// orderedUploads returns the "file" fields of the form, at most limit of them.
+// An optional "order" field lists zero-based field indexes, comma-separated,
+// to merge the files in a different order than they were uploaded.
+func orderedUploads(r *http.Request, limit int) ([]*multipart.FileHeader, error) {
+	fhs := r.MultipartForm.File["file"]
+	if len(fhs) == 0 {
+		return nil, errors.New("missing file field")
+	}
+	if len(fhs) > limit {
+		return nil, fmt.Errorf("at most %d files per job", limit)
+	}
+	order := strings.TrimSpace(r.FormValue("order"))
+	if order == "" {
+		return fhs, nil
+	}
+	parts := strings.Split(order, ",")
+	if len(parts) != len(fhs) {
+		return nil, errors.New("order must list every file once")
+	}
+	seen := make([]bool, len(fhs))
+	out := make([]*multipart.FileHeader, 0, len(fhs))
+	for _, p := range parts {
+		i, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || i < 0 || i >= len(fhs) || seen[i] {
+			return nil, errors.New("order must list every file once")
 		}
+		seen[i] = true
+		out = append(out, fhs[i])
 	}
-	if pages < 1 {
-		pages = 1
+	return out, nil
+}
+
+func saveMultipartFile(fh *multipart.FileHeader, baseDir string) (string, string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", "", err
 	}
-	if printCleanup != nil {
-		defer printCleanup()
+	defer f.Close()
+	return saveUploadedFile(f, fh.Filename, baseDir)
+}
+
+// mergedFilename names a multi-file job, or a one-photo album, after its
+// first file.
+func mergedFilename(files []printFile) string {
+	first := files[0].Filename
+	base := strings.TrimSuffix(first, filepath.Ext(first))
+	if len(files) == 1 {
+		return base + ".pdf"
 	}
+	return fmt.Sprintf("%s (+%d).pdf", base, len(files)-1)
+}
 
-	sess, _ := auth.GetSession(r)
-	var recordID int64
-	var balanceAfter int64
-	var monthSpent int64
-	var yearSpent int64
-	var costCents int64
+// printOptions are the form fields shared by every endpoint that accepts a
+// document for printing.
+type printOptions struct {
+	Printer      string
+	Sides        string
+	IsColor      bool
+	Copies       int
+	PageRange    string
+	Media        string
+	NumberUp     int
+	PrintQuality string
+	Layout       layoutOptions
+	Convert      convertOptions
+}
 
-	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
-		user, err := store.GetUserByID(r.Context(), tx, sess.UserID)
-		if err != nil {
-			return err
-		}
-		if err := normalizeUserPeriods(r.Context(), tx, &user, time.Now()); err != nil {
-			return err
+var errPresetNotFound = errors.New("preset not found")
+
+// parsePrintOptions reads the print form fields. Fields the request omits are
+// filled from the preset named by presetId, or the user's default preset.
+func parsePrintOptions(r *http.Request, userID int64) (printOptions, error) {
+	preset, err := lookupPrintPreset(r, userID)
+	if err != nil {
+		return printOptions{}, err
+	}
+
+	printer := r.FormValue("printer")
+	if printer == "" {
+		printer = preset.PrinterURI
+	}
+	if printer == "" {
+		return printOptions{}, errors.New("missing printer field")
+	}
+
+	sides := r.FormValue("sides")
+	duplexParam := r.FormValue("duplex")
+	if sides == "" && duplexParam == "" {
+		sides = preset.Sides
+	}
+	if sides == "" {
+		if duplexParam == "true" {
+			sides = "two-sided-long-edge"
+		} else {
+			sides = "one-sided"
 		}
-		costCents = 0
-		before := user.BalanceCents
-		balanceAfter = before
-		monthSpent = user.MonthSpentCents
-		yearSpent = user.YearSpentCents
+	}
+	isColor := preset.IsColor
+	if _, ok := r.Form["color"]; ok {
+		isColor = r.FormValue("color") == "true"
+	}
 
-		rec := store.PrintRecord{
-			UserID:             user.ID,
-			PrinterURI:         printer,
-			Filename:           fh.Filename,
-			StoredPath:         storedRel,
-			Pages:              pages,
-			CostCents:          costCents,
-			BalanceBeforeCents: before,
-			BalanceAfterCents:  balanceAfter,
-			MonthTotalCents:    monthSpent,
-			YearTotalCents:     yearSpent,
-			Status:             "queued",
-			IsDuplex:           isDuplex,
-			IsColor:            isColor,
-			Duplex:             sql.NullString{String: getDuplexDisplayText(sides), Valid: getDuplexDisplayText(sides) != ""},
-			Sides:              sql.NullString{String: sides, Valid: sides != ""},
-			Copies:             copies,
-			PageRange:          sql.NullString{String: pageRange, Valid: pageRange != ""},
-			CreatedAt:          time.Now().UTC().Format(time.RFC3339),
+	// 获取打印份数，默认为1
+	copies := 1
+	if preset.Copies > 0 {
+		copies = preset.Copies
+	}
+	if copiesStr := r.FormValue("copies"); copiesStr != "" {
+		if c, err := strconv.Atoi(copiesStr); err == nil && c > 0 && c <= 100 {
+			copies = c
 		}
-		id, err := store.InsertPrintRecord(r.Context(), tx, &rec)
+	}
+
+	// 获取页面范围，默认为全部页面
+	pageRange := r.FormValue("pageRange")
+
+	media := r.FormValue("media")
+	if media == "" {
+		media = preset.Media
+	}
+	numberUp := preset.NumberUp
+	if v := r.FormValue("numberUp"); v != "" {
+		numberUp, err = strconv.Atoi(v)
 		if err != nil {
-			return err
+			return printOptions{}, errors.New("invalid numberUp")
 		}
-		recordID = id
-		return nil
-	})
+	}
+	quality := r.FormValue("printQuality")
+	if quality == "" {
+		quality = preset.PrintQuality
+	}
+	layout, err := parseLayoutOptions(r)
 	if err != nil {
-		_ = os.Remove(storedAbs)
-		writeJSONError(w, http.StatusInternalServerError, "failed to create print record")
-		return
+		return printOptions{}, err
 	}
-
-	f, err := os.Open(printPath)
+	conv, err := parseConvertOptions(r)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "failed to open file")
-		return
+		return printOptions{}, err
 	}
-	defer f.Close()
-
-	mime := printMime
-	if mime == "" {
-		mime = fh.Header.Get("Content-Type")
-	}
-	if mime == "" {
-		buf := make([]byte, 512)
-		if n, _ := f.Read(buf); n > 0 {
-			mime = http.DetectContentType(buf[:n])
-			if _, err := f.Seek(0, io.SeekStart); err != nil {
-				_ = refundPrint(r.Context(), recordID, sess.UserID, costCents)
-				writeJSONError(w, http.StatusInternalServerError, "failed to read file")
-				return
-			}
+	if !layout.isZero() && pageRange != "" {
+		return printOptions{}, errors.New("pageRange cannot be combined with layout or scaling")
+	}
+	// the printer's number-up would impose the imposed sheets again
+	if layout.Layout != "" && numberUp > 1 {
+		if r.FormValue("numberUp") != "" {
+			return printOptions{}, errors.New("numberUp cannot be combined with layout")
 		}
+		numberUp = 0
 	}
-
-	job, err := ipp.SendPrintJob(printer, f, mime, sess.Username, fh.Filename, sides, isColor, copies, pageRange)
-	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "print error: "+err.Error())
-		return
+	// 小册子需要短边翻转的双面打印
+	if layout.Layout == layoutBooklet && r.FormValue("sides") == "" {
+		sides = "two-sided-short-edge"
+	}
+	opts := printOptions{
+		Printer:      printer,
+		Sides:        sides,
+		IsColor:      isColor,
+		Copies:       copies,
+		PageRange:    pageRange,
+		Media:        media,
+		NumberUp:     numberUp,
+		PrintQuality: quality,
+		Layout:       layout,
+		Convert:      conv,
 	}
+	if err := validateJobOptions(opts.Media, opts.NumberUp, opts.PrintQuality); err != nil {
+		return printOptions{}, err
+	}
+	return opts, nil
+}
 
-	_ = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
-		return store.UpdatePrintStatus(r.Context(), tx, recordID, "printed", job)
+// lookupPrintPreset returns the requested preset, the user's default preset,
+// or an empty preset when neither exists.
+func lookupPrintPreset(r *http.Request, userID int64) (store.PrintPreset, error) {
+	var preset store.PrintPreset
+	presetID := r.FormValue("presetId")
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		if presetID == "" {
+			p, err := store.GetDefaultPrintPreset(r.Context(), tx, userID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			preset = p
+			return err
+		}
+		id, err := strconv.ParseInt(presetID, 10, 64)
+		if err != nil {
+			return errPresetNotFound
+		}
+		p, err := store.GetPrintPreset(r.Context(), tx, id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && p.UserID != userID) {
+			return errPresetNotFound
+		}
+		preset = p
+		return err
 	})
+	return preset, err
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(printResp{
-		JobID:           job,
+// jobOptions converts the parsed options into what the queue item stores.
+func (o printOptions) jobOptions(mime string) printJobOptions {
+	opts := printJobOptions{
+		Mime:         mime,
+		Media:        o.Media,
+		NumberUp:     o.NumberUp,
+		PrintQuality: o.PrintQuality,
+	}
+	if !o.Layout.isZero() {
+		layout := o.Layout
+		opts.Layout = &layout
+	}
+	if !o.Convert.Text.isZero() {
+		text := o.Convert.Text
+		opts.Text = &text
+	}
+	if !o.Convert.Image.isZero() {
+		img := o.Convert.Image
+		opts.Image = &img
+	}
+	return opts
+}
+
+func mapPrintResp(rec store.PrintRecord) printResp {
+	jobID := ""
+	if rec.JobID.Valid {
+		jobID = rec.JobID.String
+	}
+	return printResp{
+		RecordID:        rec.ID,
+		Status:          rec.Status,
+		JobID:           jobID,
 		OK:              true,
-		Pages:           pages,
-		CostCents:       costCents,
-		BalanceCents:    balanceAfter,
-		MonthSpentCents: monthSpent,
-		YearSpentCents:  yearSpent,
-		IsDuplex:        isDuplex,
-		IsColor:         isColor,
-	})
+		Pages:           rec.Pages,
+		CostCents:       rec.CostCents,
+		BalanceCents:    rec.BalanceAfterCents,
+		MonthSpentCents: rec.MonthTotalCents,
+		YearSpentCents:  rec.YearTotalCents,
+		IsDuplex:        rec.IsDuplex,
+		IsColor:         rec.IsColor,
+	}
+}
+
+func isDuplexSides(sides string) bool {
+	return strings.HasPrefix(sides, "two-sided")
 }
 
 func getDuplexDisplayText(sides string) string {
@@ -303,4 +441,3 @@ func getDuplexDisplayText(sides string) string {
 		return "单面打印" // default
 	}
 }
-
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"cups-web/internal/ipp"
+	"cups-web/internal/store"
+)
+
+const defaultPrintWorkers = 2
+const queueIdleInterval = 5 * time.Second
+
+const (
+	printRetryBaseBackoff = 30 * time.Second
+	printRetryMaxBackoff  = 5 * time.Minute
+)
+
+// printJobOptions carries submission details that are not columns on the
+// print record. It is stored as JSON on the queue item.
+type printJobOptions struct {
+	Mime         string `json:"mime,omitempty"`
+	Media        string `json:"media,omitempty"`
+	NumberUp     int    `json:"numberUp,omitempty"`
+	PrintQuality string `json:"printQuality,omitempty"`
+	// Layout is the server-side imposition applied after conversion.
+	Layout *layoutOptions `json:"layout,omitempty"`
+	// Text is the layout of plain text uploads.
+	Text *textLayout `json:"text,omitempty"`
+	// Image is the page layout of image uploads.
+	Image *imageLayout `json:"image,omitempty"`
+	// Album lays the parts of the job out as a photo album instead of
+	// merging them.
+	Album *albumOptions `json:"album,omitempty"`
+}
+
+func (o printJobOptions) convertOptions() convertOptions {
+	var conv convertOptions
+	if o.Text != nil {
+		conv.Text = *o.Text
+	}
+	if o.Image != nil {
+		conv.Image = *o.Image
+	}
+	return conv
+}
+
+type printSubmission struct {
+	UserID    int64
+	Printer   string
+	Filename  string
+	StoredRel string
+	Sides     string
+	IsColor   bool
+	Copies    int
+	PageRange string
+	Options   printJobOptions
+	// Hold keeps the job out of the queue until it is released with the PIN
+	// whose bcrypt hash is ReleasePinHash.
+	Hold           bool
+	ReleasePinHash string
+	// PrintAt delays the job until the given time when set.
+	PrintAt time.Time
+	// ReprintOf links the record to the one whose stored file it reuses.
+	ReprintOf int64
+	// Files lists the parts of a multi-file job. The worker converts them and
+	// merges them, in order, into StoredRel, which does not exist yet.
+	Files []printFile
+}
+
+type printFile struct {
+	Filename  string
+	StoredRel string
+	Mime      string
+}
+
+var queueWake = make(chan struct{}, 1)
+
+func wakePrintWorkers() {
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// submitPrintJob creates the print record and its queue item in one
+// transaction and wakes the workers. The file at sub.StoredRel must already
+// be stored under uploadDir.
+func submitPrintJob(ctx context.Context, sub printSubmission) (store.PrintRecord, error) {
+	opts, err := json.Marshal(sub.Options)
+	if err != nil {
+		return store.PrintRecord{}, err
+	}
+	var rec store.PrintRecord
+	err = appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(ctx, tx, sub.UserID)
+		if err != nil {
+			return err
+		}
+		if err := normalizeUserPeriods(ctx, tx, &user, time.Now()); err != nil {
+			return err
+		}
+		duplex := getDuplexDisplayText(sub.Sides)
+		status := store.PrintStatusQueued
+		queueState := store.QueuePending
+		var holdExpires sql.NullString
+		var printAt sql.NullString
+		runAfter := ""
+		if !sub.PrintAt.IsZero() {
+			status = store.PrintStatusScheduled
+			runAfter = sub.PrintAt.UTC().Format(time.RFC3339)
+			printAt = sql.NullString{String: runAfter, Valid: true}
+		}
+		if sub.Hold {
+			hours, err := store.GetSettingInt(ctx, tx, store.SettingHoldExpiryHours, store.DefaultHoldExpiryHours)
+			if err != nil {
+				return err
+			}
+			status = store.PrintStatusHeld
+			queueState = store.QueueHeld
+			if hours > 0 {
+				holdExpires = sql.NullString{String: time.Now().Add(time.Duration(hours) * time.Hour).UTC().Format(time.RFC3339), Valid: true}
+			}
+		}
+		rec = store.PrintRecord{
+			UserID:             user.ID,
+			Username:           user.Username,
+			PrinterURI:         sub.Printer,
+			Filename:           sub.Filename,
+			StoredPath:         sub.StoredRel,
+			Pages:              0,
+			CostCents:          0,
+			BalanceBeforeCents: user.BalanceCents,
+			BalanceAfterCents:  user.BalanceCents,
+			MonthTotalCents:    user.MonthSpentCents,
+			YearTotalCents:     user.YearSpentCents,
+			Status:             status,
+			IsDuplex:           isDuplexSides(sub.Sides),
+			IsColor:            sub.IsColor,
+			Duplex:             sql.NullString{String: duplex, Valid: duplex != ""},
+			Sides:              sql.NullString{String: sub.Sides, Valid: sub.Sides != ""},
+			Copies:             sub.Copies,
+			PageRange:          sql.NullString{String: sub.PageRange, Valid: sub.PageRange != ""},
+			HoldExpiresAt:      holdExpires,
+			PrintAt:            printAt,
+			ReprintOf:          sql.NullInt64{Int64: sub.ReprintOf, Valid: sub.ReprintOf > 0},
+			CreatedAt:          time.Now().UTC().Format(time.RFC3339),
+		}
+		id, err := store.InsertPrintRecord(ctx, tx, &rec)
+		if err != nil {
+			return err
+		}
+		rec.ID = id
+		for i, f := range sub.Files {
+			_, err := store.InsertPrintJobFile(ctx, tx, store.PrintJobFile{
+				PrintJobID: id,
+				Position:   i,
+				Filename:   f.Filename,
+				StoredPath: f.StoredRel,
+				Mime:       f.Mime,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if sub.Hold {
+			if err := store.SetReleasePinHash(ctx, tx, id, sub.ReleasePinHash); err != nil {
+				return err
+			}
+		}
+		if _, err := store.EnqueuePrintJob(ctx, tx, id, queueState, string(opts), runAfter); err != nil {
+			return err
+		}
+		return enqueuePrintEvent(ctx, tx, eventJobCreated, id)
+	})
+	if err != nil {
+		return store.PrintRecord{}, err
+	}
+	wakePrintWorkers()
+	go notifyUserThresholds(context.Background(), sub.UserID)
+	publishPrintRecord(ctx, rec.ID)
+	publishBalance(ctx, sub.UserID)
+	return rec, nil
+}
+
+func startPrintWorkers(s *store.Store) {
+	n := defaultPrintWorkers
+	if v, err := strconv.Atoi(os.Getenv("PRINT_WORKERS")); err == nil && v > 0 {
+		n = v
+	}
+	ctx := context.Background()
+	var sent []store.QueueItem
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		reset, err := store.ResetRunningPrintJobs(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if reset > 0 {
+			log.Printf("requeued %d interrupted print jobs", reset)
+		}
+		sent, err = store.ListSentRunningPrintJobs(ctx, tx)
+		return err
+	})
+	if err != nil {
+		log.Println("requeue interrupted print jobs failed:", err)
+	}
+	// sending these again could print them twice
+	for _, item := range sent {
+		failInterruptedPrintJob(ctx, s, item)
+	}
+	for i := 0; i < n; i++ {
+		go printWorker(s)
+	}
+	wakePrintWorkers()
+}
+
+// failInterruptedPrintJob fails and refunds a job that a previous process
+// was sending to the printer when it stopped.
+func failInterruptedPrintJob(ctx context.Context, s *store.Store, item store.QueueItem) {
+	var rec store.PrintRecord
+	err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+		found, err := store.GetPrintRecordByID(ctx, tx, item.RecordID)
+		rec = found
+		return err
+	})
+	if err != nil {
+		log.Printf("print job %d: load record failed: %v", item.RecordID, err)
+		return
+	}
+	failPrintJob(ctx, s, item, rec, item.Attempts+1, errors.New("interrupted while sending to the printer, not sent again"))
+}
+
+func printWorker(s *store.Store) {
+	for {
+		item, err := claimPrintJob(s)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Println("claim print job failed:", err)
+			}
+			select {
+			case <-queueWake:
+			case <-time.After(queueIdleInterval):
+			}
+			continue
+		}
+		// let another idle worker look for more work
+		wakePrintWorkers()
+		processPrintJob(context.Background(), s, item)
+	}
+}
+
+func claimPrintJob(s *store.Store) (store.QueueItem, error) {
+	var item store.QueueItem
+	ctx := context.Background()
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		claimed, err := store.ClaimNextPrintJob(ctx, tx, nowRFC3339())
+		if err != nil {
+			return err
+		}
+		item = claimed
+		return store.UpdatePrintStatus(ctx, tx, item.RecordID, store.PrintStatusProcessing, "")
+	})
+	return item, err
+}
+
+func processPrintJob(ctx context.Context, s *store.Store, item store.QueueItem) {
+	var rec store.PrintRecord
+	err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+		found, err := store.GetPrintRecordByID(ctx, tx, item.RecordID)
+		if err != nil {
+			return err
+		}
+		rec = found
+		return nil
+	})
+	if err != nil {
+		log.Printf("print job %d: load record failed: %v", item.RecordID, err)
+		_ = s.WithTx(ctx, false, func(tx *sql.Tx) error {
+			return store.FinishQueueItem(ctx, tx, item.ID, store.QueueFailed, err.Error())
+		})
+		return
+	}
+	publishPrintRecord(ctx, rec.ID)
+
+	attempts := item.Attempts + 1
+	var opts printJobOptions
+	if item.Options != "" {
+		if err := json.Unmarshal([]byte(item.Options), &opts); err != nil {
+			failPrintJob(ctx, s, item, rec, attempts, fmt.Errorf("invalid job options: %w", err))
+			return
+		}
+	}
+
+	jobID, err := runPrintJob(ctx, item, rec, opts)
+	if err != nil {
+		if ipp.IsTransient(err) && retryPrintJob(ctx, s, item, rec, attempts, err) {
+			return
+		}
+		failPrintJob(ctx, s, item, rec, attempts, err)
+		return
+	}
+
+	err = s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		if err := store.UpdatePrintStatus(ctx, tx, rec.ID, store.PrintStatusPrinted, jobID); err != nil {
+			return err
+		}
+		if err := store.UpdatePrintAttempt(ctx, tx, rec.ID, attempts, ""); err != nil {
+			return err
+		}
+		if err := store.FinishQueueItem(ctx, tx, item.ID, store.QueueDone, ""); err != nil {
+			return err
+		}
+		return enqueuePrintEvent(ctx, tx, eventJobCompleted, rec.ID)
+	})
+	if err != nil {
+		log.Printf("print job %d: update status failed: %v", rec.ID, err)
+	}
+	publishPrintRecord(ctx, rec.ID)
+}
+
+// retryPrintJob puts the job back in the queue after a transient failure. It
+// returns false once the retry period configured by print_retry_minutes,
+// counted from the first failure, would be exceeded.
+func retryPrintJob(ctx context.Context, s *store.Store, item store.QueueItem, rec store.PrintRecord, attempts int, cause error) bool {
+	now := time.Now().UTC()
+	next := now.Add(printRetryBackoff(attempts))
+	retried := false
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		retryUntil := item.RetryUntil
+		if retryUntil == "" {
+			minutes, err := store.GetSettingInt(ctx, tx, store.SettingPrintRetryMinutes, store.DefaultPrintRetryMinutes)
+			if err != nil {
+				return err
+			}
+			retryUntil = now.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)
+		}
+		until, err := time.Parse(time.RFC3339, retryUntil)
+		if err != nil || next.After(until) {
+			return nil
+		}
+		if err := store.RetryQueueItem(ctx, tx, item.ID, attempts, next.Format(time.RFC3339), retryUntil, cause.Error()); err != nil {
+			return err
+		}
+		if err := store.UpdatePrintStatus(ctx, tx, rec.ID, store.PrintStatusQueued, ""); err != nil {
+			return err
+		}
+		retried = true
+		return store.UpdatePrintAttempt(ctx, tx, rec.ID, attempts, cause.Error())
+	})
+	if err != nil {
+		log.Printf("print job %d: schedule retry failed: %v", rec.ID, err)
+		return false
+	}
+	if retried {
+		log.Printf("print job %d attempt %d failed, retrying at %s: %v", rec.ID, attempts, next.Format(time.RFC3339), cause)
+		publishPrintRecord(ctx, rec.ID)
+	}
+	return retried
+}
+
+func printRetryBackoff(attempts int) time.Duration {
+	d := printRetryBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= printRetryMaxBackoff {
+			return printRetryMaxBackoff
+		}
+	}
+	return d
+}
+
+func failPrintJob(ctx context.Context, s *store.Store, item store.QueueItem, rec store.PrintRecord, attempts int, cause error) {
+	log.Printf("print job %d failed: %v", rec.ID, cause)
+	err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+		if err := store.FinishQueueItem(ctx, tx, item.ID, store.QueueFailed, cause.Error()); err != nil {
+			return err
+		}
+		if err := store.UpdatePrintAttempt(ctx, tx, rec.ID, attempts, cause.Error()); err != nil {
+			return err
+		}
+		return refundPrintTx(ctx, tx, rec.ID, rec.UserID, rec.CostCents, store.PrintStatusFailed)
+	})
+	if err != nil {
+		log.Printf("print job %d: refund failed: %v", rec.ID, err)
+		return
+	}
+	publishRefund(ctx, rec.ID, rec.UserID)
+}
+
+// runPrintJob converts the stored upload to a printable document, records the
+// page count and sends it to the printer. It returns the IPP job identifier.
+func runPrintJob(ctx context.Context, item store.QueueItem, rec store.PrintRecord, opts printJobOptions) (string, error) {
+	storedAbs := filepath.Join(uploadDir, filepath.FromSlash(rec.StoredPath))
+	var parts []store.PrintJobFile
+	err := appStore.WithTx(ctx, true, func(tx *sql.Tx) error {
+		files, err := store.ListPrintJobFiles(ctx, tx, rec.ID)
+		parts = files
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	convertCtx, cancel := convertTimeoutContext(withConvertOwner(ctx, rec.UserID))
+	defer cancel()
+	var doc printDocument
+	if len(parts) > 0 && opts.Album != nil {
+		doc, err = prepareAlbumDocument(convertCtx, storedAbs, parts, opts.convertOptions().Image, *opts.Album)
+	} else if len(parts) > 0 {
+		doc, err = prepareMergedDocument(convertCtx, storedAbs, parts, opts.convertOptions())
+	} else {
+		doc, err = preparePrintDocument(convertCtx, rec.StoredPath, storedAbs, rec.Filename, opts.convertOptions())
+	}
+	if err != nil {
+		return "", err
+	}
+	defer doc.cleanup()
+
+	if opts.Layout != nil && !opts.Layout.isZero() {
+		if doc.mime != "application/pdf" {
+			return "", errors.New("layout requires a document that can be converted to PDF")
+		}
+		imposed, pages, cleanup, err := imposePDF(doc.path, *opts.Layout, opts.Media)
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		doc.path = imposed
+		doc.pages = pages
+	}
+
+	var stamps []store.StampTemplate
+	err = appStore.WithTx(ctx, true, func(tx *sql.Tx) error {
+		list, err := store.ListStampTemplatesForPrinter(ctx, tx, rec.PrinterURI)
+		stamps = list
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(stamps) > 0 {
+		if doc.mime != "application/pdf" {
+			return "", errors.New("stamping requires a document that can be converted to PDF")
+		}
+		stamped, cleanup, err := stampPDF(doc.path, stamps, stampVars(rec, time.Now()))
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		doc.path = stamped
+	}
+
+	if doc.pages != rec.Pages {
+		err := appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+			return store.UpdatePrintPages(ctx, tx, rec.ID, doc.pages)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.Open(doc.path)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	mime := doc.mime
+	if mime == "" {
+		mime = opts.Mime
+	}
+	if mime == "" {
+		buf := make([]byte, 512)
+		if n, _ := f.Read(buf); n > 0 {
+			mime = http.DetectContentType(buf[:n])
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("read file: %w", err)
+		}
+	}
+
+	sides := ""
+	if rec.Sides.Valid {
+		sides = rec.Sides.String
+	}
+	pageRange := ""
+	if rec.PageRange.Valid {
+		pageRange = rec.PageRange.String
+	}
+	err = appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+		return store.MarkQueueItemSent(ctx, tx, item.ID)
+	})
+	if err != nil {
+		return "", err
+	}
+	job, err := ipp.SendPrintJob(ctx, rec.PrinterURI, f, mime, rec.Username, rec.Filename, sides, rec.IsColor, rec.Copies, pageRange, ipp.JobOptions{
+		Media:        opts.Media,
+		NumberUp:     opts.NumberUp,
+		PrintQuality: opts.PrintQuality,
+	})
+	if err != nil {
+		return "", fmt.Errorf("print error: %w", err)
+	}
+	return job, nil
+}
+
+type printDocument struct {
+	path    string
+	mime    string
+	pages   int
+	cleanup func()
+}
+
+// preparePrintDocument converts the stored upload to PDF when needed, keeping
+// a copy of the converted file next to the upload, and counts its pages.
+func preparePrintDocument(ctx context.Context, storedRel string, storedAbs string, filename string, conv convertOptions) (printDocument, error) {
+	doc := printDocument{path: storedAbs, cleanup: func() {}}
+	kind := detectFileKind(storedAbs, filename)
+	// a previous attempt already converted this upload, or it is a copy of a
+	// template converted ahead of time; the PDF is only reused when the job's
+	// options cannot change the result
+	if needsConversion(kind, filename) && (conv.isZero() || !usesConvertOptions(kind, filename)) {
+		convertedAbs := filepath.Join(uploadDir, filepath.FromSlash(convertedRelPath(storedRel)))
+		if pages, err := countPDFPages(convertedAbs); err == nil {
+			doc.path = convertedAbs
+			doc.mime = "application/pdf"
+			doc.pages = pages
+			return doc, nil
+		}
+	}
+	var outPath string
+	var cleanup func()
+	var err error
+	switch {
+	case kind == fileKindPDF:
+		doc.pages, err = countPDFPages(storedAbs)
+		if err != nil {
+			if encrypted, _ := isEncryptedPDF(storedAbs); encrypted {
+				return doc, errPDFPasswordRequired
+			}
+			return doc, fmt.Errorf("failed to read pages: %w", err)
+		}
+		doc.mime = "application/pdf"
+		return doc, nil
+	case needsConversion(kind, filename):
+		outPath, cleanup, err = convertDocument(ctx, storedAbs, filename, kind, conv)
+	default:
+		doc.pages, _, err = countPages(ctx, storedAbs, filename, conv)
+		if err != nil {
+			return doc, fmt.Errorf("failed to read pages: %w", err)
+		}
+		if doc.pages < 1 {
+			doc.pages = 1
+		}
+		return doc, nil
+	}
+	if err != nil {
+		return doc, fmt.Errorf("conversion failed: %w", err)
+	}
+	doc.cleanup = cleanup
+
+	doc.pages, err = countPDFPages(outPath)
+	if err != nil {
+		cleanup()
+		return doc, fmt.Errorf("failed to read pages: %w", err)
+	}
+	if doc.pages < 1 {
+		doc.pages = 1
+	}
+	_, convertedAbs, err := saveConvertedPDFToUploads(outPath, storedRel, uploadDir)
+	if err != nil {
+		cleanup()
+		return doc, fmt.Errorf("failed to save converted file: %w", err)
+	}
+	doc.path = convertedAbs
+	doc.mime = "application/pdf"
+	return doc, nil
+}
+
+// prepareMergedDocument converts every part of a multi-file job and merges
+// them into storedAbs, recording the page count of each part. The parts are
+// removed once merged, so a retry only has to count the merged pages.
+func prepareMergedDocument(ctx context.Context, storedAbs string, parts []store.PrintJobFile, conv convertOptions) (printDocument, error) {
+	doc := printDocument{path: storedAbs, mime: "application/pdf", cleanup: func() {}}
+	if pages, err := countPDFPages(storedAbs); err == nil {
+		doc.pages = pages
+		return doc, nil
+	}
+
+	paths := make([]string, 0, len(parts))
+	pages := make([]int, 0, len(parts))
+	for _, part := range parts {
+		partAbs := filepath.Join(uploadDir, filepath.FromSlash(part.StoredPath))
+		pd, err := preparePrintDocument(ctx, part.StoredPath, partAbs, part.Filename, conv)
+		if err != nil {
+			return doc, fmt.Errorf("%s: %w", part.Filename, err)
+		}
+		pd.cleanup()
+		if pd.mime != "application/pdf" {
+			return doc, fmt.Errorf("%s: unsupported file type for merging", part.Filename)
+		}
+		paths = append(paths, pd.path)
+		pages = append(pages, pd.pages)
+	}
+	if err := mergePDFs(paths, storedAbs); err != nil {
+		_ = os.Remove(storedAbs)
+		return doc, err
+	}
+	err := appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
+		for i, part := range parts {
+			if err := store.UpdatePrintJobFilePages(ctx, tx, part.ID, pages[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return doc, err
+	}
+	for _, part := range parts {
+		_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(part.StoredPath)))
+		_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(convertedRelPath(part.StoredPath))))
+	}
+	for _, n := range pages {
+		doc.pages += n
+	}
+	return doc, nil
+}
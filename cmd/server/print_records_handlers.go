@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"mime"
 	"net/http"
@@ -36,6 +37,11 @@ type printRecordResponse struct {
 	Sides              string `json:"sides"`
 	Copies             int    `json:"copies"`
 	PageRange          string `json:"pageRange"`
+	Attempts           int    `json:"attempts"`
+	LastError          string `json:"lastError"`
+	HoldExpiresAt      string `json:"holdExpiresAt"`
+	PrintAt            string `json:"printAt"`
+	ReprintOf          *int64 `json:"reprintOf"`
 	CreatedAt          string `json:"createdAt"`
 }
 
@@ -156,6 +162,162 @@ func printRecordFileHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, record.Filename, stat.ModTime(), f)
 }
 
+type printJobFileResponse struct {
+	Position int    `json:"position"`
+	Filename string `json:"filename"`
+	Pages    int    `json:"pages"`
+}
+
+// printRecordFilesHandler lists the parts of a multi-file job with their page
+// counts. Pages are 0 until the job has been converted and merged.
+func printRecordFilesHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var resp []printJobFileResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		rec, err := store.GetPrintRecordByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if sess.Role != store.RoleAdmin && rec.UserID != sess.UserID {
+			return sql.ErrNoRows
+		}
+		files, err := store.ListPrintJobFiles(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		resp = make([]printJobFileResponse, 0, len(files))
+		for _, f := range files {
+			resp = append(resp, printJobFileResponse{Position: f.Position, Filename: f.Filename, Pages: f.Pages})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "record not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to load files")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// reprintPayload overrides options of the original record; omitted fields
+// keep the original value.
+type reprintPayload struct {
+	Printer   *string `json:"printer"`
+	Copies    *int    `json:"copies"`
+	Sides     *string `json:"sides"`
+	PageRange *string `json:"pageRange"`
+	Color     *bool   `json:"color"`
+}
+
+// reprintHandler queues a new record for a previous upload. The stored file
+// (and any converted PDF next to it) is shared with the original record.
+func reprintHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var payload reprintPayload
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+
+	var orig store.PrintRecord
+	var opts printJobOptions
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		rec, err := store.GetPrintRecordByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		orig = rec
+		if item, err := store.GetQueueItemByRecordID(r.Context(), tx, id); err == nil && item.Options != "" {
+			_ = json.Unmarshal([]byte(item.Options), &opts)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "record not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to load record")
+		return
+	}
+	if orig.UserID != sess.UserID {
+		writeJSONError(w, http.StatusNotFound, "record not found")
+		return
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, filepath.FromSlash(orig.StoredPath))); err != nil {
+		writeJSONError(w, http.StatusGone, "original file no longer available")
+		return
+	}
+
+	sub := printSubmission{
+		UserID:    sess.UserID,
+		Printer:   orig.PrinterURI,
+		Filename:  orig.Filename,
+		StoredRel: orig.StoredPath,
+		Sides:     orig.Sides.String,
+		IsColor:   orig.IsColor,
+		Copies:    orig.Copies,
+		PageRange: orig.PageRange.String,
+		Options:   opts,
+		ReprintOf: orig.ID,
+	}
+	if payload.Printer != nil && *payload.Printer != "" {
+		sub.Printer = *payload.Printer
+	}
+	if payload.Copies != nil {
+		if *payload.Copies <= 0 || *payload.Copies > 100 {
+			writeJSONError(w, http.StatusBadRequest, "copies must be 1-100")
+			return
+		}
+		sub.Copies = *payload.Copies
+	}
+	if payload.Sides != nil && *payload.Sides != "" {
+		sub.Sides = *payload.Sides
+	}
+	if payload.PageRange != nil {
+		sub.PageRange = *payload.PageRange
+	}
+	if payload.Color != nil {
+		sub.IsColor = *payload.Color
+	}
+	if sub.Sides == "" {
+		sub.Sides = "one-sided"
+	}
+	if sub.Copies <= 0 {
+		sub.Copies = 1
+	}
+
+	rec, err := submitPrintJob(r.Context(), sub)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create print record")
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, mapPrintResp(rec))
+}
+
 func parseDateRange(r *http.Request) (string, string, error) {
 	start := r.URL.Query().Get("start")
 	end := r.URL.Query().Get("end")
@@ -201,6 +363,23 @@ func mapPrintRecords(records []store.PrintRecord) []printRecordResponse {
 		if rec.PageRange.Valid {
 			pageRange = rec.PageRange.String
 		}
+		lastError := ""
+		if rec.LastError.Valid {
+			lastError = rec.LastError.String
+		}
+		holdExpiresAt := ""
+		if rec.HoldExpiresAt.Valid {
+			holdExpiresAt = rec.HoldExpiresAt.String
+		}
+		printAt := ""
+		if rec.PrintAt.Valid {
+			printAt = rec.PrintAt.String
+		}
+		var reprintOf *int64
+		if rec.ReprintOf.Valid {
+			v := rec.ReprintOf.Int64
+			reprintOf = &v
+		}
 		resp = append(resp, printRecordResponse{
 			ID:                 rec.ID,
 			UserID:             rec.UserID,
@@ -221,6 +400,11 @@ func mapPrintRecords(records []store.PrintRecord) []printRecordResponse {
 			Sides:              sides,
 			Copies:             rec.Copies,
 			PageRange:          pageRange,
+			Attempts:           rec.Attempts,
+			LastError:          lastError,
+			HoldExpiresAt:      holdExpiresAt,
+			PrintAt:            printAt,
+			ReprintOf:          reprintOf,
 			CreatedAt:          rec.CreatedAt,
 		})
 	}
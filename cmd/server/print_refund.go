@@ -8,31 +8,48 @@ import (
 	"cups-web/internal/store"
 )
 
-func refundPrint(ctx context.Context, recordID int64, userID int64, costCents int64) error {
-	return appStore.WithTx(ctx, false, func(tx *sql.Tx) error {
-		user, err := store.GetUserByID(ctx, tx, userID)
-		if err != nil {
-			return err
-		}
-		balance := user.BalanceCents + costCents
-		monthSpent := user.MonthSpentCents
-		yearSpent := user.YearSpentCents
-		if monthSpent >= costCents {
-			monthSpent -= costCents
-		} else {
-			monthSpent = 0
-		}
-		if yearSpent >= costCents {
-			yearSpent -= costCents
-		} else {
-			yearSpent = 0
-		}
-		if _, err := tx.ExecContext(ctx, `UPDATE users SET
-			balance_cents = ?, month_spent_cents = ?, year_spent_cents = ?, updated_at = ?
-			WHERE id = ?`, balance, monthSpent, yearSpent, time.Now().UTC().Format(time.RFC3339), user.ID,
-		); err != nil {
-			return err
-		}
-		return store.UpdatePrintStatus(ctx, tx, recordID, "failed", "")
-	})
+// refundPrintTx returns costCents to the user and moves the record to the
+// given terminal status, inside the caller's transaction so the job is closed
+// in the same step. The caller publishes the change with publishRefund once
+// the transaction has committed.
+func refundPrintTx(ctx context.Context, tx *sql.Tx, recordID int64, userID int64, costCents int64, status string) error {
+	user, err := store.GetUserByID(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	balance := user.BalanceCents + costCents
+	monthSpent := user.MonthSpentCents
+	yearSpent := user.YearSpentCents
+	if monthSpent >= costCents {
+		monthSpent -= costCents
+	} else {
+		monthSpent = 0
+	}
+	if yearSpent >= costCents {
+		yearSpent -= costCents
+	} else {
+		yearSpent = 0
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET
+		balance_cents = ?, month_spent_cents = ?, year_spent_cents = ?, updated_at = ?
+		WHERE id = ?`, balance, monthSpent, yearSpent, time.Now().UTC().Format(time.RFC3339), user.ID,
+	); err != nil {
+		return err
+	}
+	if err := store.UpdatePrintStatus(ctx, tx, recordID, status, ""); err != nil {
+		return err
+	}
+	event := eventJobFailed
+	switch status {
+	case store.PrintStatusCanceled:
+		event = eventJobCanceled
+	case store.PrintStatusExpired:
+		event = eventJobExpired
+	}
+	return enqueuePrintEvent(ctx, tx, event, recordID)
+}
+
+func publishRefund(ctx context.Context, recordID int64, userID int64) {
+	publishPrintRecord(ctx, recordID)
+	publishBalance(ctx, userID)
 }
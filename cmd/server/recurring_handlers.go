@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/schedule"
+	"cups-web/internal/store"
+)
+
+// recurringDir keeps the source documents of recurring schedules apart from
+// per-job uploads so retention cleanup never removes them.
+const recurringDir = "recurring"
+
+const recurringRunsLimit = 100
+
+var errInvalidSchedule = errors.New("invalid schedule")
+
+// recurrenceSpec is the user-facing form of a schedule. daily, weekly and
+// monthly are shorthands that are stored as cron expressions.
+type recurrenceSpec struct {
+	Frequency string `json:"frequency"`
+	Time      string `json:"time"`
+	Weekday   int    `json:"weekday"`
+	Day       int    `json:"day"`
+	Cron      string `json:"cron"`
+}
+
+type recurringUpdatePayload struct {
+	recurrenceSpec
+	Name      string `json:"name"`
+	Printer   string `json:"printer"`
+	Sides     string `json:"sides"`
+	IsColor   bool   `json:"isColor"`
+	Copies    int    `json:"copies"`
+	PageRange string `json:"pageRange"`
+	// Enabled and Options are left unchanged when omitted. Options uses the
+	// field names of the print form, such as media, layout or fontSize.
+	Enabled *bool             `json:"enabled"`
+	Options map[string]string `json:"options"`
+}
+
+type recurringPrintResponse struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	PrinterURI string `json:"printerUri"`
+	Filename   string `json:"filename"`
+	Sides      string `json:"sides"`
+	IsColor    bool   `json:"isColor"`
+	Copies     int    `json:"copies"`
+	PageRange  string `json:"pageRange"`
+	Schedule   string `json:"schedule"`
+	Enabled    bool   `json:"enabled"`
+	NextRunAt  string `json:"nextRunAt"`
+	LastRunAt  string `json:"lastRunAt"`
+	CreatedAt  string `json:"createdAt"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+type recurringRunResponse struct {
+	ID       int64  `json:"id"`
+	RecordID *int64 `json:"recordId"`
+	Status   string `json:"status"`
+	Error    string `json:"error"`
+	RunAt    string `json:"runAt"`
+}
+
+func (s recurrenceSpec) cronExpr() (string, error) {
+	if s.Frequency == "cron" {
+		expr := strings.Join(strings.Fields(s.Cron), " ")
+		if _, err := schedule.Parse(expr); err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidSchedule, err)
+		}
+		return expr, nil
+	}
+	t, err := time.Parse("15:04", s.Time)
+	if err != nil {
+		return "", fmt.Errorf("%w: time must be HH:MM", errInvalidSchedule)
+	}
+	switch s.Frequency {
+	case "daily":
+		return fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()), nil
+	case "weekly":
+		if s.Weekday < 0 || s.Weekday > 6 {
+			return "", fmt.Errorf("%w: weekday must be 0-6", errInvalidSchedule)
+		}
+		return fmt.Sprintf("%d %d * * %d", t.Minute(), t.Hour(), s.Weekday), nil
+	case "monthly":
+		if s.Day < 1 || s.Day > 28 {
+			return "", fmt.Errorf("%w: day must be 1-28", errInvalidSchedule)
+		}
+		return fmt.Sprintf("%d %d %d * *", t.Minute(), t.Hour(), s.Day), nil
+	}
+	return "", fmt.Errorf("%w: frequency must be daily, weekly, monthly or cron", errInvalidSchedule)
+}
+
+// nextRecurringRun evaluates expr in the server's local time zone and returns
+// the next run after now as a UTC timestamp.
+func nextRecurringRun(expr string, now time.Time) (string, error) {
+	c, err := schedule.Parse(expr)
+	if err != nil {
+		return "", err
+	}
+	next, err := c.Next(now.In(time.Local))
+	if err != nil {
+		return "", err
+	}
+	return next.UTC().Format(time.RFC3339), nil
+}
+
+func recurringPrintsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp []recurringPrintResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		list, err := store.ListRecurringPrints(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		resp = make([]recurringPrintResponse, 0, len(list))
+		for _, rp := range list {
+			resp = append(resp, mapRecurringPrint(rp))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load recurring prints")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func createRecurringPrintHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	defer file.Close()
+
+	opts, err := parsePrintOptions(r, sess.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	spec := recurrenceSpec{
+		Frequency: r.FormValue("frequency"),
+		Time:      r.FormValue("time"),
+		Cron:      r.FormValue("cron"),
+	}
+	spec.Weekday, _ = strconv.Atoi(r.FormValue("weekday"))
+	spec.Day, _ = strconv.Atoi(r.FormValue("day"))
+	expr, err := spec.cronExpr()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	next, err := nextRecurringRun(expr, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = fh.Filename
+	}
+	jobOpts, err := json.Marshal(opts.jobOptions(fh.Header.Get("Content-Type")))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to encode options")
+		return
+	}
+
+	storedRel, storedAbs, err := saveUploadedFile(file, fh.Filename, filepath.Join(uploadDir, recurringDir))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	if err := decryptUploadedPDF(r.Context(), storedAbs, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+		_ = os.Remove(storedAbs)
+		if !writePDFPasswordError(w, err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+	var created store.RecurringPrint
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		rp, err := store.CreateRecurringPrint(r.Context(), tx, store.RecurringPrint{
+			UserID:     sess.UserID,
+			Name:       name,
+			PrinterURI: opts.Printer,
+			Filename:   fh.Filename,
+			StoredPath: recurringDir + "/" + storedRel,
+			Sides:      opts.Sides,
+			IsColor:    opts.IsColor,
+			Copies:     opts.Copies,
+			PageRange:  opts.PageRange,
+			Options:    string(jobOpts),
+			Schedule:   expr,
+			Enabled:    true,
+			NextRunAt:  next,
+		})
+		if err != nil {
+			return err
+		}
+		created = rp
+		return nil
+	})
+	if err != nil {
+		_ = os.Remove(storedAbs)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create recurring print")
+		return
+	}
+	writeJSON(w, mapRecurringPrint(created))
+}
+
+func updateRecurringPrintHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var payload recurringUpdatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" || payload.Printer == "" {
+		writeJSONError(w, http.StatusBadRequest, "name and printer required")
+		return
+	}
+	var opts *printOptions
+	if payload.Options != nil {
+		parsed, err := parseRecurringOptions(r, sess.UserID, payload)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		payload.Sides, payload.IsColor, payload.Copies, payload.PageRange = parsed.Sides, parsed.IsColor, parsed.Copies, parsed.PageRange
+		opts = &parsed
+	}
+	if payload.Copies <= 0 || payload.Copies > 100 {
+		payload.Copies = 1
+	}
+	if payload.Sides == "" {
+		payload.Sides = "one-sided"
+	}
+	expr, err := payload.cronExpr()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var updated store.RecurringPrint
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		current, err := store.GetRecurringPrint(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if current.UserID != sess.UserID {
+			return sql.ErrNoRows
+		}
+		enabled := current.Enabled
+		if payload.Enabled != nil {
+			enabled = *payload.Enabled
+		}
+		next := ""
+		if enabled {
+			next, err = nextRecurringRun(expr, time.Now())
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInvalidSchedule, err)
+			}
+		}
+		options := current.Options
+		if opts != nil {
+			var stored printJobOptions
+			if current.Options != "" {
+				_ = json.Unmarshal([]byte(current.Options), &stored)
+			}
+			b, err := json.Marshal(opts.jobOptions(stored.Mime))
+			if err != nil {
+				return err
+			}
+			options = string(b)
+		}
+		rp, err := store.UpdateRecurringPrint(r.Context(), tx, store.RecurringPrint{
+			ID:         id,
+			Name:       payload.Name,
+			PrinterURI: payload.Printer,
+			Sides:      payload.Sides,
+			IsColor:    payload.IsColor,
+			Copies:     payload.Copies,
+			PageRange:  payload.PageRange,
+			Options:    options,
+			Schedule:   expr,
+			Enabled:    enabled,
+			NextRunAt:  next,
+		})
+		if err != nil {
+			return err
+		}
+		updated = rp
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeJSONError(w, http.StatusNotFound, "recurring print not found")
+		case errors.Is(err, errInvalidSchedule):
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeJSONError(w, http.StatusInternalServerError, "failed to update recurring print")
+		}
+		return
+	}
+	writeJSON(w, mapRecurringPrint(updated))
+}
+
+// parseRecurringOptions validates the print options of an update the same
+// way as the print form, from the payload's fields and options.
+func parseRecurringOptions(r *http.Request, userID int64, payload recurringUpdatePayload) (printOptions, error) {
+	form := url.Values{}
+	for k, v := range payload.Options {
+		form.Set(k, v)
+	}
+	form.Set("printer", payload.Printer)
+	if payload.Sides != "" {
+		form.Set("sides", payload.Sides)
+	}
+	form.Set("color", strconv.FormatBool(payload.IsColor))
+	if payload.Copies > 0 {
+		form.Set("copies", strconv.Itoa(payload.Copies))
+	}
+	form.Set("pageRange", payload.PageRange)
+	fr := r.Clone(r.Context())
+	fr.Form = form
+	return parsePrintOptions(fr, userID)
+}
+
+func deleteRecurringPrintHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var storedPath string
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		rp, err := store.GetRecurringPrint(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if rp.UserID != sess.UserID {
+			return sql.ErrNoRows
+		}
+		storedPath = rp.StoredPath
+		return store.DeleteRecurringPrint(r.Context(), tx, id)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "recurring print not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to delete recurring print")
+		}
+		return
+	}
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(storedPath)))
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func recurringRunsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var resp []recurringRunResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		rp, err := store.GetRecurringPrint(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if rp.UserID != sess.UserID {
+			return sql.ErrNoRows
+		}
+		runs, err := store.ListRecurringRuns(r.Context(), tx, id, recurringRunsLimit)
+		if err != nil {
+			return err
+		}
+		resp = make([]recurringRunResponse, 0, len(runs))
+		for _, run := range runs {
+			var recordID *int64
+			if run.RecordID.Valid {
+				v := run.RecordID.Int64
+				recordID = &v
+			}
+			resp = append(resp, recurringRunResponse{
+				ID:       run.ID,
+				RecordID: recordID,
+				Status:   run.Status,
+				Error:    run.Error,
+				RunAt:    run.RunAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "recurring print not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to load runs")
+		}
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// runRecurringPrints submits every due schedule as a normal print job. The
+// next run time is advanced before submitting so a crash cannot print the
+// same run twice; runs missed while the server was down collapse into one.
+func runRecurringPrints(ctx context.Context, s *store.Store, now time.Time) error {
+	var due []store.RecurringPrint
+	err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+		list, err := store.ListDueRecurringPrints(ctx, tx, now.UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		due = list
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	runAt := now.UTC().Format(time.RFC3339)
+	for _, rp := range due {
+		next, err := nextRecurringRun(rp.Schedule, now)
+		if err != nil {
+			log.Printf("recurring print %d has no next run: %v", rp.ID, err)
+		}
+		err = s.WithTx(ctx, false, func(tx *sql.Tx) error {
+			return store.AdvanceRecurringPrint(ctx, tx, rp.ID, runAt, next)
+		})
+		if err != nil {
+			log.Printf("advance recurring print %d failed: %v", rp.ID, err)
+			continue
+		}
+
+		status := store.RecurringRunSubmitted
+		runErr := ""
+		rec, err := submitRecurringPrint(ctx, rp)
+		if err != nil {
+			log.Printf("recurring print %d failed: %v", rp.ID, err)
+			status = store.RecurringRunFailed
+			runErr = err.Error()
+		}
+		err = s.WithTx(ctx, false, func(tx *sql.Tx) error {
+			return store.InsertRecurringRun(ctx, tx, rp.ID, rec.ID, status, runErr, runAt)
+		})
+		if err != nil {
+			log.Printf("record recurring run %d failed: %v", rp.ID, err)
+		}
+	}
+	return nil
+}
+
+// submitRecurringPrint copies the schedule's document into a fresh upload so
+// each run owns its file like any other print record. Stored options that no
+// longer decode fail the run rather than printing with defaults.
+func submitRecurringPrint(ctx context.Context, rp store.RecurringPrint) (store.PrintRecord, error) {
+	var opts printJobOptions
+	if rp.Options != "" {
+		if err := json.Unmarshal([]byte(rp.Options), &opts); err != nil {
+			return store.PrintRecord{}, fmt.Errorf("invalid print options: %w", err)
+		}
+	}
+	storedRel, _, err := copyToUploads(rp.StoredPath, rp.Filename, uploadDir)
+	if err != nil {
+		return store.PrintRecord{}, err
+	}
+	rec, err := submitPrintJob(ctx, printSubmission{
+		UserID:    rp.UserID,
+		Printer:   rp.PrinterURI,
+		Filename:  rp.Filename,
+		StoredRel: storedRel,
+		Sides:     rp.Sides,
+		IsColor:   rp.IsColor,
+		Copies:    rp.Copies,
+		PageRange: rp.PageRange,
+		Options:   opts,
+	})
+	if err != nil {
+		removeUploadCopy(storedRel)
+		return store.PrintRecord{}, err
+	}
+	return rec, nil
+}
+
+func mapRecurringPrint(rp store.RecurringPrint) recurringPrintResponse {
+	return recurringPrintResponse{
+		ID:         rp.ID,
+		Name:       rp.Name,
+		PrinterURI: rp.PrinterURI,
+		Filename:   rp.Filename,
+		Sides:      rp.Sides,
+		IsColor:    rp.IsColor,
+		Copies:     rp.Copies,
+		PageRange:  rp.PageRange,
+		Schedule:   rp.Schedule,
+		Enabled:    rp.Enabled,
+		NextRunAt:  rp.NextRunAt,
+		LastRunAt:  rp.LastRunAt,
+		CreatedAt:  rp.CreatedAt,
+		UpdatedAt:  rp.UpdatedAt,
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/store"
+)
+
+// maxScheduleAhead bounds how far in the future a job may be scheduled so
+// uploads do not linger indefinitely.
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+var (
+	errNotScheduled   = errors.New("print job is not scheduled")
+	errInvalidPrintAt = errors.New("printAt must be an RFC3339 or YYYY-MM-DDTHH:MM time")
+	errPrintAtInPast  = errors.New("printAt must be in the future")
+	errPrintAtTooLate = errors.New("printAt must be within 30 days")
+)
+
+type schedulePayload struct {
+	PrintAt string `json:"printAt"`
+}
+
+// parsePrintAt accepts RFC3339 timestamps and the zone-less value of an HTML
+// datetime-local input, which is read in the server's local time zone.
+func parsePrintAt(value string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02T15:04", value, time.Local)
+	}
+	if err != nil {
+		return time.Time{}, errInvalidPrintAt
+	}
+	if !t.After(now) {
+		return time.Time{}, errPrintAtInPast
+	}
+	if t.Sub(now) > maxScheduleAhead {
+		return time.Time{}, errPrintAtTooLate
+	}
+	return t, nil
+}
+
+func scheduledJobsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp []printRecordResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		records, err := store.ListPrintRecords(r.Context(), tx, store.PrintFilter{
+			Username: user.Username,
+			Status:   store.PrintStatusScheduled,
+		})
+		if err != nil {
+			return err
+		}
+		resp = mapPrintRecords(records)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load scheduled jobs")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func rescheduleHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var payload schedulePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	printAt, err := parsePrintAt(strings.TrimSpace(payload.PrintAt), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		if _, err := ownScheduledRecord(r, tx, sess.UserID, id); err != nil {
+			return err
+		}
+		err := store.ReschedulePrintJob(r.Context(), tx, id, printAt.UTC().Format(time.RFC3339))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotScheduled
+		}
+		return err
+	})
+	if err != nil {
+		writeScheduleError(w, err, "failed to reschedule job")
+		return
+	}
+	publishPrintRecord(r.Context(), id)
+	writeJSON(w, map[string]string{"printAt": printAt.UTC().Format(time.RFC3339)})
+}
+
+func cancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid record id")
+		return
+	}
+	var rec store.PrintRecord
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		var err error
+		rec, err = ownScheduledRecord(r, tx, sess.UserID, id)
+		if err != nil {
+			return err
+		}
+		err = store.ClosePrintJob(r.Context(), tx, id, store.QueuePending, "canceled by user")
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotScheduled
+		}
+		if err != nil {
+			return err
+		}
+		return refundPrintTx(r.Context(), tx, rec.ID, rec.UserID, rec.CostCents, store.PrintStatusCanceled)
+	})
+	if err != nil {
+		writeScheduleError(w, err, "failed to cancel job")
+		return
+	}
+	publishRefund(r.Context(), rec.ID, rec.UserID)
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func ownScheduledRecord(r *http.Request, tx *sql.Tx, userID int64, id int64) (store.PrintRecord, error) {
+	rec, err := store.GetPrintRecordByID(r.Context(), tx, id)
+	if err != nil {
+		return rec, err
+	}
+	if rec.UserID != userID {
+		return rec, sql.ErrNoRows
+	}
+	if rec.Status != store.PrintStatusScheduled {
+		return rec, errNotScheduled
+	}
+	return rec, nil
+}
+
+func writeScheduleError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, errNotScheduled):
+		writeJSONError(w, http.StatusConflict, errNotScheduled.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, "record not found")
+	default:
+		writeJSONError(w, http.StatusInternalServerError, msg)
+	}
+}
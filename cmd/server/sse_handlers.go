@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/events"
+	"cups-web/internal/ipp"
+	"cups-web/internal/store"
+)
+
+const (
+	sseHeartbeatInterval = 25 * time.Second
+	printerPollInterval  = 10 * time.Second
+	printerStateTimeout  = 5 * time.Second
+)
+
+type balanceEvent struct {
+	UserID          int64 `json:"userId"`
+	BalanceCents    int64 `json:"balanceCents"`
+	MonthSpentCents int64 `json:"monthSpentCents"`
+	YearSpentCents  int64 `json:"yearSpentCents"`
+}
+
+// eventsHandler streams the current user's print-record and balance changes,
+// plus printer state changes, as Server-Sent Events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	serveEvents(w, r, appEvents.Subscribe(sess.UserID, false))
+}
+
+// adminEventsHandler streams every event for all users.
+func adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	serveEvents(w, r, appEvents.Subscribe(sess.UserID, true))
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request, sub *events.Subscriber) {
+	defer appEvents.Unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	// the server-wide WriteTimeout would otherwise cut the stream off
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// publishPrintRecord loads the record and broadcasts its current state. It
+// must be called after the transaction that changed it has committed.
+func publishPrintRecord(ctx context.Context, recordID int64) {
+	if appEvents.Count() == 0 {
+		return
+	}
+	var rec store.PrintRecord
+	err := appStore.WithTx(ctx, true, func(tx *sql.Tx) error {
+		found, err := store.GetPrintRecordByID(ctx, tx, recordID)
+		if err != nil {
+			return err
+		}
+		rec = found
+		return nil
+	})
+	if err != nil {
+		log.Println("publish print record failed:", err)
+		return
+	}
+	appEvents.Publish(events.Event{
+		Type:   events.TypePrintRecord,
+		UserID: rec.UserID,
+		Data:   mapPrintRecords([]store.PrintRecord{rec})[0],
+	})
+}
+
+func publishBalance(ctx context.Context, userID int64) {
+	if appEvents.Count() == 0 {
+		return
+	}
+	var user store.User
+	err := appStore.WithTx(ctx, true, func(tx *sql.Tx) error {
+		found, err := store.GetUserByID(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		user = found
+		return nil
+	})
+	if err != nil {
+		log.Println("publish balance failed:", err)
+		return
+	}
+	appEvents.Publish(events.Event{
+		Type:   events.TypeBalance,
+		UserID: user.ID,
+		Data: balanceEvent{
+			UserID:          user.ID,
+			BalanceCents:    user.BalanceCents,
+			MonthSpentCents: user.MonthSpentCents,
+			YearSpentCents:  user.YearSpentCents,
+		},
+	})
+}
+
+// startPrinterStateWatcher polls printer state while anyone is subscribed and
+// publishes an event whenever a printer's state, message or reasons change.
+func startPrinterStateWatcher() {
+	go func() {
+		last := map[string]string{}
+		for {
+			time.Sleep(printerPollInterval)
+			if appEvents.Count() == 0 {
+				continue
+			}
+			printers, err := ipp.ListPrinters(cupsHost())
+			if err != nil {
+				continue
+			}
+			for _, p := range printers {
+				ctx, cancel := context.WithTimeout(context.Background(), printerStateTimeout)
+				st, err := ipp.GetPrinterState(ctx, p.URI)
+				cancel()
+				if err != nil {
+					st = ipp.PrinterState{URI: p.URI, State: "unreachable", Message: err.Error()}
+				}
+				key, _ := json.Marshal(st)
+				if last[p.URI] == string(key) {
+					continue
+				}
+				last[p.URI] = string(key)
+				appEvents.Publish(events.Event{Type: events.TypePrinterState, Data: st})
+			}
+		}
+	}()
+}
+
+func cupsHost() string {
+	host := os.Getenv("CUPS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	return host
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"cups-web/internal/store"
+)
+
+var stampPlaceholderPattern = regexp.MustCompile(`\{[A-Za-z]+\}`)
+
+type stampTemplatePayload struct {
+	Name      string  `json:"name"`
+	Printer   string  `json:"printer"`
+	Header    string  `json:"header"`
+	Footer    string  `json:"footer"`
+	Watermark string  `json:"watermark"`
+	FontSize  float64 `json:"fontSize"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+type stampTemplateResponse struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Printer   string  `json:"printer"`
+	Header    string  `json:"header"`
+	Footer    string  `json:"footer"`
+	Watermark string  `json:"watermark"`
+	FontSize  float64 `json:"fontSize"`
+	Enabled   bool    `json:"enabled"`
+	CreatedAt string  `json:"createdAt"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+func decodeStampTemplatePayload(r *http.Request) (store.StampTemplateInput, error) {
+	var payload stampTemplatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return store.StampTemplateInput{}, errors.New("invalid payload")
+	}
+	input := store.StampTemplateInput{
+		Name:       strings.TrimSpace(payload.Name),
+		PrinterURI: strings.TrimSpace(payload.Printer),
+		Header:     strings.TrimSpace(payload.Header),
+		Footer:     strings.TrimSpace(payload.Footer),
+		Watermark:  strings.TrimSpace(payload.Watermark),
+		FontSize:   payload.FontSize,
+		Enabled:    payload.Enabled == nil || *payload.Enabled,
+	}
+	if input.Name == "" {
+		return input, errors.New("name required")
+	}
+	if input.Header == "" && input.Footer == "" && input.Watermark == "" {
+		return input, errors.New("header, footer or watermark required")
+	}
+	if input.FontSize == 0 {
+		input.FontSize = 8
+	}
+	if input.FontSize < 4 || input.FontSize > 36 {
+		return input, errors.New("fontSize must be 4-36")
+	}
+	for _, text := range []string{input.Header, input.Footer, input.Watermark} {
+		for _, p := range stampPlaceholderPattern.FindAllString(text, -1) {
+			if !validStampPlaceholder(p) {
+				return input, fmt.Errorf("unknown placeholder %s", p)
+			}
+		}
+	}
+	return input, nil
+}
+
+func validStampPlaceholder(p string) bool {
+	for _, known := range stampPlaceholders {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+func adminListStampTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	var resp []stampTemplateResponse
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		list, err := store.ListStampTemplates(r.Context(), tx)
+		if err != nil {
+			return err
+		}
+		resp = make([]stampTemplateResponse, 0, len(list))
+		for _, t := range list {
+			resp = append(resp, mapStampTemplate(t))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load stamp templates")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func adminCreateStampTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	input, err := decodeStampTemplatePayload(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var created store.StampTemplate
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		t, err := store.CreateStampTemplate(r.Context(), tx, input)
+		if err != nil {
+			return err
+		}
+		created = t
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create stamp template")
+		return
+	}
+	writeJSON(w, mapStampTemplate(created))
+}
+
+func adminUpdateStampTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid stamp template id")
+		return
+	}
+	input, err := decodeStampTemplatePayload(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var updated store.StampTemplate
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		t, err := store.UpdateStampTemplate(r.Context(), tx, id, input)
+		if err != nil {
+			return err
+		}
+		updated = t
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "stamp template not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to update stamp template")
+		}
+		return
+	}
+	writeJSON(w, mapStampTemplate(updated))
+}
+
+func adminDeleteStampTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid stamp template id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		return store.DeleteStampTemplate(r.Context(), tx, id)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "stamp template not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to delete stamp template")
+		}
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func mapStampTemplate(t store.StampTemplate) stampTemplateResponse {
+	return stampTemplateResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Printer:   t.PrinterURI,
+		Header:    t.Header,
+		Footer:    t.Footer,
+		Watermark: t.Watermark,
+		FontSize:  t.FontSize,
+		Enabled:   t.Enabled,
+		CreatedAt: t.CreatedAt,
+		UpdatedAt: t.UpdatedAt,
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cups-web/internal/store"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+)
+
+// 页眉页脚与水印：审计用的用户名、时间和任务号在转换后印到每一页上，
+// 使用内嵌的 NotoSansSC 字体以便正确显示中文用户名。
+
+const (
+	stampEdgePt          = 14.0
+	watermarkMaxFontSize = 120.0
+	watermarkAlpha       = 0.15
+)
+
+// stampPlaceholders lists the variables stamp templates may use. {page} and
+// {pages} are filled per page.
+var stampPlaceholders = []string{"{username}", "{jobId}", "{filename}", "{printer}", "{time}", "{date}", "{page}", "{pages}"}
+
+// stampVars returns the per-job placeholder values for a print record.
+func stampVars(rec store.PrintRecord, now time.Time) map[string]string {
+	return map[string]string{
+		"{username}": rec.Username,
+		"{jobId}":    strconv.FormatInt(rec.ID, 10),
+		"{filename}": rec.Filename,
+		"{printer}":  rec.PrinterURI,
+		"{time}":     now.Format("2006-01-02 15:04:05"),
+		"{date}":     now.Format("2006-01-02"),
+	}
+}
+
+func expandStamp(text string, vars map[string]string, page int, pages int) string {
+	if text == "" {
+		return ""
+	}
+	pairs := make([]string, 0, 2*(len(vars)+2))
+	for k, v := range vars {
+		pairs = append(pairs, k, v)
+	}
+	pairs = append(pairs, "{page}", strconv.Itoa(page), "{pages}", strconv.Itoa(pages))
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// stampPDF draws the stamp templates on every page of inPath and writes the
+// result to a temporary file.
+func stampPDF(inPath string, stamps []store.StampTemplate, vars map[string]string) (outPath string, cleanup func(), err error) {
+	// gofpdi panics on PDFs it cannot parse
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("stamping failed: %v", r)
+		}
+	}()
+
+	count, err := countPDFPages(inPath)
+	if err != nil {
+		return "", nil, err
+	}
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.SetAutoPageBreak(false, 0)
+	if err := setPdfTextFont(pdf, 10); err != nil {
+		return "", nil, err
+	}
+	imp := gofpdi.NewImporter()
+	for n := 1; n <= count; n++ {
+		tpl := imp.ImportPage(pdf, inPath, n, "/MediaBox")
+		box := imp.GetPageSizes()[n]["/MediaBox"]
+		w, h := box["w"], box["h"]
+		if w <= 0 || h <= 0 {
+			w, h = defaultSheet.w, defaultSheet.h
+		}
+		pdf.AddPageFormat("P", gofpdf.SizeType{Wd: w, Ht: h})
+		imp.UseImportedTemplate(pdf, tpl, 0, 0, w, h)
+		for _, st := range stamps {
+			drawStamp(pdf, st, vars, n, count, w, h)
+		}
+	}
+	if pdf.Err() {
+		return "", nil, pdf.Error()
+	}
+
+	tmpDir, err := os.MkdirTemp("", "stamp-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { _ = os.RemoveAll(tmpDir) }
+	outPath = filepath.Join(tmpDir, "stamped.pdf")
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
+
+func drawStamp(pdf *gofpdf.Fpdf, st store.StampTemplate, vars map[string]string, page int, pages int, w float64, h float64) {
+	size := st.FontSize
+	if size <= 0 {
+		size = 8
+	}
+	pdf.SetTextColor(90, 90, 90)
+	pdf.SetFontSize(size)
+	if text := expandStamp(st.Header, vars, page, pages); text != "" {
+		pdf.Text((w-pdf.GetStringWidth(text))/2, stampEdgePt+size, text)
+	}
+	if text := expandStamp(st.Footer, vars, page, pages); text != "" {
+		pdf.Text((w-pdf.GetStringWidth(text))/2, h-stampEdgePt, text)
+	}
+	if text := expandStamp(st.Watermark, vars, page, pages); text != "" {
+		// size the watermark to span most of the page diagonal
+		diagonal := math.Hypot(w, h) * 0.7
+		pdf.SetFontSize(watermarkMaxFontSize)
+		markSize := watermarkMaxFontSize * diagonal / pdf.GetStringWidth(text)
+		if markSize > watermarkMaxFontSize {
+			markSize = watermarkMaxFontSize
+		}
+		pdf.SetFontSize(markSize)
+		tw := pdf.GetStringWidth(text)
+		cx, cy := w/2, h/2
+		pdf.SetAlpha(watermarkAlpha, "Normal")
+		pdf.SetTextColor(200, 0, 0)
+		pdf.TransformBegin()
+		pdf.TransformRotate(math.Atan2(h, w)*180/math.Pi, cx, cy)
+		pdf.Text(cx-tw/2, cy+markSize/3, text)
+		pdf.TransformEnd()
+		pdf.SetAlpha(1, "Normal")
+	}
+	pdf.SetTextColor(0, 0, 0)
+}
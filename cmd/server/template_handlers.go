@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cups-web/internal/auth"
+	"cups-web/internal/store"
+)
+
+// templatesDir holds admin-published templates together with their
+// pre-converted PDFs.
+const templatesDir = "templates"
+
+type templateResponse struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Filename    string   `json:"filename"`
+	Pages       int      `json:"pages"`
+	Groups      []string `json:"groups"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+type templatePayload struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Groups      []string `json:"groups"`
+}
+
+// normalizeGroups trims, de-duplicates and drops empty group names. Commas
+// are not allowed in names because groups are stored comma-separated.
+func normalizeGroups(groups []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, g := range groups {
+		for _, part := range strings.Split(g, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" || seen[part] {
+				continue
+			}
+			seen[part] = true
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var resp []templateResponse
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		list, err := store.ListTemplates(r.Context(), tx)
+		if err != nil {
+			return err
+		}
+		resp = []templateResponse{}
+		for _, t := range list {
+			if user.Role == store.RoleAdmin || t.VisibleTo(user.Group) {
+				resp = append(resp, mapTemplate(t))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load templates")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// printTemplateHandler prints a template with the same form fields as
+// /api/print. The pre-converted PDF is copied along with the original so the
+// worker does not convert it again.
+func printTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	sess, err := auth.GetSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid template id")
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeJSONError(w, http.StatusBadRequest, "invalid form")
+		return
+	}
+	opts, err := parsePrintOptions(r, sess.UserID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var tmpl store.Template
+	err = appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		user, err := store.GetUserByID(r.Context(), tx, sess.UserID)
+		if err != nil {
+			return err
+		}
+		t, err := store.GetTemplate(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if user.Role != store.RoleAdmin && !t.VisibleTo(user.Group) {
+			return sql.ErrNoRows
+		}
+		tmpl = t
+		return nil
+	})
+	if err != nil {
+		writeTemplateError(w, err, "failed to load template")
+		return
+	}
+
+	storedRel, _, err := copyToUploads(tmpl.StoredPath, tmpl.Filename, uploadDir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to copy template")
+		return
+	}
+	rec, err := submitPrintJob(r.Context(), printSubmission{
+		UserID:    sess.UserID,
+		Printer:   opts.Printer,
+		Filename:  tmpl.Filename,
+		StoredRel: storedRel,
+		Sides:     opts.Sides,
+		IsColor:   opts.IsColor,
+		Copies:    opts.Copies,
+		PageRange: opts.PageRange,
+		Options:   opts.jobOptions(tmpl.Mime),
+	})
+	if err != nil {
+		removeUploadCopy(storedRel)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create print record")
+		return
+	}
+	writeJSONStatus(w, http.StatusAccepted, mapPrintResp(rec))
+}
+
+func adminCreateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(64 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	defer file.Close()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = fh.Filename
+	}
+	conv, err := parseConvertOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	storedRel, storedAbs, err := saveUploadedFile(file, fh.Filename, filepath.Join(uploadDir, templatesDir))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	storedRel = templatesDir + "/" + storedRel
+	if err := decryptUploadedPDF(r.Context(), storedAbs, fh.Filename, r.FormValue("pdfPassword")); err != nil {
+		_ = os.Remove(storedAbs)
+		if !writePDFPasswordError(w, err) {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+		return
+	}
+
+	// convert once now so every print of the template can reuse the PDF
+	sess, _ := auth.GetSession(r)
+	extendWriteDeadline(w)
+	convertCtx, cancel := convertTimeoutContext(withConvertOwner(r.Context(), sess.UserID))
+	defer cancel()
+	doc, err := preparePrintDocument(convertCtx, storedRel, storedAbs, fh.Filename, conv)
+	if err != nil {
+		removeUploadCopy(storedRel)
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	doc.cleanup()
+
+	var created store.Template
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		t, err := store.CreateTemplate(r.Context(), tx, store.Template{
+			Name:        name,
+			Description: strings.TrimSpace(r.FormValue("description")),
+			Filename:    fh.Filename,
+			StoredPath:  storedRel,
+			Mime:        fh.Header.Get("Content-Type"),
+			Pages:       doc.pages,
+			Groups:      normalizeGroups(r.Form["groups"]),
+		})
+		if err != nil {
+			return err
+		}
+		created = t
+		return nil
+	})
+	if err != nil {
+		removeUploadCopy(storedRel)
+		writeJSONError(w, http.StatusInternalServerError, "failed to save template")
+		return
+	}
+	writeJSON(w, mapTemplate(created))
+}
+
+func adminUpdateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid template id")
+		return
+	}
+	var payload templatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name required")
+		return
+	}
+	var updated store.Template
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		t, err := store.UpdateTemplate(r.Context(), tx, id, payload.Name, strings.TrimSpace(payload.Description), normalizeGroups(payload.Groups))
+		if err != nil {
+			return err
+		}
+		updated = t
+		return nil
+	})
+	if err != nil {
+		writeTemplateError(w, err, "failed to update template")
+		return
+	}
+	writeJSON(w, mapTemplate(updated))
+}
+
+func adminDeleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid template id")
+		return
+	}
+	var tmpl store.Template
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		t, err := store.GetTemplate(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		tmpl = t
+		return store.DeleteTemplate(r.Context(), tx, id)
+	})
+	if err != nil {
+		writeTemplateError(w, err, "failed to delete template")
+		return
+	}
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(tmpl.StoredPath)))
+	_ = os.Remove(filepath.Join(uploadDir, filepath.FromSlash(convertedRelPath(tmpl.StoredPath))))
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func writeTemplateError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, msg)
+}
+
+func mapTemplate(t store.Template) templateResponse {
+	groups := t.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return templateResponse{
+		ID:          t.ID,
+		Name:        t.Name,
+		Description: t.Description,
+		Filename:    t.Filename,
+		Pages:       t.Pages,
+		Groups:      groups,
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/phpdave11/gofpdf"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// 纯文本排版：自动识别编码（UTF-8、UTF-16、GBK/GB18030），展开制表符，
+// 按实际字宽自动换行，页数由排版结果得出，与打印输出一致。
+
+const (
+	defaultTextFontSize = 10.0
+	minTextFontSize     = 6.0
+	maxTextFontSize     = 24.0
+	textTabWidth        = 8
+	textLineSpacing     = 1.3
+	ptToMM              = 25.4 / 72
+
+	orientationPortrait  = "portrait"
+	orientationLandscape = "landscape"
+)
+
+// textLayout controls how plain text files are laid out. The zero value
+// uses the defaults: 10pt, portrait.
+type textLayout struct {
+	FontSize    float64 `json:"fontSize,omitempty"`
+	Orientation string  `json:"orientation,omitempty"`
+}
+
+func (l textLayout) isZero() bool {
+	return l.FontSize == 0 && l.Orientation == ""
+}
+
+func (l textLayout) fontSize() float64 {
+	if l.FontSize <= 0 {
+		return defaultTextFontSize
+	}
+	return l.FontSize
+}
+
+func (l textLayout) pdfOrientation() string {
+	if l.Orientation == orientationLandscape {
+		return "L"
+	}
+	return "P"
+}
+
+// parseTextLayout reads the fontSize and orientation form fields.
+func parseTextLayout(r *http.Request) (textLayout, error) {
+	var l textLayout
+	if v := strings.TrimSpace(r.FormValue("fontSize")); v != "" {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil || size < minTextFontSize || size > maxTextFontSize {
+			return l, errors.New("fontSize must be 6-24")
+		}
+		l.FontSize = size
+	}
+	o, err := parseOrientation(r)
+	if err != nil {
+		return l, err
+	}
+	l.Orientation = o
+	return l, nil
+}
+
+// parseOrientation reads the orientation form field. Portrait is the default
+// and is returned as "".
+func parseOrientation(r *http.Request) (string, error) {
+	switch o := strings.TrimSpace(r.FormValue("orientation")); o {
+	case "", orientationPortrait:
+		return "", nil
+	case orientationLandscape:
+		return o, nil
+	default:
+		return "", errors.New("orientation must be portrait or landscape")
+	}
+}
+
+// decodeText converts the file contents to UTF-8. Byte order marks select
+// UTF-8 or UTF-16; otherwise text that looks like UTF-16 without a BOM is
+// decoded as such, valid UTF-8 is kept, and anything else is read as GB18030,
+// a superset of GBK.
+func decodeText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return string(data[3:])
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeWith(data, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeWith(data, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
+	}
+	if le, ok := guessUTF16(data); ok {
+		order := unicode.BigEndian
+		if le {
+			order = unicode.LittleEndian
+		}
+		return decodeWith(data, unicode.UTF16(order, unicode.IgnoreBOM).NewDecoder())
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return decodeWith(data, simplifiedchinese.GB18030.NewDecoder())
+}
+
+func decodeWith(data []byte, t transform.Transformer) string {
+	out, _, err := transform.Bytes(t, data)
+	if err != nil {
+		return string(bytes.ToValidUTF8(data, []byte("�")))
+	}
+	return string(out)
+}
+
+// guessUTF16 detects BOM-less UTF-16 from zero bytes. Text in GBK or UTF-8
+// never contains them, while every ASCII character in UTF-16 leaves one, on
+// odd offsets for little endian and even offsets for big endian.
+func guessUTF16(data []byte) (littleEndian bool, ok bool) {
+	n := len(data)
+	if n < 2 || n%2 != 0 {
+		return false, false
+	}
+	if n > 64<<10 {
+		n = 64 << 10
+	}
+	var evenZeros, oddZeros int
+	for i := 0; i < n; i++ {
+		if data[i] == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	switch {
+	case oddZeros > 0 && evenZeros*10 < oddZeros:
+		return true, true
+	case evenZeros > 0 && oddZeros*10 < evenZeros:
+		return false, true
+	}
+	return false, false
+}
+
+// expandTabs replaces tabs with spaces up to the next tab stop.
+func expandTabs(line string) string {
+	if !strings.ContainsRune(line, '\t') {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			n := textTabWidth - col%textTabWidth
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+// runeWidths measures single characters with the current font of pdf,
+// caching the results.
+func runeWidths(pdf *gofpdf.Fpdf) func(rune) float64 {
+	widths := map[rune]float64{}
+	return func(r rune) float64 {
+		w, ok := widths[r]
+		if !ok {
+			w = pdf.GetStringWidth(string(r))
+			widths[r] = w
+		}
+		return w
+	}
+}
+
+// wrapLine splits one line into pieces that fit maxWidth, breaking at the
+// last space when there is one and between any two characters otherwise
+// (CJK text has no spaces).
+func wrapLine(line string, maxWidth float64, runeWidth func(rune) float64) []string {
+	runes := []rune(line)
+	if len(runes) == 0 {
+		return []string{""}
+	}
+	out := []string{}
+	start, width, lastSpace := 0, 0.0, -1
+	for j := 0; j < len(runes); j++ {
+		r := runes[j]
+		w := runeWidth(r)
+		if width+w > maxWidth && j > start {
+			end := j
+			next := j
+			if lastSpace > start {
+				end = lastSpace
+				next = lastSpace + 1
+			}
+			out = append(out, strings.TrimRight(string(runes[start:end]), " "))
+			start, lastSpace = next, -1
+			width = 0
+			for _, rr := range runes[start:j] {
+				width += runeWidth(rr)
+			}
+		}
+		if r == ' ' {
+			lastSpace = j
+		}
+		width += w
+	}
+	return append(out, string(runes[start:]))
+}
+
+// layoutTextPages splits text into pages of lines that fit the printable
+// width. A form feed starts a new page. The font must already be set on pdf.
+func layoutTextPages(pdf *gofpdf.Fpdf, text string, maxWidth float64, linesPerPage int) [][]string {
+	runeWidth := runeWidths(pdf)
+	pages := [][]string{}
+	page := []string{}
+	emit := func(line string) {
+		if len(page) >= linesPerPage {
+			pages = append(pages, page)
+			page = []string{}
+		}
+		page = append(page, line)
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	for _, raw := range strings.Split(text, "\n") {
+		segments := strings.Split(raw, "\f")
+		for i, seg := range segments {
+			if i > 0 {
+				pages = append(pages, page)
+				page = []string{}
+				if seg == "" {
+					continue
+				}
+			}
+			for _, line := range wrapLine(expandTabs(seg), maxWidth, runeWidth) {
+				emit(line)
+			}
+		}
+	}
+	if len(page) > 0 || len(pages) == 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// newTextPDF prepares a document with the text font and returns it together
+// with the laid out pages and the line height in mm.
+func newTextPDF(inputPath string, layout textLayout) (*gofpdf.Fpdf, [][]string, float64, error) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pdf := gofpdf.New(layout.pdfOrientation(), "mm", "A4", "")
+	pdf.SetMargins(pdfPageMarginMM, pdfPageMarginMM, pdfPageMarginMM)
+	pdf.SetAutoPageBreak(false, pdfPageMarginMM)
+	size := layout.fontSize()
+	if err := setPdfTextFont(pdf, size); err != nil {
+		return nil, nil, 0, err
+	}
+	pageW, pageH := pdf.GetPageSize()
+	lineHeight := size * ptToMM * textLineSpacing
+	linesPerPage := int((pageH - 2*pdfPageMarginMM) / lineHeight)
+	if linesPerPage < 1 {
+		linesPerPage = 1
+	}
+	pages := layoutTextPages(pdf, decodeText(data), pageW-2*pdfPageMarginMM, linesPerPage)
+	return pdf, pages, lineHeight, nil
+}
+
+// countTextPages returns the number of pages convertTextToPDF produces for
+// the file with the same layout.
+func countTextPages(path string, layout textLayout) (int, error) {
+	_, pages, _, err := newTextPDF(path, layout)
+	if err != nil {
+		return 0, err
+	}
+	return len(pages), nil
+}
+
+func convertTextToPDF(inputPath string, layout textLayout) (string, func(), error) {
+	pdf, pages, lineHeight, err := newTextPDF(inputPath, layout)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "convert-text-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tmpDir) }
+
+	for _, lines := range pages {
+		pdf.AddPage()
+		for i, line := range lines {
+			if line == "" {
+				continue
+			}
+			pdf.Text(pdfPageMarginMM, pdfPageMarginMM+lineHeight*float64(i+1), line)
+		}
+	}
+
+	outPath := filepath.Join(tmpDir, "text.pdf")
+	if err := pdf.OutputFileAndClose(outPath); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return outPath, cleanup, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cups-web/internal/store"
+)
+
+type webhookPayload struct {
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled"`
+}
+
+type webhookResponse struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret"`
+	Events    []string `json:"events"`
+	Enabled   bool     `json:"enabled"`
+	CreatedAt string   `json:"createdAt"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+type webhookDeliveryResponse struct {
+	ID             int64  `json:"id"`
+	WebhookID      int64  `json:"webhookId"`
+	URL            string `json:"url"`
+	Event          string `json:"event"`
+	Payload        string `json:"payload"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt"`
+	LastError      string `json:"lastError"`
+	ResponseStatus int    `json:"responseStatus"`
+	CreatedAt      string `json:"createdAt"`
+	DeliveredAt    string `json:"deliveredAt"`
+}
+
+func adminListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var resp []webhookResponse
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		hooks, err := store.ListWebhooks(r.Context(), tx)
+		if err != nil {
+			return err
+		}
+		resp = make([]webhookResponse, 0, len(hooks))
+		for _, hook := range hooks {
+			resp = append(resp, mapWebhook(hook))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func adminCreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	input, err := decodeWebhookPayload(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Secret == "" {
+		input.Secret = randomToken()
+	}
+	var created store.Webhook
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		hook, err := store.CreateWebhook(r.Context(), tx, input)
+		if err != nil {
+			return err
+		}
+		created = hook
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to create webhook")
+		return
+	}
+	writeJSON(w, mapWebhook(created))
+}
+
+func adminUpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	input, err := decodeWebhookPayload(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var updated store.Webhook
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		current, err := store.GetWebhookByID(r.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if input.Secret == "" {
+			input.Secret = current.Secret
+		}
+		hook, err := store.UpdateWebhook(r.Context(), tx, id, input)
+		if err != nil {
+			return err
+		}
+		updated = hook
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "webhook not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to update webhook")
+		}
+		return
+	}
+	writeJSON(w, mapWebhook(updated))
+}
+
+func adminDeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		return store.DeleteWebhook(r.Context(), tx, id)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "webhook not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to delete webhook")
+		}
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	filter := store.DeliveryFilter{
+		Status: r.URL.Query().Get("status"),
+		Limit:  200,
+	}
+	if v := r.URL.Query().Get("webhookId"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid webhook id")
+			return
+		}
+		filter.WebhookID = id
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			filter.Limit = n
+		}
+	}
+
+	var resp []webhookDeliveryResponse
+	err := appStore.WithTx(r.Context(), true, func(tx *sql.Tx) error {
+		list, err := store.ListWebhookDeliveries(r.Context(), tx, filter)
+		if err != nil {
+			return err
+		}
+		resp = make([]webhookDeliveryResponse, 0, len(list))
+		for _, d := range list {
+			resp = append(resp, mapWebhookDelivery(d))
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load deliveries")
+		return
+	}
+	writeJSON(w, resp)
+}
+
+func adminRetryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseIDParam(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid delivery id")
+		return
+	}
+	err = appStore.WithTx(r.Context(), false, func(tx *sql.Tx) error {
+		return store.RetryWebhookDelivery(r.Context(), tx, id)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "delivery not found")
+		} else {
+			writeJSONError(w, http.StatusInternalServerError, "failed to retry delivery")
+		}
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
+
+func decodeWebhookPayload(r *http.Request) (store.WebhookInput, error) {
+	var payload webhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		return store.WebhookInput{}, errors.New("invalid payload")
+	}
+	payload.URL = strings.TrimSpace(payload.URL)
+	u, err := url.Parse(payload.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return store.WebhookInput{}, errors.New("invalid url")
+	}
+	events := make([]string, 0, len(payload.Events))
+	for _, e := range payload.Events {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if e != "*" && !isWebhookEvent(e) {
+			return store.WebhookInput{}, errors.New("unknown event: " + e)
+		}
+		events = append(events, e)
+	}
+	enabled := true
+	if payload.Enabled != nil {
+		enabled = *payload.Enabled
+	}
+	return store.WebhookInput{
+		URL:     payload.URL,
+		Secret:  strings.TrimSpace(payload.Secret),
+		Events:  events,
+		Enabled: enabled,
+	}, nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func mapWebhook(hook store.Webhook) webhookResponse {
+	events := hook.Events
+	if events == nil {
+		events = []string{}
+	}
+	return webhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Secret:    hook.Secret,
+		Events:    events,
+		Enabled:   hook.Enabled,
+		CreatedAt: hook.CreatedAt,
+		UpdatedAt: hook.UpdatedAt,
+	}
+}
+
+func mapWebhookDelivery(d store.WebhookDelivery) webhookDeliveryResponse {
+	deliveredAt := ""
+	if d.DeliveredAt.Valid {
+		deliveredAt = d.DeliveredAt.String
+	}
+	return webhookDeliveryResponse{
+		ID:             d.ID,
+		WebhookID:      d.WebhookID,
+		URL:            d.URL,
+		Event:          d.Event,
+		Payload:        d.Payload,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		NextAttemptAt:  d.NextAttemptAt,
+		LastError:      d.LastError,
+		ResponseStatus: d.ResponseStatus,
+		CreatedAt:      d.CreatedAt,
+		DeliveredAt:    deliveredAt,
+	}
+}
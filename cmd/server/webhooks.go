@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"cups-web/internal/store"
+	"cups-web/internal/webhook"
+)
+
+const (
+	eventJobCreated   = "job.created"
+	eventJobCompleted = "job.completed"
+	eventJobFailed    = "job.failed"
+	eventJobCanceled  = "job.canceled"
+	eventJobExpired   = "job.expired"
+	eventTopupCreated = "topup.created"
+	eventUserCreated  = "user.created"
+)
+
+var webhookEvents = []string{eventJobCreated, eventJobCompleted, eventJobFailed, eventJobCanceled, eventJobExpired, eventTopupCreated, eventUserCreated}
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 1 * time.Hour
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 20
+)
+
+type webhookEnvelope struct {
+	Event     string      `json:"event"`
+	CreatedAt string      `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// enqueueEvent records an outbound webhook event in the outbox as part of tx.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, event string, data interface{}) error {
+	body, err := json.Marshal(webhookEnvelope{Event: event, CreatedAt: nowRFC3339(), Data: data})
+	if err != nil {
+		return err
+	}
+	return store.EnqueueWebhookEvent(ctx, tx, event, string(body))
+}
+
+func enqueuePrintEvent(ctx context.Context, tx *sql.Tx, event string, recordID int64) error {
+	rec, err := store.GetPrintRecordByID(ctx, tx, recordID)
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(ctx, tx, event, mapPrintRecords([]store.PrintRecord{rec})[0])
+}
+
+func enqueueTopupEvent(ctx context.Context, tx *sql.Tx, topupID int64) error {
+	rec, err := store.GetTopupByID(ctx, tx, topupID)
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(ctx, tx, eventTopupCreated, mapTopups([]store.TopupRecord{rec})[0])
+}
+
+func startWebhookDispatcher(s *store.Store) {
+	client := webhook.NewClient()
+	go func() {
+		for {
+			if err := dispatchWebhooks(context.Background(), s, client); err != nil {
+				log.Println("webhook dispatch failed:", err)
+			}
+			time.Sleep(webhookPollInterval)
+		}
+	}()
+}
+
+func dispatchWebhooks(ctx context.Context, s *store.Store, client *webhook.Client) error {
+	var due []store.WebhookDelivery
+	err := s.WithTx(ctx, true, func(tx *sql.Tx) error {
+		list, err := store.ListDueDeliveries(ctx, tx, nowRFC3339(), webhookBatchSize)
+		if err != nil {
+			return err
+		}
+		due = list
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		attempts := d.Attempts + 1
+		status, sendErr := client.Deliver(ctx, d.URL, d.Secret, d.Event, d.ID, []byte(d.Payload))
+		err := s.WithTx(ctx, false, func(tx *sql.Tx) error {
+			if sendErr == nil {
+				return store.MarkDeliveryDelivered(ctx, tx, d.ID, attempts, status)
+			}
+			next := ""
+			if attempts < webhookMaxAttempts {
+				next = time.Now().Add(webhookBackoff(attempts)).UTC().Format(time.RFC3339)
+			}
+			return store.MarkDeliveryAttemptFailed(ctx, tx, d.ID, attempts, status, sendErr.Error(), next)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return d
+}
@@ -7,7 +7,10 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/securecookie v1.1.1
 	github.com/phpdave11/gofpdf v1.4.2
+	github.com/yuin/goldmark v1.8.6
 	golang.org/x/crypto v0.47.0
+	golang.org/x/image v0.35.0
+	golang.org/x/text v0.33.0
 	modernc.org/sqlite v1.29.0
 	rsc.io/pdf v0.1.1
 )
@@ -18,6 +21,8 @@ require (
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/phpdave11/gofpdi v1.0.12 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	golang.org/x/exp v0.0.0-20251023183803-a4bb9ffd2546 // indirect
 	golang.org/x/sys v0.40.0 // indirect
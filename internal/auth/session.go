@@ -96,3 +96,34 @@ func GetSession(r *http.Request) (Session, error) {
 	}
 	return sess, nil
 }
+
+const kioskTokenName = "kiosk"
+
+// KioskSession identifies a user signed in at a release station. It travels
+// in the X-Kiosk-Session header rather than a cookie.
+type KioskSession struct {
+	DeviceID int64     `json:"deviceId"`
+	UserID   int64     `json:"userId"`
+	Expires  time.Time `json:"expires"`
+}
+
+func EncodeKioskSession(sess KioskSession) (string, error) {
+	if s == nil {
+		return "", errors.New("securecookie not initialized")
+	}
+	return s.Encode(kioskTokenName, sess)
+}
+
+func DecodeKioskSession(token string) (KioskSession, error) {
+	var sess KioskSession
+	if s == nil {
+		return sess, errors.New("securecookie not initialized")
+	}
+	if err := s.Decode(kioskTokenName, token, &sess); err != nil {
+		return sess, err
+	}
+	if time.Now().After(sess.Expires) {
+		return sess, errors.New("kiosk session expired")
+	}
+	return sess, nil
+}
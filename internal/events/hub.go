@@ -0,0 +1,74 @@
+package events
+
+import "sync"
+
+const (
+	TypePrintRecord  = "print-record"
+	TypeBalance      = "balance"
+	TypePrinterState = "printer-state"
+)
+
+// Event is a change notification fanned out to subscribers. UserID scopes the
+// event to a single user; zero means it is visible to everyone.
+type Event struct {
+	Type   string      `json:"type"`
+	UserID int64       `json:"-"`
+	Data   interface{} `json:"data"`
+}
+
+type Subscriber struct {
+	C      chan Event
+	userID int64
+	all    bool
+}
+
+// Hub is an in-process publish/subscribe fan-out. Publishing never blocks: a
+// subscriber that falls behind its buffer misses events rather than stalling
+// the publisher.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscriber]struct{})}
+}
+
+// Subscribe registers a subscriber for userID's events. When all is true the
+// subscriber receives every event regardless of user.
+func (h *Hub) Subscribe(userID int64, all bool) *Subscriber {
+	sub := &Subscriber{C: make(chan Event, 64), userID: userID, all: all}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.mu.Lock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.C)
+	}
+	h.mu.Unlock()
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.all && e.UserID != 0 && e.UserID != sub.userID {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+		}
+	}
+}
+
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
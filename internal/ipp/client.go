@@ -2,21 +2,51 @@ package ipp
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	goipp "github.com/OpenPrinting/goipp"
 )
 
+// httpClient bounds every exchange with CUPS or a printer, so one that stops
+// responding cannot block its caller forever. The limit is generous because
+// Print-Job uploads the whole document.
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// JobOptions are optional job template attributes; zero values are left to
+// the printer's defaults.
+type JobOptions struct {
+	Media        string
+	NumberUp     int
+	PrintQuality string
+}
+
+// printQualityValues maps print-quality keywords to their IPP enum values.
+var printQualityValues = map[string]int{
+	"draft":  3,
+	"normal": 4,
+	"high":   5,
+}
+
+// ValidPrintQuality reports whether q is a supported print-quality keyword.
+func ValidPrintQuality(q string) bool {
+	_, ok := printQualityValues[q]
+	return ok
+}
+
 // SendPrintJob sends data to the printer via IPP using goipp to build the
 // IPP Print-Job request. It returns a human-readable status or job identifier
 // when available.
-func SendPrintJob(printerURI string, r io.Reader, mime string, username string, jobName string, sides string, isColor bool, copies int, pageRange string) (string, error) {
+func SendPrintJob(ctx context.Context, printerURI string, r io.Reader, mime string, username string, jobName string, sides string, isColor bool, copies int, pageRange string, opts JobOptions) (string, error) {
 	// Build IPP Print-Job request
 	req := goipp.NewRequest(goipp.DefaultVersion, goipp.OpPrintJob, 1)
 	req.Operation.Add(goipp.MakeAttribute("attributes-charset", goipp.TagCharset, goipp.String("utf-8")))
@@ -70,38 +100,19 @@ func SendPrintJob(printerURI string, r io.Reader, mime string, username string,
 		}
 	}
 
-	payload, err := req.EncodeBytes()
-	if err != nil {
-		return "", fmt.Errorf("encode ipp request: %w", err)
-	}
-
-	// Prepare HTTP body: IPP request bytes followed by document bytes
-	body := io.MultiReader(bytes.NewBuffer(payload), r)
-
-	httpReq, err := http.NewRequest(http.MethodPost, printerURI, body)
-	if err != nil {
-		return "", fmt.Errorf("create http request: %w", err)
+	if opts.Media != "" {
+		req.Operation.Add(goipp.MakeAttribute("media", goipp.TagKeyword, goipp.String(opts.Media)))
 	}
-	httpReq.Header.Set("Content-Type", goipp.ContentType)
-	httpReq.Header.Set("Accept", goipp.ContentType)
-
-	resp, err := http.DefaultClient.Do(httpReq)
-	if resp != nil {
-		defer resp.Body.Close()
+	if opts.NumberUp > 1 {
+		req.Operation.Add(goipp.MakeAttribute("number-up", goipp.TagInteger, goipp.Integer(opts.NumberUp)))
 	}
-	if err != nil {
-		return "", fmt.Errorf("http post: %w", err)
-	}
-	if resp.StatusCode/100 != 2 {
-		return "", fmt.Errorf("http status: %s", resp.Status)
+	if q, ok := printQualityValues[opts.PrintQuality]; ok {
+		req.Operation.Add(goipp.MakeAttribute("print-quality", goipp.TagEnum, goipp.Integer(q)))
 	}
 
-	var rsp goipp.Message
-	if err := rsp.Decode(resp.Body); err != nil {
-		return "", fmt.Errorf("decode ipp response: %w", err)
-	}
-	if goipp.Status(rsp.Code) != goipp.StatusOk {
-		return "", fmt.Errorf("ipp error: %s", goipp.Status(rsp.Code).String())
+	rsp, err := doRequest(ctx, printerURI, req, r)
+	if err != nil {
+		return "", err
 	}
 
 	// Try to return job-uri or job-id if present in Job attributes
@@ -143,7 +154,7 @@ func ListPrinters(host string) ([]Printer, error) {
 
 	listURL := (&url.URL{Scheme: "http", Host: hostOnly, Path: "/printers"}).String()
 
-	resp, err := http.Get(listURL)
+	resp, err := httpClient.Get(listURL)
 	if err != nil {
 		return nil, fmt.Errorf("fetch printers page: %w", err)
 	}
@@ -172,3 +183,139 @@ func ListPrinters(host string) ([]Printer, error) {
 
 	return printers, nil
 }
+
+type PrinterState struct {
+	URI     string   `json:"uri"`
+	State   string   `json:"state"`
+	Message string   `json:"message"`
+	Reasons []string `json:"reasons"`
+}
+
+// GetPrinterState queries printer-state, printer-state-message and
+// printer-state-reasons with an IPP Get-Printer-Attributes request.
+func GetPrinterState(ctx context.Context, printerURI string) (PrinterState, error) {
+	req := goipp.NewRequest(goipp.DefaultVersion, goipp.OpGetPrinterAttributes, 1)
+	req.Operation.Add(goipp.MakeAttribute("attributes-charset", goipp.TagCharset, goipp.String("utf-8")))
+	req.Operation.Add(goipp.MakeAttribute("attributes-natural-language", goipp.TagLanguage, goipp.String("en-US")))
+	req.Operation.Add(goipp.MakeAttribute("printer-uri", goipp.TagURI, goipp.String(printerURI)))
+	requested := goipp.MakeAttribute("requested-attributes", goipp.TagKeyword, goipp.String("printer-state"))
+	requested.Values.Add(goipp.TagKeyword, goipp.String("printer-state-message"))
+	requested.Values.Add(goipp.TagKeyword, goipp.String("printer-state-reasons"))
+	req.Operation.Add(requested)
+
+	rsp, err := doRequest(ctx, printerURI, req, nil)
+	if err != nil {
+		return PrinterState{}, err
+	}
+
+	st := PrinterState{URI: printerURI}
+	for _, a := range rsp.Printer {
+		if len(a.Values) == 0 {
+			continue
+		}
+		switch a.Name {
+		case "printer-state":
+			st.State = printerStateName(a.Values[0].V.String())
+		case "printer-state-message":
+			st.Message = a.Values[0].V.String()
+		case "printer-state-reasons":
+			for _, v := range a.Values {
+				st.Reasons = append(st.Reasons, v.V.String())
+			}
+		}
+	}
+	return st, nil
+}
+
+func printerStateName(v string) string {
+	switch v {
+	case "3":
+		return "idle"
+	case "4":
+		return "processing"
+	case "5":
+		return "stopped"
+	default:
+		return v
+	}
+}
+
+// Error is returned for failed IPP exchanges. Transient is set when the
+// failure is likely to clear on its own (printer or CUPS unreachable, busy or
+// restarting) and the request is worth retrying. Failures after the request
+// was sent are never transient: the printer may already have accepted the
+// job, and resending it would print the document twice.
+type Error struct {
+	Transient bool
+	Err       error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// IsTransient reports whether err is an IPP failure worth retrying.
+func IsTransient(err error) bool {
+	var ippErr *Error
+	return errors.As(err, &ippErr) && ippErr.Transient
+}
+
+func transientStatus(code goipp.Status) bool {
+	switch code {
+	case goipp.StatusErrorServiceUnavailable, goipp.StatusErrorTemporary,
+		goipp.StatusErrorNotAcceptingJobs, goipp.StatusErrorBusy:
+		return true
+	default:
+		return false
+	}
+}
+
+// notSent reports whether a failed HTTP request never reached the server
+// because the connection could not be opened.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// doRequest POSTs an encoded IPP request (followed by an optional document) to
+// uri and decodes the response, treating non-successful IPP status codes as
+// errors.
+func doRequest(ctx context.Context, uri string, req *goipp.Message, doc io.Reader) (*goipp.Message, error) {
+	payload, err := req.EncodeBytes()
+	if err != nil {
+		return nil, fmt.Errorf("encode ipp request: %w", err)
+	}
+	var body io.Reader = bytes.NewBuffer(payload)
+	if doc != nil {
+		body = io.MultiReader(body, doc)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, body)
+	if err != nil {
+		return nil, fmt.Errorf("create http request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", goipp.ContentType)
+	httpReq.Header.Set("Accept", goipp.ContentType)
+
+	resp, err := httpClient.Do(httpReq)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, &Error{Transient: notSent(err), Err: fmt.Errorf("http post: %w", err)}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &Error{
+			Transient: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+			Err:       fmt.Errorf("http status: %s", resp.Status),
+		}
+	}
+
+	var rsp goipp.Message
+	if err := rsp.Decode(resp.Body); err != nil {
+		return nil, &Error{Err: fmt.Errorf("decode ipp response: %w", err)}
+	}
+	if status := goipp.Status(rsp.Code); status > goipp.StatusOkEventsComplete {
+		return nil, &Error{Transient: transientStatus(status), Err: fmt.Errorf("ipp error: %s", status.String())}
+	}
+	return &rsp, nil
+}
@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer delivers a single plain-text email.
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// StartTLS upgrades the connection when the server offers it. Disable it
+	// for local test servers that advertise STARTTLS without a valid cert.
+	StartTLS bool
+}
+
+// ConfigFromEnv reads SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD,
+// SMTP_FROM and SMTP_STARTTLS. The second return value is false when no SMTP
+// host is configured.
+func ConfigFromEnv() (SMTPConfig, bool) {
+	cfg := SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     25,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		StartTLS: os.Getenv("SMTP_STARTTLS") != "false",
+	}
+	if cfg.Host == "" {
+		return cfg, false
+	}
+	if p, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil && p > 0 {
+		cfg.Port = p
+	}
+	if cfg.From == "" {
+		cfg.From = cfg.Username
+	}
+	return cfg, true
+}
+
+type SMTPSender struct {
+	cfg SMTPConfig
+}
+
+func NewSMTPSender(cfg SMTPConfig) *SMTPSender {
+	return &SMTPSender{cfg: cfg}
+}
+
+func (s *SMTPSender) Send(ctx context.Context, to string, subject string, body string) error {
+	if to == "" {
+		return errors.New("empty recipient")
+	}
+	// the address goes into the To header, so a line break would let it
+	// inject headers
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("invalid recipient")
+	}
+	if s.cfg.From == "" {
+		return errors.New("smtp sender address not configured")
+	}
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial smtp: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp handshake: %w", err)
+	}
+	defer c.Close()
+
+	if s.cfg.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: s.cfg.Host}); err != nil {
+				return fmt.Errorf("smtp starttls: %w", err)
+			}
+		}
+	}
+	if s.cfg.Username != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			auth := smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+			if err := c.Auth(auth); err != nil {
+				return fmt.Errorf("smtp auth: %w", err)
+			}
+		}
+	}
+	if err := c.Mail(s.cfg.From); err != nil {
+		return fmt.Errorf("smtp mail from: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("smtp rcpt to: %w", err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	if _, err := wc.Write(buildMessage(s.cfg.From, to, subject, body)); err != nil {
+		wc.Close()
+		return fmt.Errorf("smtp write: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("smtp data close: %w", err)
+	}
+	return c.Quit()
+}
+
+func buildMessage(from string, to string, subject string, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.BEncoding.Encode("utf-8", subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	for _, line := range strings.Split(body, "\n") {
+		// dot-stuffing is handled by net/smtp's data writer
+		b.WriteString(line + "\r\n")
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts one session and records the envelope and message.
+type fakeSMTPServer struct {
+	ln   net.Listener
+	done chan struct{}
+	from string
+	rcpt []string
+	data string
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln, done: make(chan struct{})}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer close(s.done)
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.rcpt = append(s.rcpt, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			s.data = b.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPSenderSend(t *testing.T) {
+	srv := startFakeSMTPServer(t)
+	sender := NewSMTPSender(SMTPConfig{Host: "127.0.0.1", Port: srv.port(), From: "print@example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sender.Send(ctx, "alice@example.com", "余额不足", "balance low\n.hidden line"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-srv.done
+	if srv.from != "print@example.com" {
+		t.Errorf("MAIL FROM = %q", srv.from)
+	}
+	if len(srv.rcpt) != 1 || srv.rcpt[0] != "alice@example.com" {
+		t.Errorf("RCPT TO = %q", srv.rcpt)
+	}
+	for _, want := range []string{
+		"To: alice@example.com\r\n",
+		"Subject: =?utf-8?b?",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"\r\n\r\nbalance low\r\n..hidden line\r\n",
+	} {
+		if !strings.Contains(srv.data, want) {
+			t.Errorf("message missing %q:\n%s", want, srv.data)
+		}
+	}
+}
+
+func TestSMTPSenderRejectsHeaderInjection(t *testing.T) {
+	sender := NewSMTPSender(SMTPConfig{Host: "127.0.0.1", Port: 1, From: "print@example.com"})
+	for _, to := range []string{"a@example.com\r\nBcc: b@example.com", "a@example.com\nBcc: b@example.com"} {
+		if err := sender.Send(context.Background(), to, "s", "b"); err == nil || err.Error() != "invalid recipient" {
+			t.Errorf("Send(%q) = %v, want invalid recipient", to, err)
+		}
+	}
+}
+
+func TestSMTPSenderServerDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	sender := NewSMTPSender(SMTPConfig{Host: "127.0.0.1", Port: port, From: "print@example.com"})
+	err = sender.Send(context.Background(), "a@example.com", "s", "b")
+	if err == nil || !strings.Contains(err.Error(), "dial smtp") {
+		t.Errorf("Send = %v, want dial error", err)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	if _, ok := ConfigFromEnv(); ok {
+		t.Error("ConfigFromEnv without SMTP_HOST reported ok")
+	}
+	t.Setenv("SMTP_HOST", "mail.example.com")
+	t.Setenv("SMTP_PORT", strconv.Itoa(2525))
+	t.Setenv("SMTP_USERNAME", "print@example.com")
+	t.Setenv("SMTP_FROM", "")
+	t.Setenv("SMTP_STARTTLS", "false")
+	cfg, ok := ConfigFromEnv()
+	if !ok || cfg.Port != 2525 || cfg.From != "print@example.com" || cfg.StartTLS {
+		t.Errorf("ConfigFromEnv = %+v, %v", cfg, ok)
+	}
+}
@@ -0,0 +1,174 @@
+// Package schedule parses the five-field cron expressions used for
+// recurring print jobs.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed "minute hour day-of-month month day-of-week" expression.
+// Fields accept *, numbers, ranges (a-b), lists (a,b) and steps (*/n, a-b/n).
+// As in classic cron, when both day fields are restricted a time matches if
+// either of them does. A day field that covers its whole range, such as */1
+// or 1-31, is not restricted.
+type Cron struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// maxSearch bounds Next so impossible dates such as 31 February terminate.
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+var ErrNoNextRun = errors.New("schedule never fires")
+
+func Parse(expr string) (Cron, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return Cron{}, fmt.Errorf("cron expression needs %d fields, got %d", len(fields), len(parts))
+	}
+	var sets [5]uint64
+	for i, p := range parts {
+		set, err := parseField(p, fields[i])
+		if err != nil {
+			return Cron{}, err
+		}
+		sets[i] = set
+	}
+	// 7 is an alias for Sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+		sets[4] &^= 1 << 7
+	}
+	return Cron{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: sets[2] == fullRange(fields[2]),
+		dowStar: sets[4] == fullRange(fields[4])&^(1<<7),
+	}, nil
+}
+
+// fullRange is the set of every value of f.
+func fullRange(f field) uint64 {
+	return (1<<(f.max+1) - 1) &^ (1<<f.min - 1)
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field: %q", f.name, item)
+			}
+			rangePart, step = item[:i], n
+		}
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s field: %q", f.name, item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid %s field: %q", f.name, item)
+				}
+			} else if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s field out of range: %q", f.name, item)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first matching minute strictly after t, in t's location.
+// Fields are matched against local wall-clock time, and each wall-clock
+// minute fires at most once: times skipped when clocks go forward do not
+// fire that day, and times repeated when clocks go back fire only the first
+// time.
+func (c Cron) Next(t time.Time) (time.Time, error) {
+	start := t
+	limit := t.Add(maxSearch)
+	loc := t.Location()
+	// every step builds the next candidate from wall-clock fields rather than
+	// adding durations, so zones with half-hour offsets and DST changes land
+	// on whole local hours
+	t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, loc)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = wallClock(t.Year(), t.Month()+1, 1, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = wallClock(t.Year(), t.Month(), t.Day()+1, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0, !t.After(start):
+			// a repeated local time resolves to its first occurrence, which
+			// may be before start
+			t = wallClock(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, loc)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrNoNextRun
+}
+
+// wallClock returns the time showing the given local date and time in loc.
+// A time skipped by a DST change resolves to the first instant after the
+// change; time.Date may place it before, which would send Next backwards.
+func wallClock(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, loc)
+	want := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if got.Equal(want) {
+		return t
+	}
+	// the two offsets around the gap place the time on either side of it
+	_, offset := t.Zone()
+	if alt := want.Add(-time.Duration(offset) * time.Second).In(loc); alt.After(t) {
+		return alt
+	}
+	return t
+}
+
+func (c Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,165 @@
+package schedule
+
+import (
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"0 9 * * 1-5",
+		"*/15 8-18 * * *",
+		"0,30 * 1,15 * *",
+		"5 4 * 2/3 0",
+		"0 0 * * 7",
+		"0-59/20 0-23/6 1-31 1-12 0-7",
+	}
+	for _, expr := range valid {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Parse(%q) = %v", expr, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestNext(t *testing.T) {
+	utc := time.UTC
+	kolkata := mustLoad(t, "Asia/Kolkata")
+	kathmandu := mustLoad(t, "Asia/Kathmandu")
+	adelaide := mustLoad(t, "Australia/Adelaide")
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"0 9 * * *", time.Date(2026, 10, 19, 8, 0, 0, 0, utc), time.Date(2026, 10, 19, 9, 0, 0, 0, utc)},
+		{"0 9 * * *", time.Date(2026, 10, 19, 9, 0, 0, 0, utc), time.Date(2026, 10, 20, 9, 0, 0, 0, utc)},
+		{"0 9 * * *", time.Date(2026, 10, 19, 8, 59, 59, 0, utc), time.Date(2026, 10, 19, 9, 0, 0, 0, utc)},
+		{"*/15 * * * *", time.Date(2026, 10, 19, 8, 7, 30, 0, utc), time.Date(2026, 10, 19, 8, 15, 0, 0, utc)},
+		{"30 23 31 12 *", time.Date(2026, 10, 19, 0, 0, 0, 0, utc), time.Date(2026, 12, 31, 23, 30, 0, 0, utc)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		// 2026-10-19 is a Monday; both day fields restricted means either matches
+		{"0 8 25 * 5", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 23, 8, 0, 0, 0, utc)},
+		{"0 8 20 * 5", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 20, 8, 0, 0, 0, utc)},
+		{"0 8 * * 1-5", time.Date(2026, 10, 23, 12, 0, 0, 0, utc), time.Date(2026, 10, 26, 8, 0, 0, 0, utc)},
+		{"0 8 * * 7", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 25, 8, 0, 0, 0, utc)},
+		// a day field covering its whole range is unrestricted, so only the
+		// other one applies
+		{"0 8 */1 * 5", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 23, 8, 0, 0, 0, utc)},
+		{"0 8 1-31 * 5", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 23, 8, 0, 0, 0, utc)},
+		{"0 8 20 * 0-7", time.Date(2026, 10, 19, 12, 0, 0, 0, utc), time.Date(2026, 10, 20, 8, 0, 0, 0, utc)},
+		{"0 8 20 * 0-6", time.Date(2026, 10, 20, 12, 0, 0, 0, utc), time.Date(2026, 11, 20, 8, 0, 0, 0, utc)},
+		{"0 8 20 * */1", time.Date(2026, 10, 20, 12, 0, 0, 0, utc), time.Date(2026, 11, 20, 8, 0, 0, 0, utc)},
+		// half-hour and quarter-hour offsets
+		{"0 9 * * *", time.Date(2026, 10, 19, 10, 0, 0, 0, kolkata), time.Date(2026, 10, 20, 9, 0, 0, 0, kolkata)},
+		{"30 * * * *", time.Date(2026, 10, 19, 10, 45, 0, 0, kolkata), time.Date(2026, 10, 19, 11, 30, 0, 0, kolkata)},
+		{"0 9 * * *", time.Date(2026, 10, 19, 7, 0, 0, 0, kathmandu), time.Date(2026, 10, 19, 9, 0, 0, 0, kathmandu)},
+		{"0 9 * * *", time.Date(2026, 10, 19, 10, 0, 0, 0, adelaide), time.Date(2026, 10, 20, 9, 0, 0, 0, adelaide)},
+	}
+	for _, tt := range tests {
+		c, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		got, err := c.Next(tt.from)
+		if err != nil {
+			t.Errorf("%q.Next(%v) = %v", tt.expr, tt.from, err)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != tt.from.Location() {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextNeverFires(t *testing.T) {
+	for _, expr := range []string{"0 0 31 2 *", "0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		c, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !errors.Is(err, ErrNoNextRun) {
+			t.Errorf("%q.Next = %v, want ErrNoNextRun", expr, err)
+		}
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	adelaide := mustLoad(t, "Australia/Adelaide")
+	// clocks go from 02:00 EST to 03:00 EDT on 2026-03-08 and from 02:00 EDT
+	// back to 01:00 EST on 2026-11-01
+	firstHalfPastOne := time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC).In(ny)
+	secondHalfPastOne := time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC).In(ny)
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"daily across spring forward", "0 9 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, ny), time.Date(2026, 3, 8, 9, 0, 0, 0, ny)},
+		{"skipped hour", "30 2 * * *", time.Date(2026, 3, 7, 12, 0, 0, 0, ny), time.Date(2026, 3, 9, 2, 30, 0, 0, ny)},
+		{"hour after the gap", "0 3 * * *", time.Date(2026, 3, 8, 0, 0, 0, 0, ny), time.Date(2026, 3, 8, 3, 0, 0, 0, ny)},
+		{"hourly across the gap", "15 * * * *", time.Date(2026, 3, 8, 1, 20, 0, 0, ny), time.Date(2026, 3, 8, 3, 15, 0, 0, ny)},
+		{"daily across fall back", "0 9 * * *", time.Date(2026, 10, 31, 12, 0, 0, 0, ny), time.Date(2026, 11, 1, 9, 0, 0, 0, ny)},
+		{"repeated hour fires once", "30 1 * * *", time.Date(2026, 10, 31, 12, 0, 0, 0, ny), firstHalfPastOne},
+		{"not again in the repeat", "30 1 * * *", firstHalfPastOne, time.Date(2026, 11, 2, 1, 30, 0, 0, ny)},
+		{"from inside the repeat", "*/20 * * * *", secondHalfPastOne, time.Date(2026, 11, 1, 2, 0, 0, 0, ny)},
+		// Adelaide goes from 02:00 ACST (+9:30) to 03:00 ACDT (+10:30) on 2026-10-04
+		{"half-hour zone spring forward", "30 2 * * *", time.Date(2026, 10, 3, 12, 0, 0, 0, adelaide), time.Date(2026, 10, 5, 2, 30, 0, 0, adelaide)},
+		{"half-hour zone after the gap", "0 9 * * *", time.Date(2026, 10, 3, 12, 0, 0, 0, adelaide), time.Date(2026, 10, 4, 9, 0, 0, 0, adelaide)},
+	}
+	for _, tt := range tests {
+		c, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: Parse(%q): %v", tt.name, tt.expr, err)
+		}
+		got, err := c.Next(tt.from)
+		if err != nil {
+			t.Errorf("%s: Next = %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: %q.Next(%v) = %v, want %v", tt.name, tt.expr, tt.from, got, tt.want)
+		}
+		if !got.After(tt.from) {
+			t.Errorf("%s: Next(%v) = %v is not after it", tt.name, tt.from, got)
+		}
+	}
+}
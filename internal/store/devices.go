@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// KioskDevice is a release station bound to one printer. Only the SHA-256 of
+// its token is stored.
+type KioskDevice struct {
+	ID         int64
+	Name       string
+	PrinterURI string
+	TokenHash  string
+	CreatedAt  string
+	LastSeenAt string
+}
+
+func CreateKioskDevice(ctx context.Context, tx *sql.Tx, name string, printerURI string, tokenHash string) (KioskDevice, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO kiosk_devices (name, printer_uri, token_hash, created_at)
+		VALUES (?, ?, ?, ?)`, name, printerURI, tokenHash, nowUTC())
+	if err != nil {
+		return KioskDevice{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return KioskDevice{}, err
+	}
+	return GetKioskDeviceByID(ctx, tx, id)
+}
+
+func GetKioskDeviceByID(ctx context.Context, tx *sql.Tx, id int64) (KioskDevice, error) {
+	row := tx.QueryRowContext(ctx, `SELECT id, name, printer_uri, token_hash, created_at, last_seen_at
+		FROM kiosk_devices WHERE id = ?`, id)
+	return scanKioskDevice(row)
+}
+
+func GetKioskDeviceByTokenHash(ctx context.Context, tx *sql.Tx, tokenHash string) (KioskDevice, error) {
+	row := tx.QueryRowContext(ctx, `SELECT id, name, printer_uri, token_hash, created_at, last_seen_at
+		FROM kiosk_devices WHERE token_hash = ?`, tokenHash)
+	return scanKioskDevice(row)
+}
+
+func ListKioskDevices(ctx context.Context, tx *sql.Tx) ([]KioskDevice, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, name, printer_uri, token_hash, created_at, last_seen_at
+		FROM kiosk_devices ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []KioskDevice{}
+	for rows.Next() {
+		d, err := scanKioskDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func UpdateKioskDeviceToken(ctx context.Context, tx *sql.Tx, id int64, tokenHash string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE kiosk_devices SET token_hash = ? WHERE id = ?", tokenHash, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func TouchKioskDevice(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE kiosk_devices SET last_seen_at = ? WHERE id = ?", nowUTC(), id)
+	return err
+}
+
+func DeleteKioskDevice(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM kiosk_devices WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func scanKioskDevice(s scanner) (KioskDevice, error) {
+	var d KioskDevice
+	err := s.Scan(&d.ID, &d.Name, &d.PrinterURI, &d.TokenHash, &d.CreatedAt, &d.LastSeenAt)
+	return d, err
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Document is a file in a user's personal library. Library files live under
+// their own upload directory and are not subject to print retention.
+type Document struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Filename   string
+	StoredPath string
+	Mime       string
+	SizeBytes  int64
+	CreatedAt  string
+	UpdatedAt  string
+}
+
+const documentColumns = `id, user_id, name, filename, stored_path, mime, size_bytes, created_at, updated_at`
+
+func CreateDocument(ctx context.Context, tx *sql.Tx, doc Document) (Document, error) {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO documents (
+		user_id, name, filename, stored_path, mime, size_bytes, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		doc.UserID, doc.Name, doc.Filename, doc.StoredPath, doc.Mime, doc.SizeBytes, now, now,
+	)
+	if err != nil {
+		return Document{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Document{}, err
+	}
+	return GetDocument(ctx, tx, id)
+}
+
+func GetDocument(ctx context.Context, tx *sql.Tx, id int64) (Document, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+documentColumns+` FROM documents WHERE id = ?`, id)
+	return scanDocument(row)
+}
+
+func ListDocuments(ctx context.Context, tx *sql.Tx, userID int64) ([]Document, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+documentColumns+` FROM documents WHERE user_id = ? ORDER BY name, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []Document{}
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func SumDocumentBytes(ctx context.Context, tx *sql.Tx, userID int64) (int64, error) {
+	var total int64
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(size_bytes), 0) FROM documents WHERE user_id = ?", userID).Scan(&total)
+	return total, err
+}
+
+func RenameDocument(ctx context.Context, tx *sql.Tx, id int64, name string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE documents SET name = ?, updated_at = ? WHERE id = ?", name, nowUTC(), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func DeleteDocument(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM documents WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanDocument(s scanner) (Document, error) {
+	var doc Document
+	err := s.Scan(&doc.ID, &doc.UserID, &doc.Name, &doc.Filename, &doc.StoredPath, &doc.Mime, &doc.SizeBytes,
+		&doc.CreatedAt, &doc.UpdatedAt)
+	return doc, err
+}
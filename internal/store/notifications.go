@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+const (
+	NotificationLowBalance     = "low_balance"
+	NotificationMonthlyLimit80 = "monthly_limit_80"
+	NotificationMonthlyLimit   = "monthly_limit_100"
+)
+
+// Notification identifies a notice sent to a user, once per kind and period.
+type Notification struct {
+	UserID    int64
+	Kind      string
+	PeriodKey string
+}
+
+// MarkNotificationSent records that a notification of the given kind was sent
+// for periodKey. It returns false when the same notification was already sent.
+func MarkNotificationSent(ctx context.Context, tx *sql.Tx, userID int64, kind string, periodKey string) (bool, error) {
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO notifications (user_id, kind, period_key, sent_at)
+		VALUES (?, ?, ?, ?)`, userID, kind, periodKey, nowUTC())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UnmarkNotificationSent forgets a notification recorded by
+// MarkNotificationSent whose email could not be delivered.
+func UnmarkNotificationSent(ctx context.Context, tx *sql.Tx, userID int64, kind string, periodKey string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM notifications WHERE user_id = ? AND kind = ? AND period_key = ?", userID, kind, periodKey)
+	return err
+}
+
+func ClearNotification(ctx context.Context, tx *sql.Tx, userID int64, kind string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM notifications WHERE user_id = ? AND kind = ?", userID, kind)
+	return err
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// PrintPreset is a named set of print options. Empty strings and zero values
+// mean "not set" and leave the field to the request or the printer default.
+type PrintPreset struct {
+	ID           int64
+	UserID       int64
+	Name         string
+	PrinterURI   string
+	Sides        string
+	IsColor      bool
+	Copies       int
+	Media        string
+	NumberUp     int
+	PrintQuality string
+	IsDefault    bool
+	CreatedAt    string
+	UpdatedAt    string
+}
+
+const presetColumns = `id, user_id, name, printer_uri, sides, is_color, copies, media, number_up, print_quality,
+		is_default, created_at, updated_at`
+
+func CreatePrintPreset(ctx context.Context, tx *sql.Tx, p PrintPreset) (PrintPreset, error) {
+	if p.IsDefault {
+		if err := clearDefaultPreset(ctx, tx, p.UserID); err != nil {
+			return PrintPreset{}, err
+		}
+	}
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO print_presets (
+		user_id, name, printer_uri, sides, is_color, copies, media, number_up, print_quality,
+		is_default, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.UserID, p.Name, p.PrinterURI, p.Sides, p.IsColor, p.Copies, p.Media, p.NumberUp, p.PrintQuality,
+		p.IsDefault, now, now,
+	)
+	if err != nil {
+		return PrintPreset{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return PrintPreset{}, err
+	}
+	return GetPrintPreset(ctx, tx, id)
+}
+
+func UpdatePrintPreset(ctx context.Context, tx *sql.Tx, p PrintPreset) (PrintPreset, error) {
+	if p.IsDefault {
+		if err := clearDefaultPreset(ctx, tx, p.UserID); err != nil {
+			return PrintPreset{}, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE print_presets SET
+		name = ?, printer_uri = ?, sides = ?, is_color = ?, copies = ?, media = ?, number_up = ?,
+		print_quality = ?, is_default = ?, updated_at = ?
+		WHERE id = ? AND user_id = ?`,
+		p.Name, p.PrinterURI, p.Sides, p.IsColor, p.Copies, p.Media, p.NumberUp,
+		p.PrintQuality, p.IsDefault, nowUTC(), p.ID, p.UserID,
+	)
+	if err != nil {
+		return PrintPreset{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return PrintPreset{}, sql.ErrNoRows
+	}
+	return GetPrintPreset(ctx, tx, p.ID)
+}
+
+func GetPrintPreset(ctx context.Context, tx *sql.Tx, id int64) (PrintPreset, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+presetColumns+` FROM print_presets WHERE id = ?`, id)
+	return scanPrintPreset(row)
+}
+
+// GetDefaultPrintPreset returns sql.ErrNoRows when the user has no default.
+func GetDefaultPrintPreset(ctx context.Context, tx *sql.Tx, userID int64) (PrintPreset, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+presetColumns+` FROM print_presets WHERE user_id = ? AND is_default = 1`, userID)
+	return scanPrintPreset(row)
+}
+
+func ListPrintPresets(ctx context.Context, tx *sql.Tx, userID int64) ([]PrintPreset, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+presetColumns+` FROM print_presets WHERE user_id = ? ORDER BY name, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []PrintPreset{}
+	for rows.Next() {
+		p, err := scanPrintPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func DeletePrintPreset(ctx context.Context, tx *sql.Tx, id int64, userID int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM print_presets WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func clearDefaultPreset(ctx context.Context, tx *sql.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_presets SET is_default = 0 WHERE user_id = ?", userID)
+	return err
+}
+
+func scanPrintPreset(s scanner) (PrintPreset, error) {
+	var p PrintPreset
+	err := s.Scan(&p.ID, &p.UserID, &p.Name, &p.PrinterURI, &p.Sides, &p.IsColor, &p.Copies, &p.Media,
+		&p.NumberUp, &p.PrintQuality, &p.IsDefault, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// PrintJobFile is one part of a multi-file print job. The parts are converted
+// and merged into the job's stored file in Position order; Pages is set once
+// the part has been converted.
+type PrintJobFile struct {
+	ID         int64
+	PrintJobID int64
+	Position   int
+	Filename   string
+	StoredPath string
+	Mime       string
+	Pages      int
+}
+
+const printJobFileColumns = `id, print_job_id, position, filename, stored_path, mime, pages`
+
+func InsertPrintJobFile(ctx context.Context, tx *sql.Tx, f PrintJobFile) (int64, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO print_job_files (
+		print_job_id, position, filename, stored_path, mime, pages
+	) VALUES (?, ?, ?, ?, ?, ?)`,
+		f.PrintJobID, f.Position, f.Filename, f.StoredPath, f.Mime, f.Pages,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func ListPrintJobFiles(ctx context.Context, tx *sql.Tx, printJobID int64) ([]PrintJobFile, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+printJobFileColumns+` FROM print_job_files WHERE print_job_id = ? ORDER BY position, id`, printJobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []PrintJobFile{}
+	for rows.Next() {
+		var f PrintJobFile
+		if err := rows.Scan(&f.ID, &f.PrintJobID, &f.Position, &f.Filename, &f.StoredPath, &f.Mime, &f.Pages); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// ListPrintJobFilePathsBefore returns the part uploads of finished jobs
+// created before cutoff, so retention cleanup can remove parts that were never
+// merged.
+func ListPrintJobFilePathsBefore(ctx context.Context, tx *sql.Tx, cutoff string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT f.stored_path FROM print_job_files f
+		WHERE f.print_job_id IN (SELECT id FROM print_jobs WHERE `+finishedBefore+`)`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paths := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+func UpdatePrintJobFilePages(ctx context.Context, tx *sql.Tx, id int64, pages int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_job_files SET pages = ? WHERE id = ?", pages, id)
+	return err
+}
@@ -7,6 +7,17 @@ import (
 	"strings"
 )
 
+const (
+	PrintStatusQueued     = "queued"
+	PrintStatusProcessing = "processing"
+	PrintStatusPrinted    = "printed"
+	PrintStatusFailed     = "failed"
+	PrintStatusHeld       = "held"
+	PrintStatusExpired    = "expired"
+	PrintStatusCanceled   = "canceled"
+	PrintStatusScheduled  = "scheduled"
+)
+
 type PrintRecord struct {
 	ID                 int64
 	UserID             int64
@@ -28,11 +39,26 @@ type PrintRecord struct {
 	Sides              sql.NullString
 	Copies             int
 	PageRange          sql.NullString
+	Attempts           int
+	LastError          sql.NullString
+	HoldExpiresAt      sql.NullString
+	PrintAt            sql.NullString
+	ReprintOf          sql.NullInt64
 	CreatedAt          string
 }
 
+const printRecordColumns = `
+		p.id, p.user_id, u.username, p.printer_uri, p.filename, p.stored_path, p.pages, p.cost_cents,
+		p.balance_before_cents, p.balance_after_cents, p.month_total_cents, p.year_total_cents,
+		p.job_id, p.status, p.is_duplex, p.is_color, p.duplex, p.sides, p.copies, p.page_range,
+		p.attempts, p.last_error, p.hold_expires_at, p.print_at, p.reprint_of, p.created_at
+		FROM print_jobs p
+		JOIN users u ON u.id = p.user_id`
+
 type PrintFilter struct {
 	Username string
+	Status   string
+	Printer  string
 	StartAt  string
 	EndAt    string
 	Limit    int
@@ -42,11 +68,12 @@ func InsertPrintRecord(ctx context.Context, tx *sql.Tx, rec *PrintRecord) (int64
 	res, err := tx.ExecContext(ctx, `INSERT INTO print_jobs (
 		user_id, printer_uri, filename, stored_path, pages, cost_cents,
 		balance_before_cents, balance_after_cents, month_total_cents, year_total_cents,
-		job_id, status, is_duplex, is_color, duplex, sides, copies, page_range, created_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job_id, status, is_duplex, is_color, duplex, sides, copies, page_range, hold_expires_at, print_at, reprint_of, created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		rec.UserID, rec.PrinterURI, rec.Filename, rec.StoredPath, rec.Pages, rec.CostCents,
 		rec.BalanceBeforeCents, rec.BalanceAfterCents, rec.MonthTotalCents, rec.YearTotalCents,
-		rec.JobID, rec.Status, rec.IsDuplex, rec.IsColor, rec.Duplex, rec.Sides, rec.Copies, rec.PageRange, rec.CreatedAt,
+		rec.JobID, rec.Status, rec.IsDuplex, rec.IsColor, rec.Duplex, rec.Sides, rec.Copies, rec.PageRange,
+		rec.HoldExpiresAt, rec.PrintAt, rec.ReprintOf, rec.CreatedAt,
 	)
 	if err != nil {
 		return 0, err
@@ -54,27 +81,95 @@ func InsertPrintRecord(ctx context.Context, tx *sql.Tx, rec *PrintRecord) (int64
 	return res.LastInsertId()
 }
 
+// CountPrintRecordsByStoredPath reports how many records still use a stored
+// upload; reprints share the original record's file.
+func CountPrintRecordsByStoredPath(ctx context.Context, tx *sql.Tx, storedPath string) (int, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM print_jobs WHERE stored_path = ?", storedPath).Scan(&n)
+	return n, err
+}
+
+// finishedBefore selects records in a final state created before a cutoff.
+// Retention cleanup only removes these, never jobs that may still print.
+var finishedBefore = fmt.Sprintf("status IN ('%s', '%s', '%s', '%s') AND created_at < ?",
+	PrintStatusPrinted, PrintStatusFailed, PrintStatusCanceled, PrintStatusExpired)
+
+// ListFinishedPrintPathsBefore returns the stored uploads of finished records
+// created before cutoff.
+func ListFinishedPrintPathsBefore(ctx context.Context, tx *sql.Tx, cutoff string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT stored_path FROM print_jobs WHERE "+finishedBefore, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paths := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// DeleteFinishedPrintRecordsBefore removes finished records created before
+// cutoff, along with their queue items and parts.
+func DeleteFinishedPrintRecordsBefore(ctx context.Context, tx *sql.Tx, cutoff string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM print_jobs WHERE "+finishedBefore, cutoff)
+	return err
+}
+
 func UpdatePrintStatus(ctx context.Context, tx *sql.Tx, id int64, status string, jobID string) error {
 	_, err := tx.ExecContext(ctx, "UPDATE print_jobs SET status = ?, job_id = ? WHERE id = ?", status, jobID, id)
 	return err
 }
 
+func UpdatePrintAttempt(ctx context.Context, tx *sql.Tx, id int64, attempts int, lastError string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_jobs SET attempts = ?, last_error = ? WHERE id = ?", attempts, lastError, id)
+	return err
+}
+
+func SetReleasePinHash(ctx context.Context, tx *sql.Tx, id int64, hash string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_jobs SET release_pin_hash = ? WHERE id = ?", hash, id)
+	return err
+}
+
+func GetReleasePinHash(ctx context.Context, tx *sql.Tx, id int64) (string, error) {
+	var hash sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT release_pin_hash FROM print_jobs WHERE id = ?", id).Scan(&hash)
+	return hash.String, err
+}
+
+// ListExpiredHeldPrints returns held records whose hold expired before now.
+func ListExpiredHeldPrints(ctx context.Context, tx *sql.Tx, now string) ([]PrintRecord, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+printRecordColumns+`
+		WHERE p.status = ? AND p.hold_expires_at IS NOT NULL AND p.hold_expires_at <= ?
+		ORDER BY p.id`, PrintStatusHeld, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recs := []PrintRecord{}
+	for rows.Next() {
+		rec, err := scanPrintRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+func UpdatePrintPages(ctx context.Context, tx *sql.Tx, id int64, pages int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_jobs SET pages = ? WHERE id = ?", pages, id)
+	return err
+}
+
 func GetPrintRecordByID(ctx context.Context, tx *sql.Tx, id int64) (PrintRecord, error) {
-	row := tx.QueryRowContext(ctx, `SELECT
-		p.id, p.user_id, u.username, p.printer_uri, p.filename, p.stored_path, p.pages, p.cost_cents,
-		p.balance_before_cents, p.balance_after_cents, p.month_total_cents, p.year_total_cents,
-		p.job_id, p.status, p.is_duplex, p.is_color, p.duplex, p.sides, p.copies, p.page_range, p.created_at
-		FROM print_jobs p
-		JOIN users u ON u.id = p.user_id
+	row := tx.QueryRowContext(ctx, `SELECT `+printRecordColumns+`
 		WHERE p.id = ?`, id)
-	var rec PrintRecord
-	err := row.Scan(
-		&rec.ID, &rec.UserID, &rec.Username, &rec.PrinterURI, &rec.Filename, &rec.StoredPath,
-		&rec.Pages, &rec.CostCents, &rec.BalanceBeforeCents, &rec.BalanceAfterCents,
-		&rec.MonthTotalCents, &rec.YearTotalCents, &rec.JobID, &rec.Status, &rec.IsDuplex, &rec.IsColor,
-		&rec.Duplex, &rec.Sides, &rec.Copies, &rec.PageRange, &rec.CreatedAt,
-	)
-	return rec, err
+	return scanPrintRecord(row)
 }
 
 func ListPrintRecords(ctx context.Context, tx *sql.Tx, filter PrintFilter) ([]PrintRecord, error) {
@@ -84,6 +179,14 @@ func ListPrintRecords(ctx context.Context, tx *sql.Tx, filter PrintFilter) ([]Pr
 		conds = append(conds, "u.username = ?")
 		args = append(args, filter.Username)
 	}
+	if filter.Status != "" {
+		conds = append(conds, "p.status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Printer != "" {
+		conds = append(conds, "p.printer_uri = ?")
+		args = append(args, filter.Printer)
+	}
 	if filter.StartAt != "" {
 		conds = append(conds, "p.created_at >= ?")
 		args = append(args, filter.StartAt)
@@ -92,14 +195,9 @@ func ListPrintRecords(ctx context.Context, tx *sql.Tx, filter PrintFilter) ([]Pr
 		conds = append(conds, "p.created_at <= ?")
 		args = append(args, filter.EndAt)
 	}
-	query := fmt.Sprintf(`SELECT
-		p.id, p.user_id, u.username, p.printer_uri, p.filename, p.stored_path, p.pages, p.cost_cents,
-		p.balance_before_cents, p.balance_after_cents, p.month_total_cents, p.year_total_cents,
-		p.job_id, p.status, p.is_duplex, p.is_color, p.duplex, p.sides, p.copies, p.page_range, p.created_at
-		FROM print_jobs p
-		JOIN users u ON u.id = p.user_id
+	query := fmt.Sprintf(`SELECT %s
 		WHERE %s
-		ORDER BY p.id DESC`, strings.Join(conds, " AND "))
+		ORDER BY p.id DESC`, printRecordColumns, strings.Join(conds, " AND "))
 	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -107,13 +205,7 @@ func ListPrintRecords(ctx context.Context, tx *sql.Tx, filter PrintFilter) ([]Pr
 	defer rows.Close()
 	recs := []PrintRecord{}
 	for rows.Next() {
-		var rec PrintRecord
-		err := rows.Scan(
-			&rec.ID, &rec.UserID, &rec.Username, &rec.PrinterURI, &rec.Filename, &rec.StoredPath,
-			&rec.Pages, &rec.CostCents, &rec.BalanceBeforeCents, &rec.BalanceAfterCents,
-			&rec.MonthTotalCents, &rec.YearTotalCents, &rec.JobID, &rec.Status, &rec.IsDuplex, &rec.IsColor,
-			&rec.Duplex, &rec.Sides, &rec.Copies, &rec.PageRange, &rec.CreatedAt,
-		)
+		rec, err := scanPrintRecord(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -121,3 +213,15 @@ func ListPrintRecords(ctx context.Context, tx *sql.Tx, filter PrintFilter) ([]Pr
 	}
 	return recs, nil
 }
+
+func scanPrintRecord(s scanner) (PrintRecord, error) {
+	var rec PrintRecord
+	err := s.Scan(
+		&rec.ID, &rec.UserID, &rec.Username, &rec.PrinterURI, &rec.Filename, &rec.StoredPath,
+		&rec.Pages, &rec.CostCents, &rec.BalanceBeforeCents, &rec.BalanceAfterCents,
+		&rec.MonthTotalCents, &rec.YearTotalCents, &rec.JobID, &rec.Status, &rec.IsDuplex, &rec.IsColor,
+		&rec.Duplex, &rec.Sides, &rec.Copies, &rec.PageRange, &rec.Attempts, &rec.LastError, &rec.HoldExpiresAt,
+		&rec.PrintAt, &rec.ReprintOf, &rec.CreatedAt,
+	)
+	return rec, err
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+const (
+	QueuePending = "pending"
+	QueueRunning = "running"
+	QueueDone    = "done"
+	QueueFailed  = "failed"
+	// QueueHeld items wait for an explicit release before workers see them.
+	QueueHeld = "held"
+)
+
+// QueueItem is a print job waiting for (or being processed by) a worker.
+// Options holds the JSON-encoded submission options owned by the caller.
+type QueueItem struct {
+	ID        int64
+	RecordID  int64
+	State     string
+	Options   string
+	Attempts  int
+	RunAfter  string
+	LastError string
+	// RetryUntil is set on the first transient failure; retries stop after it.
+	RetryUntil string
+	// SentAt is set just before the document is sent to the printer and
+	// cleared when the attempt is retried.
+	SentAt    string
+	CreatedAt string
+	UpdatedAt string
+}
+
+func EnqueuePrintJob(ctx context.Context, tx *sql.Tx, recordID int64, state string, options string, runAfter string) (int64, error) {
+	now := nowUTC()
+	if runAfter == "" {
+		runAfter = now
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO print_queue (
+		record_id, state, options, attempts, run_after, last_error, created_at, updated_at
+	) VALUES (?, ?, ?, 0, ?, '', ?, ?)`, recordID, state, options, runAfter, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ClaimNextPrintJob marks the oldest due pending item as running and returns
+// it. It returns sql.ErrNoRows when nothing is due.
+func ClaimNextPrintJob(ctx context.Context, tx *sql.Tx, now string) (QueueItem, error) {
+	row := tx.QueryRowContext(ctx, `SELECT
+		id, record_id, state, options, attempts, run_after, last_error, retry_until, sent_at, created_at, updated_at
+		FROM print_queue
+		WHERE state = ? AND run_after <= ?
+		ORDER BY run_after, id
+		LIMIT 1`, QueuePending, now)
+	item, err := scanQueueItem(row)
+	if err != nil {
+		return QueueItem{}, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE print_queue SET state = ?, updated_at = ? WHERE id = ? AND state = ?",
+		QueueRunning, nowUTC(), item.ID, QueuePending)
+	if err != nil {
+		return QueueItem{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return QueueItem{}, sql.ErrNoRows
+	}
+	item.State = QueueRunning
+	return item, nil
+}
+
+func GetQueueItemByRecordID(ctx context.Context, tx *sql.Tx, recordID int64) (QueueItem, error) {
+	row := tx.QueryRowContext(ctx, `SELECT
+		id, record_id, state, options, attempts, run_after, last_error, retry_until, sent_at, created_at, updated_at
+		FROM print_queue WHERE record_id = ?`, recordID)
+	return scanQueueItem(row)
+}
+
+// RetryQueueItem returns a running item to the pending state to be tried
+// again at runAfter. The caller has established that the failed attempt never
+// reached the printer.
+func RetryQueueItem(ctx context.Context, tx *sql.Tx, id int64, attempts int, runAfter string, retryUntil string, lastError string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE print_queue SET
+		state = ?, attempts = ?, run_after = ?, retry_until = ?, last_error = ?, sent_at = '', updated_at = ?
+		WHERE id = ?`, QueuePending, attempts, runAfter, retryUntil, lastError, nowUTC(), id)
+	return err
+}
+
+// ReleaseHeldPrintJob moves a held item into the pending state and marks its
+// record queued. It returns sql.ErrNoRows when the record is not held.
+func ReleaseHeldPrintJob(ctx context.Context, tx *sql.Tx, recordID int64) error {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, "UPDATE print_queue SET state = ?, run_after = ?, updated_at = ? WHERE record_id = ? AND state = ?",
+		QueuePending, now, now, recordID, QueueHeld)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE print_jobs SET status = ? WHERE id = ?", PrintStatusQueued, recordID)
+	return err
+}
+
+// ClosePrintJob fails a queue item that is still in the given state. It
+// returns sql.ErrNoRows when a worker or another request got to it first.
+func ClosePrintJob(ctx context.Context, tx *sql.Tx, recordID int64, fromState string, lastError string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE print_queue SET state = ?, last_error = ?, updated_at = ? WHERE record_id = ? AND state = ?",
+		QueueFailed, lastError, nowUTC(), recordID, fromState)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReschedulePrintJob moves a scheduled job that has not started yet to a new
+// print time.
+func ReschedulePrintJob(ctx context.Context, tx *sql.Tx, recordID int64, printAt string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE print_queue SET run_after = ?, updated_at = ? WHERE record_id = ? AND state = ?",
+		printAt, nowUTC(), recordID, QueuePending)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE print_jobs SET print_at = ? WHERE id = ?", printAt, recordID)
+	return err
+}
+
+func FinishQueueItem(ctx context.Context, tx *sql.Tx, id int64, state string, lastError string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE print_queue SET state = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		state, lastError, nowUTC(), id)
+	return err
+}
+
+// MarkQueueItemSent records that the item is about to be sent to the printer,
+// so an interrupted attempt is not sent a second time after a restart.
+func MarkQueueItemSent(ctx context.Context, tx *sql.Tx, id int64) error {
+	now := nowUTC()
+	_, err := tx.ExecContext(ctx, "UPDATE print_queue SET sent_at = ?, updated_at = ? WHERE id = ?", now, now, id)
+	return err
+}
+
+// ResetRunningPrintJobs puts items left running by a previous process back in
+// the pending state so they are picked up again after a restart. Items that
+// may already have reached the printer are left running; see
+// ListSentRunningPrintJobs.
+func ResetRunningPrintJobs(ctx context.Context, tx *sql.Tx) (int64, error) {
+	if _, err := tx.ExecContext(ctx, `UPDATE print_jobs SET status = ?
+		WHERE id IN (SELECT record_id FROM print_queue WHERE state = ? AND sent_at = '')`, PrintStatusQueued, QueueRunning); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE print_queue SET state = ?, updated_at = ? WHERE state = ? AND sent_at = ''",
+		QueuePending, nowUTC(), QueueRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListSentRunningPrintJobs returns the items a previous process left running
+// after it started sending them to the printer.
+func ListSentRunningPrintJobs(ctx context.Context, tx *sql.Tx) ([]QueueItem, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT
+		id, record_id, state, options, attempts, run_after, last_error, retry_until, sent_at, created_at, updated_at
+		FROM print_queue WHERE state = ? AND sent_at != '' ORDER BY id`, QueueRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []QueueItem
+	for rows.Next() {
+		item, err := scanQueueItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func CountPendingPrintJobs(ctx context.Context, tx *sql.Tx) (int, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(1) FROM print_queue WHERE state IN (?, ?)", QueuePending, QueueRunning).Scan(&n)
+	return n, err
+}
+
+func scanQueueItem(s scanner) (QueueItem, error) {
+	var item QueueItem
+	err := s.Scan(&item.ID, &item.RecordID, &item.State, &item.Options, &item.Attempts,
+		&item.RunAfter, &item.LastError, &item.RetryUntil, &item.SentAt, &item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+const (
+	RecurringRunSubmitted = "submitted"
+	RecurringRunFailed    = "failed"
+)
+
+// RecurringPrint is a stored document that is printed on a cron schedule.
+type RecurringPrint struct {
+	ID         int64
+	UserID     int64
+	Username   string
+	Name       string
+	PrinterURI string
+	Filename   string
+	StoredPath string
+	Sides      string
+	IsColor    bool
+	Copies     int
+	PageRange  string
+	Options    string
+	Schedule   string
+	Enabled    bool
+	NextRunAt  string
+	LastRunAt  string
+	CreatedAt  string
+	UpdatedAt  string
+}
+
+type RecurringRun struct {
+	ID          int64
+	RecurringID int64
+	RecordID    sql.NullInt64
+	Status      string
+	Error       string
+	RunAt       string
+}
+
+const recurringColumns = `
+		r.id, r.user_id, u.username, r.name, r.printer_uri, r.filename, r.stored_path,
+		r.sides, r.is_color, r.copies, r.page_range, r.options, r.schedule, r.enabled,
+		r.next_run_at, r.last_run_at, r.created_at, r.updated_at
+		FROM recurring_prints r
+		JOIN users u ON u.id = r.user_id`
+
+func CreateRecurringPrint(ctx context.Context, tx *sql.Tx, rp RecurringPrint) (RecurringPrint, error) {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO recurring_prints (
+		user_id, name, printer_uri, filename, stored_path, sides, is_color, copies, page_range,
+		options, schedule, enabled, next_run_at, last_run_at, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?)`,
+		rp.UserID, rp.Name, rp.PrinterURI, rp.Filename, rp.StoredPath, rp.Sides, rp.IsColor, rp.Copies, rp.PageRange,
+		rp.Options, rp.Schedule, rp.Enabled, rp.NextRunAt, now, now,
+	)
+	if err != nil {
+		return RecurringPrint{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return RecurringPrint{}, err
+	}
+	return GetRecurringPrint(ctx, tx, id)
+}
+
+// UpdateRecurringPrint changes the schedule and print options; the stored
+// document stays the same.
+func UpdateRecurringPrint(ctx context.Context, tx *sql.Tx, rp RecurringPrint) (RecurringPrint, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE recurring_prints SET
+		name = ?, printer_uri = ?, sides = ?, is_color = ?, copies = ?, page_range = ?,
+		options = ?, schedule = ?, enabled = ?, next_run_at = ?, updated_at = ?
+		WHERE id = ?`,
+		rp.Name, rp.PrinterURI, rp.Sides, rp.IsColor, rp.Copies, rp.PageRange,
+		rp.Options, rp.Schedule, rp.Enabled, rp.NextRunAt, nowUTC(), rp.ID,
+	)
+	if err != nil {
+		return RecurringPrint{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return RecurringPrint{}, sql.ErrNoRows
+	}
+	return GetRecurringPrint(ctx, tx, rp.ID)
+}
+
+func GetRecurringPrint(ctx context.Context, tx *sql.Tx, id int64) (RecurringPrint, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+recurringColumns+` WHERE r.id = ?`, id)
+	return scanRecurringPrint(row)
+}
+
+func ListRecurringPrints(ctx context.Context, tx *sql.Tx, userID int64) ([]RecurringPrint, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+recurringColumns+` WHERE r.user_id = ? ORDER BY r.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return collectRecurringPrints(rows)
+}
+
+// ListDueRecurringPrints returns enabled schedules whose next run is at or
+// before now.
+func ListDueRecurringPrints(ctx context.Context, tx *sql.Tx, now string) ([]RecurringPrint, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+recurringColumns+`
+		WHERE r.enabled = 1 AND r.next_run_at <> '' AND r.next_run_at <= ?
+		ORDER BY r.next_run_at, r.id`, now)
+	if err != nil {
+		return nil, err
+	}
+	return collectRecurringPrints(rows)
+}
+
+// AdvanceRecurringPrint records that a run happened and moves the schedule to
+// its next run time.
+func AdvanceRecurringPrint(ctx context.Context, tx *sql.Tx, id int64, lastRunAt string, nextRunAt string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE recurring_prints SET last_run_at = ?, next_run_at = ?, updated_at = ? WHERE id = ?",
+		lastRunAt, nextRunAt, nowUTC(), id)
+	return err
+}
+
+func DeleteRecurringPrint(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM recurring_prints WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func InsertRecurringRun(ctx context.Context, tx *sql.Tx, recurringID int64, recordID int64, status string, runErr string, runAt string) error {
+	rec := sql.NullInt64{Int64: recordID, Valid: recordID > 0}
+	_, err := tx.ExecContext(ctx, `INSERT INTO recurring_runs (recurring_id, record_id, status, error, run_at)
+		VALUES (?, ?, ?, ?, ?)`, recurringID, rec, status, runErr, runAt)
+	return err
+}
+
+func ListRecurringRuns(ctx context.Context, tx *sql.Tx, recurringID int64, limit int) ([]RecurringRun, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, recurring_id, record_id, status, error, run_at
+		FROM recurring_runs WHERE recurring_id = ? ORDER BY id DESC LIMIT ?`, recurringID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []RecurringRun{}
+	for rows.Next() {
+		var run RecurringRun
+		if err := rows.Scan(&run.ID, &run.RecurringID, &run.RecordID, &run.Status, &run.Error, &run.RunAt); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func collectRecurringPrints(rows *sql.Rows) ([]RecurringPrint, error) {
+	defer rows.Close()
+	list := []RecurringPrint{}
+	for rows.Next() {
+		rp, err := scanRecurringPrint(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rp)
+	}
+	return list, rows.Err()
+}
+
+func scanRecurringPrint(s scanner) (RecurringPrint, error) {
+	var rp RecurringPrint
+	err := s.Scan(
+		&rp.ID, &rp.UserID, &rp.Username, &rp.Name, &rp.PrinterURI, &rp.Filename, &rp.StoredPath,
+		&rp.Sides, &rp.IsColor, &rp.Copies, &rp.PageRange, &rp.Options, &rp.Schedule, &rp.Enabled,
+		&rp.NextRunAt, &rp.LastRunAt, &rp.CreatedAt, &rp.UpdatedAt,
+	)
+	return rp, err
+}
@@ -26,3 +26,20 @@ func SetSettingInt(ctx context.Context, tx *sql.Tx, key string, value int64) err
 	_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO settings(key, value) VALUES (?, ?)", key, strconv.FormatInt(value, 10))
 	return err
 }
+
+func GetSetting(ctx context.Context, tx *sql.Tx, key string, defaultVal string) (string, error) {
+	var value string
+	err := tx.QueryRowContext(ctx, "SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return defaultVal, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func SetSetting(ctx context.Context, tx *sql.Tx, key string, value string) error {
+	_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO settings(key, value) VALUES (?, ?)", key, value)
+	return err
+}
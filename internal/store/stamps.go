@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// StampTemplate is text stamped on every printed page. Header and Footer are
+// single lines at the top and bottom of the page; Watermark is drawn large
+// and diagonally. An empty PrinterURI applies the template to all printers.
+type StampTemplate struct {
+	ID         int64
+	Name       string
+	PrinterURI string
+	Header     string
+	Footer     string
+	Watermark  string
+	FontSize   float64
+	Enabled    bool
+	CreatedAt  string
+	UpdatedAt  string
+}
+
+type StampTemplateInput struct {
+	Name       string
+	PrinterURI string
+	Header     string
+	Footer     string
+	Watermark  string
+	FontSize   float64
+	Enabled    bool
+}
+
+const stampTemplateColumns = `id, name, printer_uri, header, footer, watermark, font_size, enabled, created_at, updated_at`
+
+func CreateStampTemplate(ctx context.Context, tx *sql.Tx, input StampTemplateInput) (StampTemplate, error) {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO stamp_templates (
+		name, printer_uri, header, footer, watermark, font_size, enabled, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		input.Name, input.PrinterURI, input.Header, input.Footer, input.Watermark, input.FontSize, input.Enabled, now, now,
+	)
+	if err != nil {
+		return StampTemplate{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return StampTemplate{}, err
+	}
+	return GetStampTemplate(ctx, tx, id)
+}
+
+func UpdateStampTemplate(ctx context.Context, tx *sql.Tx, id int64, input StampTemplateInput) (StampTemplate, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE stamp_templates SET
+		name = ?, printer_uri = ?, header = ?, footer = ?, watermark = ?, font_size = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`,
+		input.Name, input.PrinterURI, input.Header, input.Footer, input.Watermark, input.FontSize, input.Enabled, nowUTC(), id,
+	)
+	if err != nil {
+		return StampTemplate{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return StampTemplate{}, sql.ErrNoRows
+	}
+	return GetStampTemplate(ctx, tx, id)
+}
+
+func GetStampTemplate(ctx context.Context, tx *sql.Tx, id int64) (StampTemplate, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+stampTemplateColumns+` FROM stamp_templates WHERE id = ?`, id)
+	return scanStampTemplate(row)
+}
+
+func ListStampTemplates(ctx context.Context, tx *sql.Tx) ([]StampTemplate, error) {
+	return queryStampTemplates(ctx, tx, `SELECT `+stampTemplateColumns+` FROM stamp_templates ORDER BY name, id`)
+}
+
+// ListStampTemplatesForPrinter returns the enabled templates that apply to
+// the printer: global ones first, then the printer's own.
+func ListStampTemplatesForPrinter(ctx context.Context, tx *sql.Tx, printerURI string) ([]StampTemplate, error) {
+	return queryStampTemplates(ctx, tx, `SELECT `+stampTemplateColumns+` FROM stamp_templates
+		WHERE enabled = 1 AND (printer_uri = '' OR printer_uri = ?)
+		ORDER BY printer_uri <> '', id`, printerURI)
+}
+
+func DeleteStampTemplate(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM stamp_templates WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func queryStampTemplates(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]StampTemplate, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []StampTemplate{}
+	for rows.Next() {
+		t, err := scanStampTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func scanStampTemplate(s scanner) (StampTemplate, error) {
+	var t StampTemplate
+	var enabled int
+	err := s.Scan(&t.ID, &t.Name, &t.PrinterURI, &t.Header, &t.Footer, &t.Watermark, &t.FontSize, &enabled, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return StampTemplate{}, err
+	}
+	t.Enabled = enabled != 0
+	return t, nil
+}
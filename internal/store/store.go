@@ -17,20 +17,34 @@ const (
 )
 
 const (
-	SettingPerPageCents   = "per_page_cents"
-	SettingColorPageCents = "color_page_cents"
-	SettingRetentionDays  = "retention_days"
+	SettingPerPageCents      = "per_page_cents"
+	SettingColorPageCents    = "color_page_cents"
+	SettingRetentionDays     = "retention_days"
+	SettingLowBalanceCents   = "low_balance_cents"
+	SettingPrintRetryMinutes = "print_retry_minutes"
+	SettingHoldExpiryHours   = "hold_expiry_hours"
+	SettingPinSecret         = "pin_secret"
+	SettingLibraryQuotaBytes = "library_quota_bytes"
 )
 
 const DefaultPerPageCents = 10
 const DefaultColorPageCents = 30
+const DefaultPrintRetryMinutes = 30
+const DefaultHoldExpiryHours = 24
+const DefaultLibraryQuotaBytes = 100 << 20
 
 type Store struct {
 	DB *sql.DB
 }
 
 func Open(ctx context.Context, path string) (*Store, error) {
-	db, err := sql.Open("sqlite", path)
+	// foreign_keys and busy_timeout are per connection, so they go in the DSN
+	// to reach every connection in the pool
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", path+sep+"_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
@@ -41,14 +55,6 @@ func Open(ctx context.Context, path string) (*Store, error) {
 		db.Close()
 		return nil, fmt.Errorf("set journal_mode: %w", err)
 	}
-	if _, err := db.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("set foreign_keys: %w", err)
-	}
-	if _, err := db.ExecContext(ctx, "PRAGMA busy_timeout = 5000"); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("set busy_timeout: %w", err)
-	}
 
 	s := &Store{DB: db}
 	if err := s.migrate(ctx); err != nil {
@@ -145,6 +151,156 @@ func (s *Store) migrate(ctx context.Context) error {
 			print_content TEXT,
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			period_key TEXT NOT NULL,
+			sent_at TEXT NOT NULL,
+			UNIQUE(user_id, kind, period_key),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '',
+			enabled INTEGER NOT NULL DEFAULT 1,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TEXT NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			response_status INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL,
+			delivered_at TEXT,
+			FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`,
+		`CREATE TABLE IF NOT EXISTS print_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			record_id INTEGER NOT NULL UNIQUE,
+			state TEXT NOT NULL,
+			options TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			run_after TEXT NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY(record_id) REFERENCES print_jobs(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_print_queue_due ON print_queue(state, run_after)`,
+		`CREATE TABLE IF NOT EXISTS recurring_prints (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			printer_uri TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			stored_path TEXT NOT NULL,
+			sides TEXT NOT NULL DEFAULT '',
+			is_color INTEGER NOT NULL DEFAULT 0,
+			copies INTEGER NOT NULL DEFAULT 1,
+			page_range TEXT NOT NULL DEFAULT '',
+			options TEXT NOT NULL DEFAULT '{}',
+			schedule TEXT NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 1,
+			next_run_at TEXT NOT NULL DEFAULT '',
+			last_run_at TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recurring_prints_due ON recurring_prints(enabled, next_run_at)`,
+		`CREATE TABLE IF NOT EXISTS recurring_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			recurring_id INTEGER NOT NULL,
+			record_id INTEGER,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			run_at TEXT NOT NULL,
+			FOREIGN KEY(recurring_id) REFERENCES recurring_prints(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recurring_runs_recurring ON recurring_runs(recurring_id)`,
+		`CREATE TABLE IF NOT EXISTS documents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			stored_path TEXT NOT NULL,
+			mime TEXT NOT NULL DEFAULT '',
+			size_bytes INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_documents_user ON documents(user_id)`,
+		`CREATE TABLE IF NOT EXISTS templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			filename TEXT NOT NULL,
+			stored_path TEXT NOT NULL,
+			mime TEXT NOT NULL DEFAULT '',
+			pages INTEGER NOT NULL DEFAULT 0,
+			groups TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS print_presets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			printer_uri TEXT NOT NULL DEFAULT '',
+			sides TEXT NOT NULL DEFAULT '',
+			is_color INTEGER NOT NULL DEFAULT 0,
+			copies INTEGER NOT NULL DEFAULT 0,
+			media TEXT NOT NULL DEFAULT '',
+			number_up INTEGER NOT NULL DEFAULT 0,
+			print_quality TEXT NOT NULL DEFAULT '',
+			is_default INTEGER NOT NULL DEFAULT 0,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_print_presets_user ON print_presets(user_id)`,
+		`CREATE TABLE IF NOT EXISTS print_job_files (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			print_job_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			filename TEXT NOT NULL,
+			stored_path TEXT NOT NULL,
+			mime TEXT NOT NULL DEFAULT '',
+			pages INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(print_job_id) REFERENCES print_jobs(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_print_job_files_job ON print_job_files(print_job_id)`,
+		`CREATE TABLE IF NOT EXISTS stamp_templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			printer_uri TEXT NOT NULL DEFAULT '',
+			header TEXT NOT NULL DEFAULT '',
+			footer TEXT NOT NULL DEFAULT '',
+			watermark TEXT NOT NULL DEFAULT '',
+			font_size REAL NOT NULL DEFAULT 8,
+			enabled INTEGER NOT NULL DEFAULT 1,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS kiosk_devices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			printer_uri TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TEXT NOT NULL,
+			last_seen_at TEXT NOT NULL DEFAULT ''
+		)`,
 	}
 
 	for _, stmt := range stmts {
@@ -173,11 +329,59 @@ func (s *Store) migrate(ctx context.Context) error {
 	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "duplex TEXT"); err != nil {
 		return fmt.Errorf("migrate: %w", err)
 	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "attempts INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "last_error TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_queue", "retry_until TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_queue", "sent_at TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "release_pin_hash TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "hold_expires_at TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "print_at TEXT"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "print_jobs", "reprint_of INTEGER"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if _, err := s.DB.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_print_jobs_stored_path ON print_jobs(stored_path)`); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "users", "user_group TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "users", "pin_hash TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := addColumnIfMissing(ctx, s.DB, "users", "card_number TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	for _, stmt := range []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_pin_hash ON users(pin_hash) WHERE pin_hash <> ''`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_card_number ON users(card_number) WHERE card_number <> ''`,
+	} {
+		if _, err := s.DB.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
 
-	if _, err := s.DB.ExecContext(ctx, `INSERT OR IGNORE INTO settings(key, value) VALUES (?, ?), (?, ?), (?, ?)`,
+	if _, err := s.DB.ExecContext(ctx, `INSERT OR IGNORE INTO settings(key, value) VALUES (?, ?), (?, ?), (?, ?), (?, ?), (?, ?), (?, ?), (?, ?)`,
 		SettingPerPageCents, strconv.Itoa(DefaultPerPageCents),
 		SettingColorPageCents, strconv.Itoa(DefaultColorPageCents),
 		SettingRetentionDays, "0",
+		SettingLowBalanceCents, "0",
+		SettingPrintRetryMinutes, strconv.Itoa(DefaultPrintRetryMinutes),
+		SettingHoldExpiryHours, strconv.Itoa(DefaultHoldExpiryHours),
+		SettingLibraryQuotaBytes, strconv.Itoa(DefaultLibraryQuotaBytes),
 	); err != nil {
 		return fmt.Errorf("seed settings: %w", err)
 	}
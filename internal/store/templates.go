@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Template is an organization-wide document published by an admin. Groups
+// restricts visibility to users in one of the listed groups; an empty list
+// means everyone can see it.
+type Template struct {
+	ID          int64
+	Name        string
+	Description string
+	Filename    string
+	StoredPath  string
+	Mime        string
+	Pages       int
+	Groups      []string
+	CreatedAt   string
+	UpdatedAt   string
+}
+
+// VisibleTo reports whether a user in the given group may use the template.
+func (t Template) VisibleTo(group string) bool {
+	if len(t.Groups) == 0 {
+		return true
+	}
+	for _, g := range t.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+const templateColumns = `id, name, description, filename, stored_path, mime, pages, groups, created_at, updated_at`
+
+func CreateTemplate(ctx context.Context, tx *sql.Tx, t Template) (Template, error) {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO templates (
+		name, description, filename, stored_path, mime, pages, groups, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Name, t.Description, t.Filename, t.StoredPath, t.Mime, t.Pages, strings.Join(t.Groups, ","), now, now,
+	)
+	if err != nil {
+		return Template{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Template{}, err
+	}
+	return GetTemplate(ctx, tx, id)
+}
+
+func UpdateTemplate(ctx context.Context, tx *sql.Tx, id int64, name string, description string, groups []string) (Template, error) {
+	res, err := tx.ExecContext(ctx, "UPDATE templates SET name = ?, description = ?, groups = ?, updated_at = ? WHERE id = ?",
+		name, description, strings.Join(groups, ","), nowUTC(), id)
+	if err != nil {
+		return Template{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return Template{}, sql.ErrNoRows
+	}
+	return GetTemplate(ctx, tx, id)
+}
+
+func GetTemplate(ctx context.Context, tx *sql.Tx, id int64) (Template, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+templateColumns+` FROM templates WHERE id = ?`, id)
+	return scanTemplate(row)
+}
+
+func ListTemplates(ctx context.Context, tx *sql.Tx) ([]Template, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+templateColumns+` FROM templates ORDER BY name, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func DeleteTemplate(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM templates WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanTemplate(s scanner) (Template, error) {
+	var t Template
+	var groups string
+	err := s.Scan(&t.ID, &t.Name, &t.Description, &t.Filename, &t.StoredPath, &t.Mime, &t.Pages, &groups,
+		&t.CreatedAt, &t.UpdatedAt)
+	if groups != "" {
+		t.Groups = strings.Split(groups, ",")
+	}
+	return t, err
+}
@@ -44,6 +44,21 @@ func InsertTopup(ctx context.Context, tx *sql.Tx, userID int64, amountCents int6
 	return res.LastInsertId()
 }
 
+func GetTopupByID(ctx context.Context, tx *sql.Tx, id int64) (TopupRecord, error) {
+	row := tx.QueryRowContext(ctx, `SELECT
+		t.id, t.user_id, u.username, t.amount_cents, t.balance_before_cents, t.balance_after_cents,
+		t.type, t.operator_user_id, t.operator_name, t.created_at
+		FROM topups t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.id = ?`, id)
+	var rec TopupRecord
+	err := row.Scan(
+		&rec.ID, &rec.UserID, &rec.Username, &rec.AmountCents, &rec.BalanceBeforeCents, &rec.BalanceAfterCents,
+		&rec.Type, &rec.OperatorUserID, &rec.OperatorName, &rec.CreatedAt,
+	)
+	return rec, err
+}
+
 func ListTopups(ctx context.Context, tx *sql.Tx, filter TopupFilter) ([]TopupRecord, error) {
 	args := []interface{}{}
 	conds := []string{"1=1"}
@@ -28,6 +28,9 @@ type User struct {
 	LastDailyTopup    string
 	LastMonthlyTopup  string
 	LastYearlyTopup   string
+	PinHash           string
+	CardNumber        string
+	Group             string
 	CreatedAt         string
 	UpdatedAt         string
 }
@@ -46,6 +49,7 @@ type CreateUserInput struct {
 	YearlyTopupCents  int64
 	MonthlyLimitCents int64
 	YearlyLimitCents  int64
+	Group             string
 }
 
 type UpdateUserInput struct {
@@ -61,8 +65,17 @@ type UpdateUserInput struct {
 	YearlyTopupCents  int64
 	MonthlyLimitCents int64
 	YearlyLimitCents  int64
+	// Group is left unchanged when nil.
+	Group *string
 }
 
+const userColumns = `
+		id, username, password_hash, role, protected, contact_name, phone, email,
+		balance_cents, daily_topup_cents, monthly_topup_cents, yearly_topup_cents,
+		monthly_limit_cents, yearly_limit_cents, month_spent_cents, year_spent_cents,
+		month_period, year_period, last_daily_topup, last_monthly_topup, last_yearly_topup,
+		pin_hash, card_number, user_group, created_at, updated_at`
+
 func CountUsers(ctx context.Context, tx *sql.Tx) (int, error) {
 	var count int
 	if err := tx.QueryRowContext(ctx, "SELECT COUNT(1) FROM users").Scan(&count); err != nil {
@@ -72,34 +85,47 @@ func CountUsers(ctx context.Context, tx *sql.Tx) (int, error) {
 }
 
 func GetUserByUsername(ctx context.Context, tx *sql.Tx, username string) (User, error) {
-	row := tx.QueryRowContext(ctx, `SELECT
-		id, username, password_hash, role, protected, contact_name, phone, email,
-		balance_cents, daily_topup_cents, monthly_topup_cents, yearly_topup_cents,
-		monthly_limit_cents, yearly_limit_cents, month_spent_cents, year_spent_cents,
-		month_period, year_period, last_daily_topup, last_monthly_topup, last_yearly_topup,
-		created_at, updated_at
+	row := tx.QueryRowContext(ctx, `SELECT `+userColumns+`
 		FROM users WHERE username = ?`, username)
 	return scanUser(row)
 }
 
 func GetUserByID(ctx context.Context, tx *sql.Tx, id int64) (User, error) {
-	row := tx.QueryRowContext(ctx, `SELECT
-		id, username, password_hash, role, protected, contact_name, phone, email,
-		balance_cents, daily_topup_cents, monthly_topup_cents, yearly_topup_cents,
-		monthly_limit_cents, yearly_limit_cents, month_spent_cents, year_spent_cents,
-		month_period, year_period, last_daily_topup, last_monthly_topup, last_yearly_topup,
-		created_at, updated_at
+	row := tx.QueryRowContext(ctx, `SELECT `+userColumns+`
 		FROM users WHERE id = ?`, id)
 	return scanUser(row)
 }
 
+func GetUserByPinHash(ctx context.Context, tx *sql.Tx, pinHash string) (User, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+userColumns+`
+		FROM users WHERE pin_hash = ? AND pin_hash <> ''`, pinHash)
+	return scanUser(row)
+}
+
+func GetUserByCardNumber(ctx context.Context, tx *sql.Tx, cardNumber string) (User, error) {
+	row := tx.QueryRowContext(ctx, `SELECT `+userColumns+`
+		FROM users WHERE card_number = ? AND card_number <> ''`, cardNumber)
+	return scanUser(row)
+}
+
+// SetUserCredentials updates the kiosk PIN hash and card number. A nil
+// value leaves that credential unchanged; an empty string clears it.
+func SetUserCredentials(ctx context.Context, tx *sql.Tx, id int64, pinHash *string, cardNumber *string) error {
+	if pinHash != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET pin_hash = ?, updated_at = ? WHERE id = ?", *pinHash, nowUTC(), id); err != nil {
+			return err
+		}
+	}
+	if cardNumber != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET card_number = ?, updated_at = ? WHERE id = ?", *cardNumber, nowUTC(), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ListUsers(ctx context.Context, tx *sql.Tx) ([]User, error) {
-	rows, err := tx.QueryContext(ctx, `SELECT
-		id, username, password_hash, role, protected, contact_name, phone, email,
-		balance_cents, daily_topup_cents, monthly_topup_cents, yearly_topup_cents,
-		monthly_limit_cents, yearly_limit_cents, month_spent_cents, year_spent_cents,
-		month_period, year_period, last_daily_topup, last_monthly_topup, last_yearly_topup,
-		created_at, updated_at
+	rows, err := tx.QueryContext(ctx, `SELECT `+userColumns+`
 		FROM users ORDER BY id`)
 	if err != nil {
 		return nil, err
@@ -127,13 +153,13 @@ func CreateUser(ctx context.Context, tx *sql.Tx, input CreateUserInput) (User, e
 		monthly_limit_cents, yearly_limit_cents,
 		month_spent_cents, year_spent_cents, month_period, year_period,
 		last_daily_topup, last_monthly_topup, last_yearly_topup,
-		created_at, updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?, '', '', '', ?, ?)`,
+		user_group, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, 0, ?, ?, '', '', '', ?, ?, ?)`,
 		input.Username, input.PasswordHash, input.Role, input.Protected, input.ContactName, input.Phone, input.Email,
 		input.BalanceCents, input.DailyTopupCents, input.MonthlyTopupCents, input.YearlyTopupCents,
 		input.MonthlyLimitCents, input.YearlyLimitCents,
 		monthPeriod, yearPeriod,
-		now, now,
+		input.Group, now, now,
 	)
 	if err != nil {
 		return User{}, err
@@ -151,11 +177,11 @@ func UpdateUser(ctx context.Context, tx *sql.Tx, input UpdateUserInput) (User, e
 		if _, err := tx.ExecContext(ctx, `UPDATE users SET
 			username = ?, password_hash = ?, role = ?, contact_name = ?, phone = ?, email = ?,
 			daily_topup_cents = ?, monthly_topup_cents = ?, yearly_topup_cents = ?,
-			monthly_limit_cents = ?, yearly_limit_cents = ?, updated_at = ?
+			monthly_limit_cents = ?, yearly_limit_cents = ?, user_group = COALESCE(?, user_group), updated_at = ?
 			WHERE id = ?`,
 			input.Username, *input.PasswordHash, input.Role, input.ContactName, input.Phone, input.Email,
 			input.DailyTopupCents, input.MonthlyTopupCents, input.YearlyTopupCents,
-			input.MonthlyLimitCents, input.YearlyLimitCents, now, input.ID,
+			input.MonthlyLimitCents, input.YearlyLimitCents, input.Group, now, input.ID,
 		); err != nil {
 			return User{}, err
 		}
@@ -163,11 +189,11 @@ func UpdateUser(ctx context.Context, tx *sql.Tx, input UpdateUserInput) (User, e
 		if _, err := tx.ExecContext(ctx, `UPDATE users SET
 			username = ?, role = ?, contact_name = ?, phone = ?, email = ?,
 			daily_topup_cents = ?, monthly_topup_cents = ?, yearly_topup_cents = ?,
-			monthly_limit_cents = ?, yearly_limit_cents = ?, updated_at = ?
+			monthly_limit_cents = ?, yearly_limit_cents = ?, user_group = COALESCE(?, user_group), updated_at = ?
 			WHERE id = ?`,
 			input.Username, input.Role, input.ContactName, input.Phone, input.Email,
 			input.DailyTopupCents, input.MonthlyTopupCents, input.YearlyTopupCents,
-			input.MonthlyLimitCents, input.YearlyLimitCents, now, input.ID,
+			input.MonthlyLimitCents, input.YearlyLimitCents, input.Group, now, input.ID,
 		); err != nil {
 			return User{}, err
 		}
@@ -198,7 +224,7 @@ func scanUser(s scanner) (User, error) {
 		&user.BalanceCents, &user.DailyTopupCents, &user.MonthlyTopupCents, &user.YearlyTopupCents,
 		&user.MonthlyLimitCents, &user.YearlyLimitCents, &user.MonthSpentCents, &user.YearSpentCents,
 		&user.MonthPeriod, &user.YearPeriod, &user.LastDailyTopup, &user.LastMonthlyTopup, &user.LastYearlyTopup,
-		&user.CreatedAt, &user.UpdatedAt,
+		&user.PinHash, &user.CardNumber, &user.Group, &user.CreatedAt, &user.UpdatedAt,
 	)
 	return user, err
 }
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID        int64
+	URL       string
+	Secret    string
+	Events    []string
+	Enabled   bool
+	CreatedAt string
+	UpdatedAt string
+}
+
+// Subscribed reports whether the webhook wants the given event. An empty
+// event list subscribes to everything.
+func (w Webhook) Subscribed(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookInput struct {
+	URL     string
+	Secret  string
+	Events  []string
+	Enabled bool
+}
+
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      int64
+	URL            string
+	Secret         string
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	NextAttemptAt  string
+	LastError      string
+	ResponseStatus int
+	CreatedAt      string
+	DeliveredAt    sql.NullString
+}
+
+type DeliveryFilter struct {
+	WebhookID int64
+	Status    string
+	Limit     int
+}
+
+func CreateWebhook(ctx context.Context, tx *sql.Tx, input WebhookInput) (Webhook, error) {
+	now := nowUTC()
+	res, err := tx.ExecContext(ctx, `INSERT INTO webhooks (url, secret, events, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, input.URL, input.Secret, strings.Join(input.Events, ","), input.Enabled, now, now)
+	if err != nil {
+		return Webhook{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Webhook{}, err
+	}
+	return GetWebhookByID(ctx, tx, id)
+}
+
+func UpdateWebhook(ctx context.Context, tx *sql.Tx, id int64, input WebhookInput) (Webhook, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE webhooks SET url = ?, secret = ?, events = ?, enabled = ?, updated_at = ?
+		WHERE id = ?`, input.URL, input.Secret, strings.Join(input.Events, ","), input.Enabled, nowUTC(), id)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return Webhook{}, sql.ErrNoRows
+	}
+	return GetWebhookByID(ctx, tx, id)
+}
+
+func DeleteWebhook(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func GetWebhookByID(ctx context.Context, tx *sql.Tx, id int64) (Webhook, error) {
+	row := tx.QueryRowContext(ctx, `SELECT id, url, secret, events, enabled, created_at, updated_at
+		FROM webhooks WHERE id = ?`, id)
+	return scanWebhook(row)
+}
+
+func ListWebhooks(ctx context.Context, tx *sql.Tx) ([]Webhook, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, url, secret, events, enabled, created_at, updated_at
+		FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func scanWebhook(s scanner) (Webhook, error) {
+	var hook Webhook
+	var events string
+	err := s.Scan(&hook.ID, &hook.URL, &hook.Secret, &events, &hook.Enabled, &hook.CreatedAt, &hook.UpdatedAt)
+	if events != "" {
+		hook.Events = strings.Split(events, ",")
+	}
+	return hook, err
+}
+
+// EnqueueWebhookEvent writes one outbox row per enabled webhook subscribed to
+// event. It runs inside the caller's transaction so events are only recorded
+// when the change that produced them commits.
+func EnqueueWebhookEvent(ctx context.Context, tx *sql.Tx, event string, payload string) error {
+	hooks, err := ListWebhooks(ctx, tx)
+	if err != nil {
+		return err
+	}
+	now := nowUTC()
+	for _, hook := range hooks {
+		if !hook.Enabled || !hook.Subscribed(event) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (
+			webhook_id, event, payload, status, attempts, next_attempt_at, last_error, response_status, created_at
+		) VALUES (?, ?, ?, ?, 0, ?, '', 0, ?)`, hook.ID, event, payload, DeliveryPending, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ListDueDeliveries(ctx context.Context, tx *sql.Tx, now string, limit int) ([]WebhookDelivery, error) {
+	return queryDeliveries(ctx, tx, "d.status = ? AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?", DeliveryPending, now, limit)
+}
+
+func ListWebhookDeliveries(ctx context.Context, tx *sql.Tx, filter DeliveryFilter) ([]WebhookDelivery, error) {
+	args := []interface{}{}
+	conds := []string{"1=1"}
+	if filter.WebhookID > 0 {
+		conds = append(conds, "d.webhook_id = ?")
+		args = append(args, filter.WebhookID)
+	}
+	if filter.Status != "" {
+		conds = append(conds, "d.status = ?")
+		args = append(args, filter.Status)
+	}
+	where := strings.Join(conds, " AND ") + " ORDER BY d.id DESC"
+	if filter.Limit > 0 {
+		where += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return queryDeliveries(ctx, tx, where, args...)
+}
+
+func GetWebhookDelivery(ctx context.Context, tx *sql.Tx, id int64) (WebhookDelivery, error) {
+	list, err := queryDeliveries(ctx, tx, "d.id = ?", id)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if len(list) == 0 {
+		return WebhookDelivery{}, sql.ErrNoRows
+	}
+	return list[0], nil
+}
+
+func queryDeliveries(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) ([]WebhookDelivery, error) {
+	query := fmt.Sprintf(`SELECT
+		d.id, d.webhook_id, w.url, w.secret, d.event, d.payload, d.status, d.attempts,
+		d.next_attempt_at, d.last_error, d.response_status, d.created_at, d.delivered_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE %s`, where)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(
+			&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.ResponseStatus, &d.CreatedAt, &d.DeliveredAt,
+		); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+func MarkDeliveryDelivered(ctx context.Context, tx *sql.Tx, id int64, attempts int, responseStatus int) error {
+	now := nowUTC()
+	_, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries SET
+		status = ?, attempts = ?, response_status = ?, last_error = '', delivered_at = ?
+		WHERE id = ?`, DeliveryDelivered, attempts, responseStatus, now, id)
+	return err
+}
+
+// MarkDeliveryAttemptFailed records a failed attempt. When nextAttemptAt is
+// empty the delivery is given up and marked failed.
+func MarkDeliveryAttemptFailed(ctx context.Context, tx *sql.Tx, id int64, attempts int, responseStatus int, lastError string, nextAttemptAt string) error {
+	status := DeliveryPending
+	if nextAttemptAt == "" {
+		status = DeliveryFailed
+		nextAttemptAt = nowUTC()
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries SET
+		status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?`, status, attempts, responseStatus, lastError, nextAttemptAt, id)
+	return err
+}
+
+func RetryWebhookDelivery(ctx context.Context, tx *sql.Tx, id int64) error {
+	res, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, next_attempt_at = ?
+		WHERE id = ?`, DeliveryPending, nowUTC(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
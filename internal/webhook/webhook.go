@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Sign returns the signature sent in X-Webhook-Signature: the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret, prefixed
+// with "sha256=". Receivers should recompute it and reject stale timestamps.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	expected := Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+type Client struct {
+	HTTP *http.Client
+}
+
+func NewClient() *Client {
+	return &Client{HTTP: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Deliver POSTs a signed JSON body to url. It returns the HTTP status code
+// (0 when no response was received) and an error for transport failures and
+// non-2xx responses.
+func (c *Client) Deliver(ctx context.Context, url string, secret string, event string, deliveryID int64, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cups-web-webhook")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, ts, body))
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("http post: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("http status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}